@@ -129,6 +129,64 @@ create table if not exists Image (
 		)
 		userVersion = 4
 	}
+	if userVersion == 4 {
+		api.ddl(
+			`alter table Image add column LinkStatus TEXT NOT NULL DEFAULT ''`,
+			`alter table Image add column LinkCheckedAt INTEGER`,
+			`pragma user_version = 5`,
+		)
+		userVersion = 5
+	}
+	if userVersion == 5 {
+		api.ddl(
+			`alter table Image add column CapturedAt INTEGER`,
+			`alter table Image add column Camera TEXT NOT NULL DEFAULT ''`,
+			`pragma user_version = 6`,
+		)
+		userVersion = 6
+	}
+	if userVersion == 6 {
+		api.ddl(
+			`alter table Image add column ContentHash TEXT NOT NULL DEFAULT ''`,
+			`
+create table if not exists ProcessorRun (
+	ID INTEGER PRIMARY KEY AUTOINCREMENT,
+	ImageID INTEGER NOT NULL,
+	Processor TEXT NOT NULL,
+	StartedAt INTEGER NOT NULL,
+	DurationMS INTEGER NOT NULL,
+	Error TEXT NOT NULL DEFAULT ''
+)`,
+			`create index if not exists IX_ProcessorRun_ImageID on ProcessorRun (ImageID)`,
+			`pragma user_version = 7`,
+		)
+		userVersion = 7
+	}
+	if userVersion == 7 {
+		api.ddl(
+			`alter table Image add column Author TEXT NOT NULL DEFAULT ''`,
+			`alter table Image add column AuthorURL TEXT NOT NULL DEFAULT ''`,
+			`alter table Image add column License TEXT NOT NULL DEFAULT ''`,
+			`pragma user_version = 8`,
+		)
+		userVersion = 8
+	}
+	if userVersion == 8 {
+		api.ddl(
+			`alter table Image add column ParentID INTEGER`,
+			`alter table Image add column DerivationOp TEXT NOT NULL DEFAULT ''`,
+			`create index if not exists IX_Image_ParentID on Image (ParentID)`,
+			`pragma user_version = 9`,
+		)
+		userVersion = 9
+	}
+	if userVersion == 9 {
+		api.ddl(
+			`alter table Image add column ThumbFrame INTEGER`,
+			`pragma user_version = 10`,
+		)
+		userVersion = 10
+	}
 
 	return
 }
@@ -149,6 +207,17 @@ type Image struct {
 	IsHidden       bool
 	IsClean        bool
 	Keywords       string
+	LinkStatus     string
+	LinkCheckedAt  *int64
+	CapturedAt     *int64
+	Camera         string
+	ContentHash    string
+	Author         string
+	AuthorURL      string
+	License        string
+	ParentID       *int64
+	DerivationOp   string
+	ThumbFrame     *int64
 }
 
 type columnNameSet []string
@@ -165,6 +234,17 @@ type dbImage struct {
 	IsHidden       int64          `db:"IsHidden"`
 	IsClean        int64          `db:"IsClean"`
 	Keywords       string         `db:"Keywords"`
+	LinkStatus     string         `db:"LinkStatus"`
+	LinkCheckedAt  sql.NullInt64  `db:"LinkCheckedAt"`
+	CapturedAt     sql.NullInt64  `db:"CapturedAt"`
+	Camera         string         `db:"Camera"`
+	ContentHash    string         `db:"ContentHash"`
+	Author         string         `db:"Author"`
+	AuthorURL      string         `db:"AuthorURL"`
+	License        string         `db:"License"`
+	ParentID       sql.NullInt64  `db:"ParentID"`
+	DerivationOp   string         `db:"DerivationOp"`
+	ThumbFrame     sql.NullInt64  `db:"ThumbFrame"`
 }
 
 var nonIDColumnNames = []string{
@@ -177,6 +257,17 @@ var nonIDColumnNames = []string{
 	"IsHidden",
 	"IsClean",
 	"Keywords",
+	"LinkStatus",
+	"LinkCheckedAt",
+	"CapturedAt",
+	"Camera",
+	"ContentHash",
+	"Author",
+	"AuthorURL",
+	"License",
+	"ParentID",
+	"DerivationOp",
+	"ThumbFrame",
 }
 var nonIDColumns = columnNameSet(nonIDColumnNames).ToCommaDelimited()
 
@@ -193,6 +284,17 @@ func (img *Image) toSQLArgs() []interface{} {
 		boolToInt64(img.IsHidden),
 		boolToInt64(img.IsClean),
 		img.Keywords,
+		img.LinkStatus,
+		ptrToNullInt64(img.LinkCheckedAt),
+		ptrToNullInt64(img.CapturedAt),
+		img.Camera,
+		img.ContentHash,
+		img.Author,
+		img.AuthorURL,
+		img.License,
+		ptrToNullInt64(img.ParentID),
+		img.DerivationOp,
+		ptrToNullInt64(img.ThumbFrame),
 	}
 }
 
@@ -200,6 +302,14 @@ func (names columnNameSet) ToCommaDelimited() string {
 	return strings.Join(names, ", ")
 }
 
+func (names columnNameSet) ToPlaceholders(startArg int) string {
+	args := make([]string, len(names))
+	for i := range names {
+		args[i] = "?" + strconv.FormatInt(int64(startArg+i), 10)
+	}
+	return strings.Join(args, ", ")
+}
+
 func (names columnNameSet) ToUpdateSet(startArg int) string {
 	if len(names) == 0 {
 		return ""
@@ -243,6 +353,17 @@ func mapRecToModel(r *dbImage, m *Image) *Image {
 	m.IsHidden = int64ToBool(r.IsHidden)
 	m.IsClean = int64ToBool(r.IsClean)
 	m.Keywords = r.Keywords
+	m.LinkStatus = r.LinkStatus
+	m.LinkCheckedAt = nullInt64ToPtr(r.LinkCheckedAt)
+	m.CapturedAt = nullInt64ToPtr(r.CapturedAt)
+	m.Camera = r.Camera
+	m.ContentHash = r.ContentHash
+	m.Author = r.Author
+	m.AuthorURL = r.AuthorURL
+	m.License = r.License
+	m.ParentID = nullInt64ToPtr(r.ParentID)
+	m.DerivationOp = r.DerivationOp
+	m.ThumbFrame = nullInt64ToPtr(r.ThumbFrame)
 	return m
 }
 
@@ -262,11 +383,11 @@ func (api *API) NewImage(img *Image) (int64, error) {
 	var args []interface{}
 	if img.ID <= 0 {
 		// Insert a new record:
-		query = `insert into Image (` + nonIDColumns + `) values (?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8, ?9)`
+		query = `insert into Image (` + nonIDColumns + `) values (` + columnNameSet(nonIDColumnNames).ToPlaceholders(1) + `)`
 		args = img.toSQLArgs()[1:]
 	} else {
 		// Do an identity insert:
-		query = `insert into Image (ID, ` + nonIDColumns + `) values (?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8, ?9, ?10)`
+		query = `insert into Image (ID, ` + nonIDColumns + `) values (?1, ` + columnNameSet(nonIDColumnNames).ToPlaceholders(2) + `)`
 		args = img.toSQLArgs()
 	}
 
@@ -302,7 +423,56 @@ func (api *API) Update(img *Image) error {
 	return nil
 }
 
+// Records the outcome of a link check without touching the rest of the record:
+func (api *API) UpdateLinkStatus(id int64, status string, checkedAt int64) error {
+	_, err := api.db.Exec(`update Image set LinkStatus = ?2, LinkCheckedAt = ?3 where ID = ?1`, id, status, checkedAt)
+	return err
+}
+
+// Timing and outcome of a single processor run against an image:
+type ProcessorRun struct {
+	ID         int64  `db:"ID"`
+	ImageID    int64  `db:"ImageID"`
+	Processor  string `db:"Processor"`
+	StartedAt  int64  `db:"StartedAt"`
+	DurationMS int64  `db:"DurationMS"`
+	Error      string `db:"Error"`
+}
+
+func (api *API) AddProcessorRun(run *ProcessorRun) error {
+	_, err := api.db.Exec(
+		`insert into ProcessorRun (ImageID, Processor, StartedAt, DurationMS, Error) values (?1, ?2, ?3, ?4, ?5)`,
+		run.ImageID, run.Processor, run.StartedAt, run.DurationMS, run.Error,
+	)
+	return err
+}
+
+// Gets the processor runs for an image, most recent first:
+func (api *API) GetProcessorRuns(imageID int64) (runs []ProcessorRun, err error) {
+	runs = make([]ProcessorRun, 0, 8)
+	err = api.db.Select(&runs, `select ID, ImageID, Processor, StartedAt, DurationMS, Error from ProcessorRun where ImageID = ?1 order by ID DESC`, imageID)
+	return
+}
+
+// Lists the images made from an image, oldest first:
+func (api *API) GetDerivedImages(parentID int64) (imgs []Image, err error) {
+	recs := make([]dbImage, 0, 4)
+	err = api.db.Select(&recs, `select ID, `+nonIDColumns+` from Image where ParentID = ?1 order by ID ASC`, parentID)
+	if err != nil {
+		return
+	}
+
+	imgs = make([]Image, len(recs))
+	for i := range recs {
+		mapRecToModel(&recs[i], &imgs[i])
+	}
+	return
+}
+
 func (api *API) Delete(id int64) (err error) {
+	if _, err = api.db.Exec(`delete from ProcessorRun where ImageID = ?1`, id); err != nil {
+		return
+	}
 	_, err = api.db.Exec(`delete from Image where ID = ?1`, id)
 	return
 }
@@ -335,22 +505,38 @@ func (orderBy ImagesOrderBy) ToSQL() string {
 }
 
 func (api *API) GetList(collectionName string, includeBase bool, orderBy ImagesOrderBy) (imgs []Image, err error) {
-	ob := orderBy.ToSQL()
+	return api.selectList(collectionName, includeBase, nil, orderBy)
+}
 
-	recs := make([]dbImage, 0, 200)
+// Selects images of a collection, limited to the given licenses if any (see licenseCondition):
+func (api *API) selectList(collectionName string, includeBase bool, licenses []string, orderBy ImagesOrderBy) (imgs []Image, err error) {
+	ob := orderBy.ToSQL()
 
-	if collectionName == "all" {
+	conds := make([]string, 0, 2)
+	args := make([]interface{}, 0, 4)
+	if collectionName != "all" {
 		// Special collection name "all" yields all images across all collections.
-		err = api.db.Select(&recs, `select ID, `+nonIDColumns+` from Image `+ob)
-	} else {
+		args = append(args, collectionName)
 		if includeBase {
 			// Include items from base collection:
-			err = api.db.Select(&recs, `select ID, `+nonIDColumns+` from Image where CollectionName = ?1 or CollectionName = '' `+ob, collectionName)
+			conds = append(conds, `(CollectionName = ?1 or CollectionName = '')`)
 		} else {
 			// Only query items from specific collection:
-			err = api.db.Select(&recs, `select ID, `+nonIDColumns+` from Image where CollectionName = ?1 `+ob, collectionName)
+			conds = append(conds, `CollectionName = ?1`)
 		}
 	}
+	if cond, condArgs := licenseCondition(licenses, len(args)+1); cond != "" {
+		conds = append(conds, cond)
+		args = append(args, condArgs...)
+	}
+
+	where := ""
+	if len(conds) > 0 {
+		where = `where ` + strings.Join(conds, ` and `) + ` `
+	}
+
+	recs := make([]dbImage, 0, 200)
+	err = api.db.Select(&recs, `select ID, `+nonIDColumns+` from Image `+where+ob, args...)
 	if err != nil {
 		return
 	}
@@ -429,9 +615,9 @@ func keywordMatch(keywords []string, list []Image) (winners []Image) {
 	return
 }
 
-func (api *API) Search(keywords []string, collectionName string, includeBase bool, orderBy ImagesOrderBy) (winners []Image, err error) {
+func (api *API) Search(keywords []string, collectionName string, includeBase bool, licenses []string, orderBy ImagesOrderBy) (winners []Image, err error) {
 	// Pull down records server-side and search through them:
-	imgs, err := api.GetList(collectionName, includeBase, orderBy)
+	imgs, err := api.selectList(collectionName, includeBase, licenses, orderBy)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+import "github.com/JamesDunne/go-util/web"
+
+// Limits applied when extracting uploaded archives:
+var (
+	archiveMaxEntries = 1000
+	archiveMaxBytes   = int64(1 << 30)
+)
+
+// Recognized archive kinds by file name:
+func archiveKind(name string) string {
+	name = strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(name, ".zip"):
+		return "zip"
+	case strings.HasSuffix(name, ".tar"):
+		return "tar"
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return "tgz"
+	}
+	return ""
+}
+
+// Image file extensions accepted from archives:
+func isImageFileName(name string) bool {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".gif", ".jpg", ".jpeg", ".png", ".webp", ".bmp", ".tif", ".tiff", ".svg", ".mp4", ".webm":
+		return true
+	}
+	return false
+}
+
+// Derives keywords from an entry's directory names and file name, e.g. "reactions/happy/dance.gif" -> "reactions happy dance":
+func archiveEntryKeywords(name string) string {
+	dir, file := path.Split(name)
+	return titleToKeywords(strings.Replace(dir, "/", " ", -1) + " " + filenameToTitle(file))
+}
+
+// State for extracting the image entries of a single archive into temporary files:
+type archiveExtractor struct {
+	archive *uploadedFile
+	files   []*uploadedFile
+	skipped []uploadResult
+	entries int
+	bytes   int64
+}
+
+func (x *archiveExtractor) skip(name, reason string) {
+	x.skipped = append(x.skipped, uploadResult{FileName: x.archive.FileName + ":" + name, Skipped: reason})
+}
+
+// Extracts a single entry; returns an error only when the whole archive must be abandoned:
+func (x *archiveExtractor) extract(name string, isRegular bool, r io.Reader) error {
+	x.entries++
+	if x.entries > archiveMaxEntries {
+		return fmt.Errorf("Archive '%s' has more than %d entries", x.archive.FileName, archiveMaxEntries)
+	}
+
+	// Reject absolute paths and parent directory references:
+	clean := path.Clean(strings.Replace(name, "\\", "/", -1))
+	if path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+		x.skip(name, "unsafe path")
+		return nil
+	}
+	if !isRegular {
+		if !strings.HasSuffix(name, "/") {
+			x.skip(name, "not a regular file")
+		}
+		return nil
+	}
+
+	// Skip metadata added by archivers, e.g. `__MACOSX/` and `._name` files:
+	_, file := path.Split(clean)
+	if strings.HasPrefix(clean, "__MACOSX/") || strings.HasPrefix(file, ".") {
+		return nil
+	}
+	if !isImageFileName(clean) {
+		x.skip(name, "not an image")
+		return nil
+	}
+
+	f, err := TempFile(tmp_folder(), "ar-", path.Ext(clean))
+	if err != nil {
+		return err
+	}
+	x.files = append(x.files, &uploadedFile{
+		FieldName: x.archive.FieldName,
+		FileName:  clean,
+		LocalPath: f.Name(),
+		Title:     filenameToTitle(file),
+		Keywords:  archiveEntryKeywords(clean),
+	})
+
+	// Enforce the total extracted size across all entries:
+	n, err := io.Copy(f, io.LimitReader(r, archiveMaxBytes-x.bytes+1))
+	f.Close()
+	if err != nil {
+		return err
+	}
+	x.bytes += n
+	if x.bytes > archiveMaxBytes {
+		return fmt.Errorf("Archive '%s' extracts to more than %d bytes", x.archive.FileName, archiveMaxBytes)
+	}
+	return nil
+}
+
+func (x *archiveExtractor) extractZip() error {
+	zr, err := zip.OpenReader(x.archive.LocalPath)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	for _, zf := range zr.File {
+		if err = func() error {
+			if !zf.Mode().IsRegular() {
+				return x.extract(zf.Name, false, nil)
+			}
+
+			r, err := zf.Open()
+			if err != nil {
+				return err
+			}
+			defer r.Close()
+			return x.extract(zf.Name, true, r)
+		}(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (x *archiveExtractor) extractTar(gzipped bool) error {
+	f, err := os.Open(x.archive.LocalPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if gzipped {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		isRegular := hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeRegA
+		if err = x.extract(hdr.Name, isRegular, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// Replaces any archives among the uploaded files with the images extracted from them.
+// Archives are removed after extraction; skipped entries are reported. On error, all files are removed.
+func expandArchives(uploads []*uploadedFile) (files []*uploadedFile, skipped []uploadResult, err error) {
+	files = make([]*uploadedFile, 0, len(uploads))
+	for i, up := range uploads {
+		kind := archiveKind(up.FileName)
+		if kind == "" {
+			files = append(files, up)
+			continue
+		}
+
+		x := &archiveExtractor{archive: up}
+		switch kind {
+		case "zip":
+			err = x.extractZip()
+		case "tar":
+			err = x.extractTar(false)
+		case "tgz":
+			err = x.extractTar(true)
+		}
+		os.Remove(up.LocalPath)
+
+		files = append(files, x.files...)
+		skipped = append(skipped, x.skipped...)
+		if err != nil {
+			removeUploads(files)
+			removeUploads(uploads[i+1:])
+			return nil, skipped, err
+		}
+	}
+	return files, skipped, nil
+}
+
+// Stores the images of an archive sent as a raw request body, e.g. `POST /api/v1/archive/memes?name=gifs.zip&keywords=reaction`.
+// The archive kind comes from the `name` query value or else the Content-Type header.
+func storeArchiveBody(req *http.Request, collectionName string) (results []uploadResult, werr *web.Error) {
+	query := req.URL.Query()
+
+	name := query.Get("name")
+	if archiveKind(name) == "" {
+		switch strings.ToLower(strings.TrimSpace(strings.Split(req.Header.Get("Content-Type"), ";")[0])) {
+		case "application/zip", "application/x-zip-compressed":
+			name = "upload.zip"
+		case "application/x-tar":
+			name = "upload.tar"
+		case "application/gzip", "application/x-gzip", "application/x-compressed-tar":
+			name = "upload.tar.gz"
+		default:
+			return nil, web.AsError(fmt.Errorf("Unrecognized archive type; supply a 'name' ending in .zip, .tar, .tar.gz or .tgz"), http.StatusUnsupportedMediaType)
+		}
+	}
+
+	// Save the request body to a local file:
+	os.MkdirAll(tmp_folder(), 0755)
+	f, err := TempFile(tmp_folder(), "up-", path.Ext(name))
+	if werr = web.AsError(err, http.StatusInternalServerError); werr != nil {
+		return nil, werr
+	}
+	_, err = io.Copy(f, req.Body)
+	f.Close()
+	if werr = web.AsError(err, http.StatusInternalServerError); werr != nil {
+		os.Remove(f.Name())
+		return nil, werr
+	}
+
+	files, skipped, err := expandArchives([]*uploadedFile{{FileName: name, LocalPath: f.Name()}})
+	if werr = web.AsError(err, http.StatusBadRequest); werr != nil {
+		return nil, werr
+	}
+
+	values := map[string]string{
+		"keywords": query.Get("keywords"),
+		"nsfw":     query.Get("nsfw"),
+	}
+	results = storeUploads(collectionName, req.RemoteAddr, values, files)
+	return append(results, skipped...), nil
+}
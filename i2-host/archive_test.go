@@ -0,0 +1,76 @@
+package main
+
+import (
+	"archive/zip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_expandArchives(t *testing.T) {
+	dir, done := withTempStore(t)
+	defer done()
+	os.MkdirAll(tmp_folder(), 0755)
+
+	// Build a zip with a mix of good and bad entries:
+	zip_path := filepath.Join(dir, "upload.zip")
+	zf, err := os.Create(zip_path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(zf)
+	for _, name := range []string{"reactions/happy/dance_party.gif", "../escape.gif", "notes.txt", "__MACOSX/reactions/._dance_party.gif"} {
+		w, _ := zw.Create(name)
+		w.Write([]byte("GIF89a"))
+	}
+	zw.Close()
+	zf.Close()
+
+	files, skipped, err := expandArchives([]*uploadedFile{{FileName: "upload.zip", LocalPath: zip_path}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer removeUploads(files)
+
+	if len(files) != 1 {
+		t.Fatalf("expected 1 file, got %d", len(files))
+	}
+	if f := files[0]; f.FileName != "reactions/happy/dance_party.gif" || f.Title != "dance party" || f.Keywords != "reactions happy dance party" {
+		t.Errorf("file = %+v", *f)
+	}
+	if len(skipped) != 2 || skipped[0].Skipped != "unsafe path" || skipped[1].Skipped != "not an image" {
+		t.Errorf("skipped = %+v", skipped)
+	}
+	if _, err := os.Stat(zip_path); !os.IsNotExist(err) {
+		t.Errorf("archive was not removed")
+	}
+}
+
+func Test_expandArchives_limits(t *testing.T) {
+	dir, done := withTempStore(t)
+	defer done()
+	os.MkdirAll(tmp_folder(), 0755)
+
+	defer func(old int64) { archiveMaxBytes = old }(archiveMaxBytes)
+	archiveMaxBytes = 10
+
+	zip_path := filepath.Join(dir, "big.zip")
+	zf, _ := os.Create(zip_path)
+	zw := zip.NewWriter(zf)
+	w, _ := zw.Create("big.gif")
+	w.Write(make([]byte, 64))
+	zw.Close()
+	zf.Close()
+
+	files, _, err := expandArchives([]*uploadedFile{{FileName: "big.zip", LocalPath: zip_path}})
+	if err == nil {
+		t.Fatal("expected size limit error")
+	}
+	if files != nil {
+		t.Errorf("files = %v", files)
+	}
+	if left, _ := ioutil.ReadDir(tmp_folder()); len(left) != 0 {
+		t.Errorf("temporary files left behind: %d", len(left))
+	}
+}
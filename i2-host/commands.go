@@ -0,0 +1,28 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Maintenance commands run instead of the server, e.g. `i2-host -fs /srv/i2 import manifest.csv`:
+var commands = map[string]func(args []string) error{
+	"import":        importCommand,
+	"backfill-gifv": backfillGifvCommand,
+	"reprocess":     reprocessCommand,
+}
+
+func runCommand(args []string) error {
+	cmd, ok := commands[args[0]]
+	if !ok {
+		names := make([]string, 0, len(commands))
+		for name := range commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("Unknown command '%s'; available commands: %s", args[0], strings.Join(names, ", "))
+	}
+
+	return cmd(args[1:])
+}
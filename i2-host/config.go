@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// Per-collection settings, e.g. `{"collections": {"memes": {"inbox": "/srv/inbox/memes"}}}`:
+type collectionConfig struct {
+	// Directory watched for new files to ingest into the collection:
+	Inbox string `json:"inbox,omitempty"`
+	// Remove EXIF, XMP and IPTC metadata from stored JPEG originals:
+	StripMetadata bool `json:"stripMetadata,omitempty"`
+}
+
+// An external command run as a processor, e.g. `{"name": "virus-scan", "command": ["clamscan", "--no-summary"]}`:
+type hookConfig struct {
+	Name    string   `json:"name"`
+	Command []string `json:"command"`
+	// Seconds before the command is killed; defaults to 10:
+	Timeout int `json:"timeout,omitempty"`
+}
+
+type serverConfig struct {
+	Collections map[string]*collectionConfig `json:"collections"`
+	// Names of the processors run on new images in order; defaults to metadata, strip-metadata and hash:
+	Processors []string     `json:"processors,omitempty"`
+	Hooks      []hookConfig `json:"hooks,omitempty"`
+}
+
+var config = &serverConfig{}
+
+// Reads the config file; a missing file yields an empty config:
+func loadConfig(config_path string) (*serverConfig, error) {
+	c := &serverConfig{}
+
+	f, err := os.Open(config_path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if err = json.NewDecoder(f).Decode(c); err != nil {
+		return nil, err
+	}
+
+	// stripMetadata only takes effect through the strip-metadata processor:
+	if len(c.Processors) > 0 && !hasProcessor(c.Processors, "strip-metadata") {
+		for name, coll := range c.Collections {
+			if coll != nil && coll.StripMetadata {
+				return nil, fmt.Errorf("Collection '%s' sets stripMetadata but the processors list does not include strip-metadata", name)
+			}
+		}
+	}
+	return c, nil
+}
+
+func hasProcessor(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Settings for a collection; collections not in the config get the defaults:
+func configFor(collectionName string) *collectionConfig {
+	if c, ok := config.Collections[collectionName]; ok && c != nil {
+		return c
+	}
+	return &collectionConfig{}
+}
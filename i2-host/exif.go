@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"strings"
+)
+
+import "github.com/rwcarlsen/goexif/exif"
+
+// The safe subset of EXIF metadata kept for JPEG images:
+type imageMetadata struct {
+	Orientation int
+	CapturedAt  *int64
+	Camera      string
+}
+
+// Reads EXIF metadata from a JPEG file; files without EXIF yield empty metadata:
+func readJPEGMetadata(local_path string) (*imageMetadata, error) {
+	f, err := os.Open(local_path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return decodeJPEGMetadata(f), nil
+}
+
+func decodeJPEGMetadata(r io.Reader) *imageMetadata {
+	md := &imageMetadata{Orientation: 1}
+
+	x, err := exif.Decode(r)
+	if err != nil {
+		return md
+	}
+
+	if tag, err := x.Get(exif.Orientation); err == nil {
+		if o, err := tag.Int(0); err == nil && o >= 1 && o <= 8 {
+			md.Orientation = o
+		}
+	}
+	if t, err := x.DateTime(); err == nil {
+		unix := t.Unix()
+		md.CapturedAt = &unix
+	}
+
+	// Camera is "<make> <model>" without repeating the make, e.g. "Apple iPhone 6":
+	camera := make([]string, 0, 2)
+	for _, name := range []exif.FieldName{exif.Make, exif.Model} {
+		if tag, err := x.Get(name); err == nil {
+			if s, err := tag.StringVal(); err == nil {
+				if s = strings.TrimSpace(strings.Trim(s, "\x00")); s != "" {
+					camera = append(camera, s)
+				}
+			}
+		}
+	}
+	if len(camera) == 2 && strings.HasPrefix(strings.ToLower(camera[1]), strings.ToLower(camera[0])) {
+		camera = camera[1:]
+	}
+	md.Camera = strings.Join(camera, " ")
+
+	return md
+}
+
+// Transforms an image as its EXIF orientation (1-8) requires for display, returning an *image.RGBA
+// unless it is left as it is:
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+
+	// Orientations 5-8 swap width and height:
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+
+	// Maps destination coordinates to source coordinates:
+	var src func(x, y int) (int, int)
+	switch orientation {
+	case 2: // flip horizontal
+		src = func(x, y int) (int, int) { return w - 1 - x, y }
+	case 3: // rotate 180
+		src = func(x, y int) (int, int) { return w - 1 - x, h - 1 - y }
+	case 4: // flip vertical
+		src = func(x, y int) (int, int) { return x, h - 1 - y }
+	case 5: // transpose
+		src = func(x, y int) (int, int) { return y, x }
+	case 6: // rotate 90 clockwise
+		src = func(x, y int) (int, int) { return y, h - 1 - x }
+	case 7: // transverse
+		src = func(x, y int) (int, int) { return w - 1 - y, h - 1 - x }
+	case 8: // rotate 90 counter-clockwise
+		src = func(x, y int) (int, int) { return w - 1 - y, x }
+	}
+
+	// Move whole pixels between Pix slices rather than converting colors one at a time:
+	s, ok := img.(*image.RGBA)
+	if !ok {
+		s = toRGBA(img)
+	}
+	offset := func(x, y int) int {
+		sx, sy := src(x, y)
+		return s.PixOffset(s.Rect.Min.X+sx, s.Rect.Min.Y+sy)
+	}
+
+	// Source offsets step evenly along destination rows and columns:
+	start := offset(0, 0)
+	stepX, stepY := offset(1, 0)-start, offset(0, 1)-start
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		i := start + y*stepY
+		row := dst.Pix[y*dst.Stride : y*dst.Stride+dw*4]
+		for x := 0; x < len(row); x += 4 {
+			copy(row[x:x+4], s.Pix[i:i+4])
+			i += stepX
+		}
+	}
+	return dst
+}
+
+// JPEG markers:
+const (
+	jpegSOI  = 0xD8
+	jpegSOS  = 0xDA
+	jpegAPP0 = 0xE0
+	jpegAPP1 = 0xE1
+	jpegAPPD = 0xED
+	jpegCOM  = 0xFE
+)
+
+// Builds an APP1 segment holding an EXIF block with nothing but the orientation tag:
+func orientationSegment(orientation int) []byte {
+	seg := []byte{
+		0xFF, jpegAPP1, 0, 34,
+		'E', 'x', 'i', 'f', 0, 0,
+		// Big-endian TIFF header with the IFD at offset 8:
+		'M', 'M', 0, 42, 0, 0, 0, 8,
+		// One entry: Orientation (0x0112), SHORT, count 1:
+		0, 1, 0x01, 0x12, 0, 3, 0, 0, 0, 1, 0, 0, 0, 0,
+		// No next IFD:
+		0, 0, 0, 0,
+	}
+	binary.BigEndian.PutUint16(seg[28:30], uint16(orientation))
+	return seg
+}
+
+// Losslessly copies a JPEG without its EXIF, XMP, IPTC and comment segments. A non-default
+// orientation is kept in a minimal EXIF segment so the image still displays the right way up.
+func stripJPEGMetadata(r io.Reader, w io.Writer, orientation int) error {
+	br := bufio.NewReader(r)
+	bw := bufio.NewWriter(w)
+
+	var soi [2]byte
+	if _, err := io.ReadFull(br, soi[:]); err != nil {
+		return err
+	}
+	if soi[0] != 0xFF || soi[1] != jpegSOI {
+		return fmt.Errorf("Not a JPEG file")
+	}
+	bw.Write(soi[:])
+
+	wroteOrientation := orientation <= 1
+	for {
+		// Find the next marker, skipping fill bytes:
+		b, err := br.ReadByte()
+		if err != nil {
+			return err
+		}
+		if b != 0xFF {
+			return fmt.Errorf("Malformed JPEG: expected marker")
+		}
+		marker := byte(0xFF)
+		for marker == 0xFF {
+			if marker, err = br.ReadByte(); err != nil {
+				return err
+			}
+		}
+
+		// Markers without a length:
+		if marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) {
+			bw.Write([]byte{0xFF, marker})
+			continue
+		}
+
+		var lenb [2]byte
+		if _, err = io.ReadFull(br, lenb[:]); err != nil {
+			return err
+		}
+		n := int(binary.BigEndian.Uint16(lenb[:]))
+		if n < 2 {
+			return fmt.Errorf("Malformed JPEG: bad segment length")
+		}
+
+		// The EXIF segment must follow SOI or a JFIF APP0:
+		if !wroteOrientation && marker != jpegAPP0 {
+			bw.Write(orientationSegment(orientation))
+			wroteOrientation = true
+		}
+
+		if marker == jpegAPP1 || marker == jpegAPPD || marker == jpegCOM {
+			if _, err = br.Discard(n - 2); err != nil {
+				return err
+			}
+			continue
+		}
+
+		bw.Write([]byte{0xFF, marker})
+		bw.Write(lenb[:])
+		if _, err = io.CopyN(bw, br, int64(n-2)); err != nil {
+			return err
+		}
+
+		// Entropy-coded data and the rest of the file follow the start of scan:
+		if marker == jpegSOS {
+			if _, err = io.Copy(bw, br); err != nil {
+				return err
+			}
+			return bw.Flush()
+		}
+	}
+}
+
+// Rewrites a JPEG file in place without its identifying metadata:
+func stripJPEGFile(local_path string, orientation int) error {
+	src, err := os.Open(local_path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmpf, err := TempFile(tmp_folder(), "strip-", ".jpg")
+	if err != nil {
+		return err
+	}
+	err = stripJPEGMetadata(src, tmpf, orientation)
+	tmpf.Close()
+	if err != nil {
+		os.Remove(tmpf.Name())
+		return err
+	}
+
+	src.Close()
+	return os.Rename(tmpf.Name(), local_path)
+}
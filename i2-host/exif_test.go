@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+)
+
+// Builds a JPEG carrying an APP1 segment with the given orientation plus a comment segment:
+func testJPEG(t *testing.T, w, h, orientation int) []byte {
+	buf := &bytes.Buffer{}
+	if err := jpeg.Encode(buf, image.NewGray(image.Rect(0, 0, w, h)), nil); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+
+	out := &bytes.Buffer{}
+	out.Write(b[:2])
+	out.Write(orientationSegment(orientation))
+	out.Write([]byte{0xFF, jpegCOM, 0, 7, 's', 'e', 'c', 'r', 'e'})
+	out.Write(b[2:])
+	return out.Bytes()
+}
+
+func Test_stripJPEGMetadata(t *testing.T) {
+	src := testJPEG(t, 4, 2, 6)
+	if md := decodeJPEGMetadata(bytes.NewReader(src)); md.Orientation != 6 {
+		t.Fatalf("expected orientation 6, got %d", md.Orientation)
+	}
+
+	out := &bytes.Buffer{}
+	if err := stripJPEGMetadata(bytes.NewReader(src), out, 6); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(out.Bytes(), []byte("secre")) {
+		t.Error("comment segment was not stripped")
+	}
+
+	// Orientation survives and the image still decodes:
+	if md := decodeJPEGMetadata(bytes.NewReader(out.Bytes())); md.Orientation != 6 {
+		t.Errorf("expected orientation 6 after stripping, got %d", md.Orientation)
+	}
+	img, err := jpeg.Decode(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds().Dx() != 4 || img.Bounds().Dy() != 2 {
+		t.Errorf("unexpected bounds %v", img.Bounds())
+	}
+
+	// Without an orientation nothing of EXIF remains:
+	out.Reset()
+	if err := stripJPEGMetadata(bytes.NewReader(src), out, 1); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(out.Bytes(), []byte("Exif")) {
+		t.Error("EXIF segment was not stripped")
+	}
+}
+
+func Test_applyOrientation(t *testing.T) {
+	// A 2x1 image with a white pixel on the left:
+	img := image.NewGray(image.Rect(0, 0, 2, 1))
+	img.Set(0, 0, color.White)
+
+	tests := []struct {
+		orientation int
+		w, h        int
+		x, y        int
+	}{
+		{1, 2, 1, 0, 0},
+		{2, 2, 1, 1, 0},
+		{3, 2, 1, 1, 0},
+		{6, 1, 2, 0, 0},
+		{8, 1, 2, 0, 1},
+	}
+	for _, test := range tests {
+		out := applyOrientation(img, test.orientation)
+		b := out.Bounds()
+		if b.Dx() != test.w || b.Dy() != test.h {
+			t.Errorf("orientation %d: expected %dx%d, got %v", test.orientation, test.w, test.h, b)
+			continue
+		}
+		if r, _, _, _ := out.At(test.x, test.y).RGBA(); r != 0xffff {
+			t.Errorf("orientation %d: expected white pixel at %d,%d", test.orientation, test.x, test.y)
+		}
+	}
+}
+
+func Test_applyOrientation_subImage(t *testing.T) {
+	// A 3x2 image of distinct pixels inside a larger one:
+	big := image.NewRGBA(image.Rect(-5, -5, 10, 10))
+	for y := 0; y < 2; y++ {
+		for x := 0; x < 3; x++ {
+			big.SetRGBA(x+1, y+2, color.RGBA{uint8(x), uint8(y), 0, 255})
+		}
+	}
+	img := big.SubImage(image.Rect(1, 2, 4, 4))
+
+	// Where the source pixel shown at the destination's top left and its right neighbour come from:
+	tests := []struct {
+		orientation int
+		first, next image.Point
+	}{
+		{2, image.Pt(2, 0), image.Pt(1, 0)},
+		{3, image.Pt(2, 1), image.Pt(1, 1)},
+		{4, image.Pt(0, 1), image.Pt(1, 1)},
+		{5, image.Pt(0, 0), image.Pt(0, 1)},
+		{6, image.Pt(0, 1), image.Pt(0, 0)},
+		{7, image.Pt(2, 1), image.Pt(2, 0)},
+		{8, image.Pt(2, 0), image.Pt(2, 1)},
+	}
+	for _, test := range tests {
+		out := applyOrientation(img, test.orientation)
+		for i, p := range []image.Point{test.first, test.next} {
+			if c := color.RGBAModel.Convert(out.At(i, 0)).(color.RGBA); c.R != uint8(p.X) || c.G != uint8(p.Y) {
+				t.Errorf("orientation %d: pixel %d,0 came from %d,%d; expected %v", test.orientation, i, c.R, c.G, p)
+			}
+		}
+	}
+}
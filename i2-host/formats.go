@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/draw"
+	"io"
+	"io/ioutil"
+)
+
+import (
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/tiff"
+	"golang.org/x/image/webp"
+)
+
+// WebP, BMP and TIFF images are decoded with golang.org/x/image and thumbnailed as PNG.
+// The webp package cannot decode animated WebPs, so their first frame is cut out of the
+// animation and decoded as a still image of its own.
+
+// Reads the chunks of a RIFF container, e.g. a WebP file:
+func readRIFFChunks(data []byte) (chunks []riffChunk, err error) {
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return nil, fmt.Errorf("Corrupt WebP: truncated chunk header")
+		}
+		size := binary.LittleEndian.Uint32(data[4:8])
+		if uint64(size) > uint64(len(data)-8) {
+			return nil, fmt.Errorf("Corrupt WebP: chunk '%s' is truncated", data[:4])
+		}
+		chunks = append(chunks, riffChunk{FourCC: string(data[:4]), Data: data[8 : 8+size]})
+
+		// Chunks are padded to an even size:
+		next := 8 + int(size) + int(size&1)
+		if next > len(data) {
+			break
+		}
+		data = data[next:]
+	}
+	return chunks, nil
+}
+
+type riffChunk struct {
+	FourCC string
+	Data   []byte
+}
+
+func (c riffChunk) appendTo(b []byte) []byte {
+	var hdr [8]byte
+	copy(hdr[:4], c.FourCC)
+	binary.LittleEndian.PutUint32(hdr[4:], uint32(len(c.Data)))
+	b = append(b, hdr[:]...)
+	b = append(b, c.Data...)
+	if len(c.Data)&1 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+func uint24(b []byte) int {
+	return int(b[0]) | int(b[1])<<8 | int(b[2])<<16
+}
+
+func putUint24(b []byte, v int) {
+	b[0], b[1], b[2] = byte(v), byte(v>>8), byte(v>>16)
+}
+
+// Decodes a WebP; animated WebPs decode to their first frame drawn on the full canvas:
+func decodeWebP(r io.Reader) (image.Image, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, fmt.Errorf("Not a WebP image")
+	}
+	chunks, err := readRIFFChunks(data[12:])
+	if err != nil {
+		return nil, err
+	}
+
+	// VP8X flags bit 1 marks an animation:
+	if len(chunks) == 0 || chunks[0].FourCC != "VP8X" || len(chunks[0].Data) < 10 || chunks[0].Data[0]&0x02 == 0 {
+		return webp.Decode(bytes.NewReader(data))
+	}
+	canvas := image.NewNRGBA(image.Rect(0, 0, uint24(chunks[0].Data[4:])+1, uint24(chunks[0].Data[7:])+1))
+
+	for _, c := range chunks[1:] {
+		if c.FourCC != "ANMF" {
+			continue
+		}
+		if len(c.Data) < 16 {
+			return nil, fmt.Errorf("Corrupt WebP: truncated animation frame")
+		}
+		// Frame header: X/2, Y/2, width-1, height-1, duration and flags:
+		x, y := uint24(c.Data[0:])*2, uint24(c.Data[3:])*2
+		w, h := uint24(c.Data[6:])+1, uint24(c.Data[9:])+1
+
+		frame, err := decodeWebPFrame(c.Data[16:], w, h)
+		if err != nil {
+			return nil, err
+		}
+		draw.Draw(canvas, image.Rect(x, y, x+w, y+h), frame, frame.Bounds().Min, draw.Src)
+		return canvas, nil
+	}
+	return nil, fmt.Errorf("Corrupt WebP: animation has no frames")
+}
+
+// Decodes the bitstream chunks of an animation frame by wrapping them in a still WebP:
+func decodeWebPFrame(data []byte, w, h int) (image.Image, error) {
+	frameChunks, err := readRIFFChunks(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var alpha, bitstream *riffChunk
+	for i := range frameChunks {
+		switch frameChunks[i].FourCC {
+		case "ALPH":
+			alpha = &frameChunks[i]
+		case "VP8 ", "VP8L":
+			bitstream = &frameChunks[i]
+		}
+	}
+	if bitstream == nil {
+		return nil, fmt.Errorf("Corrupt WebP: animation frame has no image data")
+	}
+
+	body := []byte("WEBP")
+	if alpha != nil && bitstream.FourCC == "VP8 " {
+		// A lossy frame with a separate alpha plane needs a VP8X header with the alpha flag:
+		vp8x := make([]byte, 10)
+		vp8x[0] = 0x10
+		putUint24(vp8x[4:], w-1)
+		putUint24(vp8x[7:], h-1)
+		body = riffChunk{FourCC: "VP8X", Data: vp8x}.appendTo(body)
+		body = alpha.appendTo(body)
+	}
+	body = bitstream.appendTo(body)
+
+	still := riffChunk{FourCC: "RIFF", Data: body}.appendTo(nil)
+	return webp.Decode(bytes.NewReader(still))
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+import (
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
+)
+
+// Writes bits least significant first, as VP8L bitstreams are read:
+type bitWriter struct {
+	buf  []byte
+	nbit uint
+}
+
+func (b *bitWriter) write(v uint32, n uint) {
+	for i := uint(0); i < n; i++ {
+		if b.nbit%8 == 0 {
+			b.buf = append(b.buf, 0)
+		}
+		b.buf[len(b.buf)-1] |= byte((v>>i)&1) << (b.nbit % 8)
+		b.nbit++
+	}
+}
+
+// Encodes a lossless WebP bitstream of a single color; every Huffman code has one symbol so no pixel bits follow:
+func vp8lSolid(w, h int, c color.NRGBA) []byte {
+	b := &bitWriter{}
+	b.write(0x2f, 8)
+	b.write(uint32(w-1), 14)
+	b.write(uint32(h-1), 14)
+	b.write(1, 1) // alpha is used
+	b.write(0, 3) // version
+	b.write(0, 1) // no transforms
+	b.write(0, 1) // no color cache
+	b.write(0, 1) // no meta prefix codes
+	for _, sym := range []uint8{c.G, c.R, c.B, c.A, 0} {
+		b.write(1, 1) // simple code
+		b.write(0, 1) // one symbol
+		b.write(1, 1) // of 8 bits
+		b.write(uint32(sym), 8)
+	}
+	return b.buf
+}
+
+// Builds an animated WebP with a canvas of w by h holding a single frame:
+func testAnimatedWebP(w, h int, frame image.Rectangle, c color.NRGBA) []byte {
+	vp8x := make([]byte, 10)
+	vp8x[0] = 0x02 | 0x10
+	putUint24(vp8x[4:], w-1)
+	putUint24(vp8x[7:], h-1)
+
+	anmf := make([]byte, 16)
+	putUint24(anmf[0:], frame.Min.X/2)
+	putUint24(anmf[3:], frame.Min.Y/2)
+	putUint24(anmf[6:], frame.Dx()-1)
+	putUint24(anmf[9:], frame.Dy()-1)
+	putUint24(anmf[12:], 100)
+	anmf = riffChunk{FourCC: "VP8L", Data: vp8lSolid(frame.Dx(), frame.Dy(), c)}.appendTo(anmf)
+
+	body := []byte("WEBP")
+	body = riffChunk{FourCC: "VP8X", Data: vp8x}.appendTo(body)
+	body = riffChunk{FourCC: "ANIM", Data: make([]byte, 6)}.appendTo(body)
+	body = riffChunk{FourCC: "ANMF", Data: anmf}.appendTo(body)
+	return riffChunk{FourCC: "RIFF", Data: body}.appendTo(nil)
+}
+
+func Test_decodeAnimatedWebP(t *testing.T) {
+	red := color.NRGBA{255, 0, 0, 255}
+	data := testAnimatedWebP(10, 8, image.Rect(4, 2, 7, 5), red)
+
+	config, kind, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kind != "webp" || config.Width != 10 || config.Height != 8 {
+		t.Fatalf("expected a 10x8 webp, got a %dx%d %s", config.Width, config.Height, kind)
+	}
+
+	img, err := decodeWebP(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds() != image.Rect(0, 0, 10, 8) {
+		t.Fatalf("expected the full canvas, got %v", img.Bounds())
+	}
+	if got := color.NRGBAModel.Convert(img.At(5, 3)); got != red {
+		t.Errorf("expected the frame at (5, 3), got %v", got)
+	}
+	if _, _, _, a := img.At(1, 1).RGBA(); a != 0 {
+		t.Errorf("expected the canvas outside the frame to be transparent")
+	}
+}
+
+func Test_decodeFirstImage_formats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "formats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := image.NewNRGBA(image.Rect(0, 0, 6, 4))
+	for i := range src.Pix {
+		src.Pix[i] = 0xff
+	}
+
+	var bmpData, tiffData bytes.Buffer
+	if err = bmp.Encode(&bmpData, src); err != nil {
+		t.Fatal(err)
+	}
+	if err = tiff.Encode(&tiffData, src, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		kind string
+		ext  string
+		w, h int
+	}{
+		{"a.bmp", bmpData.Bytes(), "bmp", ".bmp", 6, 4},
+		{"a.tif", tiffData.Bytes(), "tiff", ".tif", 6, 4},
+		{"a.webp", testAnimatedWebP(6, 4, image.Rect(0, 0, 2, 2), color.NRGBA{0, 0, 255, 255}), "webp", ".webp", 6, 4},
+		{"a.svg", []byte(`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 300 150"><rect width="300" height="150" fill="#0f0"/></svg>`), "svg", ".svg", 300, 150},
+	}
+	for _, test := range tests {
+		local_path := path.Join(dir, test.name)
+		if err = ioutil.WriteFile(local_path, test.data, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		w, h, kind, err := getImageInfo(local_path)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if kind != test.kind || w != test.w || h != test.h {
+			t.Errorf("%s: expected %dx%d %s, got %dx%d %s", test.name, test.w, test.h, test.kind, w, h, kind)
+		}
+
+		img, kind, release, err := decodeFirstImage(local_path)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		release()
+		if kind != test.kind || img.Bounds().Dx() != test.w || img.Bounds().Dy() != test.h {
+			t.Errorf("%s: expected to decode %dx%d %s, got %v %s", test.name, test.w, test.h, test.kind, img.Bounds(), kind)
+		}
+
+		mimeType, ext, thumbExt := imageKindTo(kind)
+		if ext != test.ext || thumbExt != ".png" || extToMimeType(ext) != mimeType {
+			t.Errorf("%s: unexpected mapping %s %s %s", test.name, mimeType, ext, thumbExt)
+		}
+		if err = generateThumbnail(img, kind, path.Join(dir, test.name+".png")); err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		}
+	}
+}
+
+func Test_sanitizeSVG(t *testing.T) {
+	input := `<?xml version="1.0"?>
+<!DOCTYPE svg [<!ENTITY x SYSTEM "file:///etc/passwd">]>
+<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" onload="alert(1)" width="10" height="10">
+<script>alert(2)</script>
+<style>@import url(http://evil.example/x.css);</style>
+<style>.a { fill: url(#g) }</style>
+<foreignObject><iframe src="http://evil.example/"></iframe></foreignObject>
+<a xlink:href="javascript:alert(3)"><rect class="a" width="5" height="5" onclick="alert(4)"/></a>
+<image href="http://evil.example/tracker.png" width="1" height="1"/>
+<image xlink:href="data:image/png;base64,AAAA" width="1" height="1"/>
+<rect style="fill: url('https://evil.example/p')" fill="url(#g)" width="1" height="1"/>
+<set attributeName="href" to="javascript:alert(5)"/>
+</svg>`
+
+	var out bytes.Buffer
+	if err := sanitizeSVG(strings.NewReader(input), &out); err != nil {
+		t.Fatal(err)
+	}
+	s := out.String()
+
+	for _, bad := range []string{"alert", "evil.example", "<script", "@import", "foreignObject", "iframe", "DOCTYPE", "ENTITY", "<set"} {
+		if strings.Contains(s, bad) {
+			t.Errorf("expected '%s' to be removed from:\n%s", bad, s)
+		}
+	}
+	for _, good := range []string{`xmlns:xlink="http://www.w3.org/1999/xlink"`, `.a { fill: url(#g) }`, `xlink:href="data:image/png;base64,AAAA"`, `fill="url(#g)"`, `<rect class="a" width="5" height="5">`} {
+		if !strings.Contains(s, good) {
+			t.Errorf("expected '%s' to be kept in:\n%s", good, s)
+		}
+	}
+
+	if !isSVG([]byte(input)) || isSVG([]byte("<html><body>svg</body></html>")) {
+		t.Errorf("unexpected SVG detection")
+	}
+	if err := sanitizeSVG(strings.NewReader("<html></html>"), &out); err == nil {
+		t.Errorf("expected documents without an <svg> element to be refused")
+	}
+}
+
+func Test_sniffFile_formats(t *testing.T) {
+	f, err := ioutil.TempFile("", "sniff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	for _, test := range []struct {
+		data     []byte
+		expected string
+	}{
+		{[]byte("\n<svg xmlns=\"http://www.w3.org/2000/svg\"></svg>"), "image/svg+xml"},
+		{append([]byte("II*\x00"), make([]byte, 4)...), "image/tiff"},
+	} {
+		f.Truncate(0)
+		f.WriteAt(test.data, 0)
+		if mimeType, _ := sniffFile(f.Name()); mimeType != test.expected {
+			t.Errorf("expected %s, got %s", test.expected, mimeType)
+		}
+	}
+	f.Close()
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+)
+
+import "github.com/JamesDunne/go-util/web"
+
+// The frames of an animated GIF are listed at /api/v1/frames/<base62> and exported one at a time as
+// composited PNGs at /api/v1/frames/<base62>/<n>.png. Thumbnails show the frame an admin picked as the
+// image's ThumbFrame, or else the first frame that is fully composited.
+
+// Frames searched for a representative one before settling for the most complete seen:
+const representativeMaxFrames = 100
+
+type gifFrameInfo struct {
+	Index    int    `json:"index"`
+	Delay    int    `json:"delay"` // hundredths of a second
+	Left     int    `json:"left"`
+	Top      int    `json:"top"`
+	Right    int    `json:"right"`
+	Bottom   int    `json:"bottom"`
+	Disposal string `json:"disposal"`
+}
+
+type gifFramesInfo struct {
+	Width          int            `json:"width"`
+	Height         int            `json:"height"`
+	LoopCount      int            `json:"loopCount"`
+	Duration       int            `json:"duration"` // hundredths of a second
+	Representative int            `json:"representative"`
+	ThumbFrame     *int64         `json:"thumbFrame,omitempty"`
+	Frames         []gifFrameInfo `json:"frames"`
+}
+
+var gifDisposalNames = map[byte]string{
+	0:                      "unspecified",
+	gif.DisposalNone:       "none",
+	gif.DisposalBackground: "background",
+	gif.DisposalPrevious:   "previous",
+}
+
+// Decodes every frame of a GIF file once there is room in the decode budget; release must be called
+// once g is no longer needed:
+func decodeGIFFile(local_path string) (g *gif.GIF, release func(), err error) {
+	imf, err := os.Open(local_path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer imf.Close()
+
+	if release, err = acquireDecode(imf, true); err != nil {
+		return nil, nil, err
+	}
+	if g, err = gif.DecodeAll(imf); err != nil {
+		release()
+		return nil, nil, err
+	}
+	return g, release, nil
+}
+
+// A frame number past the last frame of a GIF:
+type gifFrameRangeError struct {
+	n, count int
+}
+
+func (e *gifFrameRangeError) Error() string {
+	return fmt.Sprintf("GIF has no frame %d; it has %d frames", e.n, e.count)
+}
+
+func listGIFFrames(g *gif.GIF) *gifFramesInfo {
+	comp := newGIFCompositor(g)
+	info := &gifFramesInfo{
+		Width:     comp.screen.Dx(),
+		Height:    comp.screen.Dy(),
+		LoopCount: g.LoopCount,
+		Frames:    make([]gifFrameInfo, 0, len(g.Image)),
+	}
+	info.Representative, _, _ = representativeGIFFrame(newGIFCompositor(g))
+
+	for i, frame := range g.Image {
+		b := frame.Bounds()
+		f := gifFrameInfo{Index: i, Left: b.Min.X, Top: b.Min.Y, Right: b.Max.X, Bottom: b.Max.Y}
+		if i < len(g.Delay) {
+			f.Delay = g.Delay[i]
+		}
+		if i < len(g.Disposal) {
+			f.Disposal = gifDisposalNames[g.Disposal[i]]
+		}
+		info.Duration += f.Delay
+		info.Frames = append(info.Frames, f)
+	}
+	return info
+}
+
+// Counts the opaque pixels of a canvas and whether it has more than one color:
+func frameCoverage(canvas *image.RGBA) (opaque int, varied bool) {
+	b := canvas.Rect
+	first := canvas.PixOffset(b.Min.X, b.Min.Y)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		row := canvas.Pix[canvas.PixOffset(b.Min.X, y):canvas.PixOffset(b.Max.X, y)]
+		for i := 0; i < len(row); i += 4 {
+			if row[i+3] == 0xff {
+				opaque++
+			}
+			if !varied && (row[i] != canvas.Pix[first] || row[i+1] != canvas.Pix[first+1] || row[i+2] != canvas.Pix[first+2] || row[i+3] != canvas.Pix[first+3]) {
+				varied = true
+			}
+		}
+	}
+	return
+}
+
+// Finds the first frame that is fully opaque and not a single flat color, e.g. not a blank lead-in;
+// failing that, the frame with the most opaque pixels. Returns its index and a copy of its canvas.
+func representativeGIFFrame(comp *gifCompositor) (index int, frame *image.RGBA, err error) {
+	total := comp.screen.Dx() * comp.screen.Dy()
+
+	best := -1
+	for i := 0; i < representativeMaxFrames; i++ {
+		canvas, _ := comp.Next()
+		if canvas == nil {
+			break
+		}
+
+		opaque, varied := frameCoverage(canvas)
+		if opaque == total && varied {
+			return i, cloneRGBA(canvas), nil
+		}
+		if opaque > best {
+			best, index, frame = opaque, i, cloneRGBA(canvas)
+		}
+	}
+	if err = comp.Err(); err != nil {
+		return 0, nil, err
+	}
+	if frame == nil {
+		return 0, nil, fmt.Errorf("GIF has no frames")
+	}
+	return index, frame, nil
+}
+
+// Composites frames up to and including frame n and returns a copy of its canvas:
+func compositeGIFFrame(comp *gifCompositor, n int) (*image.RGBA, error) {
+	if n < 0 {
+		return nil, &gifFrameRangeError{n: n}
+	}
+
+	var canvas *image.RGBA
+	for i := 0; i <= n; i++ {
+		if canvas, _ = comp.Next(); canvas == nil {
+			if err := comp.Err(); err != nil {
+				return nil, err
+			}
+			return nil, &gifFrameRangeError{n: n, count: i}
+		}
+	}
+	return cloneRGBA(canvas), nil
+}
+
+func cloneRGBA(img *image.RGBA) *image.RGBA {
+	out := image.NewRGBA(img.Rect)
+	draw.Draw(out, out.Rect, img, img.Rect.Min, draw.Src)
+	return out
+}
+
+// Decodes the frame a GIF's thumbnail is made from; thumbFrame picks one, nil finds a representative frame.
+// Frames after it are left unread.
+func decodeGIFThumbFrame(r io.ReadSeeker, thumbFrame *int64) (image.Image, error) {
+	if thumbFrame != nil {
+		comp, err := newGIFStreamCompositor(r)
+		if err != nil {
+			return nil, err
+		}
+		frame, err := compositeGIFFrame(comp, int(*thumbFrame))
+		if err == nil {
+			return frame, nil
+		}
+		if _, ok := err.(*gifFrameRangeError); !ok {
+			return nil, err
+		}
+
+		// The picked frame is gone, e.g. since the image was replaced:
+		if _, err = r.Seek(0, 0); err != nil {
+			return nil, err
+		}
+	}
+
+	comp, err := newGIFStreamCompositor(r)
+	if err != nil {
+		return nil, err
+	}
+	_, frame, err := representativeGIFFrame(comp)
+	if err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+// Generates a thumbnail from the chosen frame if it does not exist yet:
+func ensureThumbnailFrame(image_path, thumb_path string, thumbFrame *int64) error {
+	if _, err := os.Stat(thumb_path); err == nil {
+		return nil
+	}
+	if thumbFrame == nil {
+		return ensureThumbnail(image_path, thumb_path)
+	}
+
+	imf, err := os.Open(image_path)
+	if err != nil {
+		return err
+	}
+	defer imf.Close()
+	release, err := acquireDecode(imf, false)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	frame, err := decodeGIFThumbFrame(imf, thumbFrame)
+	if err != nil {
+		return err
+	}
+	return generateThumbnail(frame, "gif", thumb_path)
+}
+
+// Checks and applies a change of an image's thumbnail frame, regenerating its thumbnail:
+func setThumbFrame(img *Image, thumbFrame *int64) *web.Error {
+	if thumbFrame != nil && *thumbFrame < 0 {
+		return web.AsError(fmt.Errorf("Thumbnail frame must be a frame number"), http.StatusBadRequest)
+	}
+	if thumbFrame == nil && img.ThumbFrame == nil {
+		return nil
+	}
+	if thumbFrame != nil && img.ThumbFrame != nil && *thumbFrame == *img.ThumbFrame {
+		return nil
+	}
+	if img.Kind != "gif" {
+		return web.AsError(fmt.Errorf("Only GIFs have a thumbnail frame"), http.StatusBadRequest)
+	}
+
+	local_path := storePath(img.ID, ".gif")
+	thumb_path := path.Join(thumb_folder(), strconv.FormatInt(img.ID, 10)+".png")
+	if thumbFrame == nil {
+		img.ThumbFrame = nil
+		os.Remove(thumb_path)
+		return asDecodeError(ensureThumbnail(local_path, thumb_path))
+	}
+
+	// Composite up to the frame, which also checks that it exists:
+	comp, done, err := openGIFStream(local_path)
+	if werr := asDecodeError(err); werr != nil {
+		return werr
+	}
+	defer done()
+	frame, err := compositeGIFFrame(comp, int(*thumbFrame))
+	if _, ok := err.(*gifFrameRangeError); ok {
+		return web.AsError(err, http.StatusBadRequest)
+	} else if werr := asDecodeError(err); werr != nil {
+		return werr
+	}
+	img.ThumbFrame = thumbFrame
+
+	return asDecodeError(generateThumbnail(frame, "gif", thumb_path))
+}
+
+// Parses a thumbnail frame form value; blank picks a representative frame automatically:
+func parseThumbFrame(s string) (*int64, error) {
+	if s == "" {
+		return nil, nil
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("Thumbnail frame must be a frame number")
+	}
+	return &n, nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"testing"
+)
+
+// Builds an 8x8 GIF from frames of a single color each:
+func testFlatFrames(rects []image.Rectangle, colors []uint8) *gif.GIF {
+	palette := color.Palette{color.RGBA{}, color.RGBA{0, 0, 0, 255}, color.RGBA{255, 0, 0, 255}, color.RGBA{0, 0, 255, 255}}
+	g := &gif.GIF{Config: image.Config{Width: 8, Height: 8, ColorModel: palette}}
+	for i, r := range rects {
+		p := image.NewPaletted(r, palette)
+		draw.Draw(p, r, &image.Uniform{palette[colors[i]]}, image.ZP, draw.Src)
+		g.Image = append(g.Image, p)
+		g.Delay = append(g.Delay, 10)
+		g.Disposal = append(g.Disposal, gif.DisposalNone)
+	}
+	return g
+}
+
+func Test_representativeGIFFrame(t *testing.T) {
+	full, corner := image.Rect(0, 0, 8, 8), image.Rect(0, 0, 4, 4)
+	tests := []struct {
+		name     string
+		g        *gif.GIF
+		expected int
+	}{
+		// A black lead-in is skipped for the first frame with something on it:
+		{"blank lead-in", testFlatFrames([]image.Rectangle{full, full, corner}, []uint8{1, 1, 2}), 2},
+		// A partial first frame is skipped for the first one that covers the screen:
+		{"partial first frame", testFlatFrames([]image.Rectangle{corner, full, corner}, []uint8{2, 3, 2}), 2},
+		// Without a complete frame the most complete one is used:
+		{"no complete frame", testAnimation(), 0},
+	}
+	for _, test := range tests {
+		index, frame, err := representativeGIFFrame(newGIFCompositor(test.g))
+		if err != nil || index != test.expected {
+			t.Errorf("%s: expected frame %d, got %d (%v)", test.name, test.expected, index, err)
+		}
+		expected, _ := compositeGIFFrame(newGIFCompositor(test.g), test.expected)
+		if !sameRGBA(frame, expected) {
+			t.Errorf("%s: returned canvas does not match frame %d", test.name, test.expected)
+		}
+	}
+}
+
+func Test_listGIFFrames(t *testing.T) {
+	info := listGIFFrames(testAnimation())
+	if info.Width != 16 || info.Height != 16 || info.LoopCount != 3 || info.Duration != 105 || len(info.Frames) != 5 {
+		t.Fatalf("unexpected frames info: %+v", info)
+	}
+	f := info.Frames[1]
+	if f.Index != 1 || f.Delay != 20 || f.Disposal != "previous" || image.Rect(f.Left, f.Top, f.Right, f.Bottom) != image.Rect(2, 2, 6, 6) {
+		t.Errorf("unexpected frame: %+v", f)
+	}
+
+	if _, err := compositeGIFFrame(newGIFCompositor(testAnimation()), 5); err == nil {
+		t.Errorf("expected frame 5 of 5 to be refused")
+	}
+}
+
+func Test_setThumbFrame(t *testing.T) {
+	_, done := withTempStore(t)
+	defer done()
+	os.MkdirAll(store_folder(), 0755)
+	os.MkdirAll(thumb_folder(), 0755)
+
+	full, corner := image.Rect(0, 0, 8, 8), image.Rect(0, 0, 4, 4)
+	buf := &bytes.Buffer{}
+	if err := gif.EncodeAll(buf, testFlatFrames([]image.Rectangle{full, full, corner}, []uint8{1, 3, 2})); err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(storePath(1, ".gif"), buf.Bytes(), 0644)
+	img := &Image{ID: 1, Kind: "gif"}
+
+	thumbColor := func() color.Color {
+		f, err := os.Open(path.Join(thumb_folder(), "1.png"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		thumb, err := png.Decode(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return color.RGBAModel.Convert(thumb.At(thumb.Bounds().Min.X, thumb.Bounds().Min.Y))
+	}
+
+	one := int64(1)
+	if werr := setThumbFrame(img, &one); werr != nil {
+		t.Fatal(werr.Error)
+	}
+	if img.ThumbFrame == nil || *img.ThumbFrame != 1 {
+		t.Errorf("expected thumbnail frame 1 to be set")
+	}
+	if c := thumbColor(); c != (color.RGBA{0, 0, 255, 255}) {
+		t.Errorf("expected a thumbnail of the blue frame, got %v", c)
+	}
+
+	// Back to automatic, which skips the flat black and blue frames for the red corner over blue:
+	if werr := setThumbFrame(img, nil); werr != nil {
+		t.Fatal(werr.Error)
+	}
+	if c := thumbColor(); c != (color.RGBA{255, 0, 0, 255}) {
+		t.Errorf("expected a thumbnail of the red frame, got %v", c)
+	}
+
+	three := int64(3)
+	if werr := setThumbFrame(img, &three); werr == nil || werr.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected frame 3 of 3 to be refused")
+	}
+	negative := int64(-1)
+	if werr := setThumbFrame(img, &negative); werr == nil || werr.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected frame -1 to be refused")
+	}
+	if werr := setThumbFrame(&Image{ID: 2, Kind: "png"}, &one); werr == nil {
+		t.Errorf("expected a PNG to have no thumbnail frame")
+	}
+
+	if n, err := parseThumbFrame("-1"); err == nil {
+		t.Errorf("expected -1 to be refused, got %v", *n)
+	}
+}
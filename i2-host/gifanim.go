@@ -0,0 +1,430 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"io"
+	"os"
+)
+
+// Animated GIF frames are usually sub-rectangles drawn over what came before, so they cannot be edited one
+// by one. A gifCompositor replays frames onto the logical screen the way a browser does and yields the
+// full picture shown for each frame; encodeGIFCanvases turns such pictures back into optimized sub-frames.
+
+type gifCompositor struct {
+	frames gifFrameSource
+	screen image.Rectangle
+	canvas *image.RGBA
+	err    error
+
+	// Disposal of the last drawn frame, applied before drawing the next:
+	dispose   byte
+	disposeAt image.Rectangle
+	previous  *image.RGBA
+}
+
+// Frames in display order; Next returns io.EOF after the last one:
+type gifFrameSource interface {
+	Next() (frame *image.Paletted, delay int, disposal byte, err error)
+}
+
+// The frames of a fully decoded GIF:
+type gifFrames struct {
+	g    *gif.GIF
+	next int
+}
+
+func (s *gifFrames) Next() (frame *image.Paletted, delay int, disposal byte, err error) {
+	if s.next >= len(s.g.Image) {
+		return nil, 0, 0, io.EOF
+	}
+	i := s.next
+	s.next++
+	if i < len(s.g.Delay) {
+		delay = s.g.Delay[i]
+	}
+	if i < len(s.g.Disposal) {
+		disposal = s.g.Disposal[i]
+	}
+	return s.g.Image[i], delay, disposal, nil
+}
+
+func newGIFCompositor(g *gif.GIF) *gifCompositor {
+	screen := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	if screen.Empty() {
+		// Files without a logical screen size get the union of their frames:
+		for _, frame := range g.Image {
+			screen = screen.Union(frame.Bounds())
+		}
+		screen.Min = image.ZP
+	}
+	return newFrameCompositor(&gifFrames{g: g}, screen)
+}
+
+func newFrameCompositor(frames gifFrameSource, screen image.Rectangle) *gifCompositor {
+	// The background shows through as transparent, as in browsers:
+	return &gifCompositor{
+		frames: frames,
+		screen: screen,
+		canvas: image.NewRGBA(screen),
+	}
+}
+
+// Composites the next frame and returns the canvas as displayed, or nil after the last frame or
+// when reading a frame failed. The canvas is reused by the following call.
+func (c *gifCompositor) Next() (canvas *image.RGBA, delay int) {
+	if c.err != nil {
+		return nil, 0
+	}
+	frame, delay, disposal, err := c.frames.Next()
+	if err != nil {
+		if err != io.EOF {
+			c.err = err
+		}
+		return nil, 0
+	}
+
+	// Dispose of the previous frame:
+	switch c.dispose {
+	case gif.DisposalBackground:
+		draw.Draw(c.canvas, c.disposeAt, image.Transparent, image.ZP, draw.Src)
+	case gif.DisposalPrevious:
+		draw.Draw(c.canvas, c.disposeAt, c.previous, c.disposeAt.Min, draw.Src)
+	}
+
+	c.dispose = disposal
+	c.disposeAt = frame.Bounds().Intersect(c.screen)
+	if c.dispose == gif.DisposalPrevious {
+		if c.previous == nil {
+			c.previous = image.NewRGBA(c.screen)
+		}
+		draw.Draw(c.previous, c.disposeAt, c.canvas, c.disposeAt.Min, draw.Src)
+	}
+
+	// Transparent pixels leave the canvas as it was:
+	draw.Draw(c.canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+
+	return c.canvas, delay
+}
+
+// The loop count as in gif.GIF:
+func (c *gifCompositor) LoopCount() int {
+	switch frames := c.frames.(type) {
+	case *gifFrames:
+		return frames.g.LoopCount
+	case *gifFrameReader:
+		return frames.LoopCount
+	}
+	return 0
+}
+
+// Reports why Next stopped early, if it did:
+func (c *gifCompositor) Err() error {
+	return c.err
+}
+
+// Streams an animated GIF's frames, crops every displayed frame and writes a new GIF keeping timing, looping and transparency:
+func cropGIF(r io.Reader, w io.Writer, cropBounds image.Rectangle) error {
+	comp, err := newGIFStreamCompositor(r)
+	if err != nil {
+		return err
+	}
+	if !cropBounds.In(comp.screen) {
+		return fmt.Errorf("Crop boundaries are not contained within image boundaries")
+	}
+
+	err = encodeGIFCanvases(w, comp.LoopCount(), cropBounds.Size(), func() (*image.RGBA, int) {
+		canvas, delay := comp.Next()
+		if canvas == nil {
+			return nil, 0
+		}
+		cropped := image.NewRGBA(image.Rectangle{Max: cropBounds.Size()})
+		draw.Draw(cropped, cropped.Rect, canvas, cropBounds.Min, draw.Src)
+		return cropped, delay
+	})
+	if err == nil {
+		err = comp.Err()
+	}
+	return err
+}
+
+// Encodes a sequence of full canvases as a GIF. next returns each canvas in turn and nil at the end;
+// it must return a new canvas each time. Repeated canvases are merged into one frame with their delays added,
+// and each frame only covers what changed since the one before.
+func encodeGIFCanvases(w io.Writer, loopCount int, size image.Point, next func() (*image.RGBA, int)) error {
+	out := &gif.GIF{
+		LoopCount: loopCount,
+		Config:    image.Config{Width: size.X, Height: size.Y},
+	}
+
+	// What a viewer shows before the frame being encoded is drawn:
+	shown := image.NewRGBA(image.Rectangle{Max: size})
+
+	pending, pendingDelay := next()
+	if pending == nil {
+		return fmt.Errorf("GIF has no frames")
+	}
+	for pending != nil {
+		following, followingDelay := next()
+		if following != nil && following.Rect == pending.Rect && sameRGBA(following, pending) {
+			pendingDelay += followingDelay
+			continue
+		}
+
+		frame, disposal := encodeGIFFrame(shown, pending, following)
+		out.Image = append(out.Image, frame)
+		out.Delay = append(out.Delay, pendingDelay)
+		out.Disposal = append(out.Disposal, disposal)
+
+		// Track what is shown once this frame is disposed of:
+		draw.Draw(shown, shown.Rect, pending, image.ZP, draw.Src)
+		if disposal == gif.DisposalBackground {
+			draw.Draw(shown, frame.Rect, image.Transparent, image.ZP, draw.Src)
+		}
+
+		pending, pendingDelay = following, followingDelay
+	}
+
+	return gif.EncodeAll(w, out)
+}
+
+func sameRGBA(a, b *image.RGBA) bool {
+	for y := a.Rect.Min.Y; y < a.Rect.Max.Y; y++ {
+		ra := a.Pix[a.PixOffset(a.Rect.Min.X, y):a.PixOffset(a.Rect.Max.X, y)]
+		rb := b.Pix[b.PixOffset(a.Rect.Min.X, y):b.PixOffset(a.Rect.Max.X, y)]
+		if string(ra) != string(rb) {
+			return false
+		}
+	}
+	return true
+}
+
+// Encodes the pixels of canvas that differ from shown as a paletted sub-frame. Pixels that turn
+// transparent in following can only be cleared by disposing of this frame to the background, so the
+// frame is widened to cover them.
+func encodeGIFFrame(shown, canvas, following *image.RGBA) (*image.Paletted, byte) {
+	changed := image.Rectangle{}
+	cleared := image.Rectangle{}
+	for y := canvas.Rect.Min.Y; y < canvas.Rect.Max.Y; y++ {
+		for x := canvas.Rect.Min.X; x < canvas.Rect.Max.X; x++ {
+			px := image.Rect(x, y, x+1, y+1)
+			if canvas.RGBAAt(x, y) != shown.RGBAAt(x, y) {
+				changed = changed.Union(px)
+			}
+			if following != nil && following.RGBAAt(x, y).A == 0 && canvas.RGBAAt(x, y).A != 0 {
+				cleared = cleared.Union(px)
+			}
+		}
+	}
+
+	disposal := byte(gif.DisposalNone)
+	rect := changed
+	if !cleared.Empty() {
+		disposal = gif.DisposalBackground
+		rect = rect.Union(cleared)
+	}
+	if rect.Empty() {
+		// Nothing changed but the frame still holds its delay:
+		rect = image.Rect(0, 0, 1, 1)
+	}
+
+	// Unchanged pixels are transparent so the shown picture comes through:
+	palette := color.Palette{color.RGBA{}}
+	index := map[color.RGBA]uint8{}
+	exact := true
+	for y := rect.Min.Y; y < rect.Max.Y && exact; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			c := canvas.RGBAAt(x, y)
+			if c.A == 0 || c == shown.RGBAAt(x, y) {
+				continue
+			}
+			if _, ok := index[c]; ok {
+				continue
+			}
+			if len(palette) == 256 {
+				exact = false
+				break
+			}
+			index[c] = uint8(len(palette))
+			palette = append(palette, c)
+		}
+	}
+	if !exact {
+		// More than 255 colors can only come about by restoring or combining frames with different palettes:
+		palette = color.Palette{color.RGBA{}}
+		palette = append(palette, gifQuantizePalette(canvas, rect)...)
+	}
+
+	frame := image.NewPaletted(rect, palette)
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			c := canvas.RGBAAt(x, y)
+			if c.A == 0 || c == shown.RGBAAt(x, y) {
+				frame.SetColorIndex(x, y, 0)
+				continue
+			}
+			if i, ok := index[c]; ok && exact {
+				frame.SetColorIndex(x, y, i)
+				continue
+			}
+			frame.SetColorIndex(x, y, uint8(1+palette[1:].Index(c)))
+		}
+	}
+	return frame, disposal
+}
+
+// Picks 255 opaque colors for a frame by taking the most used after reducing to 5 bits per channel:
+func gifQuantizePalette(canvas *image.RGBA, rect image.Rectangle) color.Palette {
+	counts := map[color.RGBA]int{}
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			c := canvas.RGBAAt(x, y)
+			if c.A == 0 {
+				continue
+			}
+			counts[color.RGBA{c.R &^ 7, c.G &^ 7, c.B &^ 7, 255}]++
+		}
+	}
+
+	palette := make(color.Palette, 0, 255)
+	for len(palette) < 255 && len(counts) > 0 {
+		var best color.RGBA
+		n := -1
+		for c, count := range counts {
+			if count > n || (count == n && rgbaLess(c, best)) {
+				best, n = c, count
+			}
+		}
+		delete(counts, best)
+		palette = append(palette, color.RGBA{best.R | best.R>>5, best.G | best.G>>5, best.B | best.B>>5, 255})
+	}
+	return palette
+}
+
+func rgbaLess(a, b color.RGBA) bool {
+	if a.R != b.R {
+		return a.R < b.R
+	}
+	if a.G != b.G {
+		return a.G < b.G
+	}
+	return a.B < b.B
+}
+
+// Limits on animated thumbnails; a frame limit of 0 disables them:
+var (
+	animThumbMaxFrames = 24
+	animThumbSize      = 100
+	animThumbColors    = 64
+)
+
+var errNotAnimated = fmt.Errorf("Image is not animated")
+
+func animThumbEnabled(kind string) bool {
+	return animThumbMaxFrames > 0 && (kind == "gif" || kind == "imgur-gifv")
+}
+
+// Creates a small animated GIF preview unless it already exists:
+func ensureAnimatedThumbnail(image_path, thumb_path string) error {
+	if _, err := os.Stat(thumb_path); err == nil {
+		return nil
+	}
+	return generateAnimatedThumbnail(image_path, thumb_path)
+}
+
+// Writes a downscaled GIF of at most animThumbMaxFrames frames and animThumbColors colors.
+// Dropped frames add their delay to the frame kept before them.
+func generateAnimatedThumbnail(image_path, thumb_path string) (err error) {
+	imf, err := os.Open(image_path)
+	if err != nil {
+		return err
+	}
+	defer imf.Close()
+
+	frames, err := countGIFFrames(imf)
+	if err != nil {
+		return err
+	}
+	if frames < 2 {
+		return errNotAnimated
+	}
+
+	// Frames are composited as they are read, so only one needs room at a time:
+	release, err := acquireDecode(imf, false)
+	if err != nil {
+		return err
+	}
+	defer release()
+	comp, err := newGIFStreamCompositor(imf)
+	if err != nil {
+		return err
+	}
+
+	// Keep every step-th frame:
+	step := (frames + animThumbMaxFrames - 1) / animThumbMaxFrames
+	var palette color.Palette
+	next := func() (*image.RGBA, int) {
+		canvas, delay := comp.Next()
+		if canvas == nil {
+			return nil, 0
+		}
+		for i := 1; i < step; i++ {
+			_, d := comp.Next()
+			delay += d
+		}
+
+		thumb := image.NewRGBA(image.Rect(0, 0, animThumbSize, animThumbSize))
+		resized := makeThumbnail(canvas, animThumbSize)
+		draw.Draw(thumb, thumb.Rect, resized, resized.Bounds().Min, draw.Src)
+
+		// Pick the palette from the first frame and map all frames onto it:
+		if palette == nil {
+			palette = gifQuantizePalette(thumb, thumb.Rect)
+			if len(palette) > animThumbColors {
+				palette = palette[:animThumbColors]
+			}
+		}
+		limitColors(thumb, palette)
+		return thumb, delay
+	}
+
+	os.Remove(thumb_path)
+	tf, err := os.Create(thumb_path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		tf.Close()
+		if err != nil {
+			os.Remove(thumb_path)
+		}
+	}()
+
+	if err = encodeGIFCanvases(tf, comp.LoopCount(), image.Pt(animThumbSize, animThumbSize), next); err != nil {
+		return err
+	}
+	return comp.Err()
+}
+
+// Makes each pixel fully opaque or transparent, as GIF requires, and maps opaque pixels to their
+// nearest palette color unless palette is nil:
+func limitColors(img *image.RGBA, palette color.Palette) {
+	for y := img.Rect.Min.Y; y < img.Rect.Max.Y; y++ {
+		for x := img.Rect.Min.X; x < img.Rect.Max.X; x++ {
+			c := img.RGBAAt(x, y)
+			if c.A < 128 {
+				img.SetRGBA(x, y, color.RGBA{})
+				continue
+			}
+			// Resizing leaves colors premultiplied at the edges:
+			opaque := color.RGBA{uint8(int(c.R) * 255 / int(c.A)), uint8(int(c.G) * 255 / int(c.A)), uint8(int(c.B) * 255 / int(c.A)), 255}
+			if palette != nil {
+				opaque = palette[palette.Index(opaque)].(color.RGBA)
+			}
+			img.SetRGBA(x, y, opaque)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+// Builds a 16x16 animation of sub-frames using every disposal method and transparency:
+func testAnimation() *gif.GIF {
+	palette := color.Palette{color.RGBA{}, color.RGBA{255, 0, 0, 255}, color.RGBA{0, 255, 0, 255}, color.RGBA{0, 0, 255, 255}}
+	frame := func(r image.Rectangle, index uint8) *image.Paletted {
+		p := image.NewPaletted(r, palette)
+		draw.Draw(p, r, &image.Uniform{palette[index]}, image.ZP, draw.Src)
+		return p
+	}
+
+	// A red backdrop with a transparent hole:
+	first := frame(image.Rect(0, 0, 16, 16), 1)
+	first.SetColorIndex(8, 8, 0)
+
+	return &gif.GIF{
+		Image: []*image.Paletted{
+			first,
+			frame(image.Rect(2, 2, 6, 6), 2),
+			frame(image.Rect(8, 2, 12, 6), 3),
+			frame(image.Rect(8, 2, 12, 6), 3),
+			frame(image.Rect(4, 8, 14, 14), 2),
+		},
+		Delay:     []int{10, 20, 30, 5, 40},
+		Disposal:  []byte{gif.DisposalNone, gif.DisposalPrevious, gif.DisposalNone, gif.DisposalBackground, gif.DisposalNone},
+		LoopCount: 3,
+		Config:    image.Config{Width: 16, Height: 16, ColorModel: palette},
+	}
+}
+
+// Lists each displayed frame of a GIF, cropped:
+func displayedFrames(g *gif.GIF, crop image.Rectangle) (frames []*image.RGBA, delays []int) {
+	comp := newGIFCompositor(g)
+	for {
+		canvas, delay := comp.Next()
+		if canvas == nil {
+			return
+		}
+		cropped := image.NewRGBA(image.Rectangle{Max: crop.Size()})
+		draw.Draw(cropped, cropped.Rect, canvas, crop.Min, draw.Src)
+		frames = append(frames, cropped)
+		delays = append(delays, delay)
+	}
+}
+
+func Test_cropGIF(t *testing.T) {
+	src := testAnimation()
+	buf := &bytes.Buffer{}
+	if err := gif.EncodeAll(buf, src); err != nil {
+		t.Fatal(err)
+	}
+
+	crop := image.Rect(3, 3, 13, 13)
+	out := &bytes.Buffer{}
+	if err := cropGIF(bytes.NewReader(buf.Bytes()), out, crop); err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := gif.DecodeAll(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.Config.Width != 10 || g.Config.Height != 10 || g.LoopCount != 3 {
+		t.Fatalf("unexpected config %+v, loop count %d", g.Config, g.LoopCount)
+	}
+
+	// Frames that differ are re-encoded as sub-frames:
+	for _, frame := range g.Image {
+		if frame.Rect == image.Rect(0, 0, 10, 10) {
+			continue
+		}
+		if !frame.Rect.In(image.Rect(0, 0, 10, 10)) {
+			t.Errorf("frame %v is outside the canvas", frame.Rect)
+		}
+	}
+
+	// The cropped animation displays the same pictures for the same time:
+	want, wantDelays := displayedFrames(src, crop)
+	got, gotDelays := displayedFrames(g, image.Rect(0, 0, 10, 10))
+	expand := func(frames []*image.RGBA, delays []int) (timeline []*image.RGBA) {
+		for i, f := range frames {
+			for j := 0; j < delays[i]; j += 5 {
+				timeline = append(timeline, f)
+			}
+		}
+		return
+	}
+	wantTimeline, gotTimeline := expand(want, wantDelays), expand(got, gotDelays)
+	if len(wantTimeline) != len(gotTimeline) {
+		t.Fatalf("expected %d total delay, got %d", len(wantTimeline)*5, len(gotTimeline)*5)
+	}
+	for i := range wantTimeline {
+		if !sameRGBA(wantTimeline[i], gotTimeline[i]) {
+			t.Fatalf("picture differs at %dcs", i*5)
+		}
+	}
+
+	// The transparent hole survives:
+	if got[0].RGBAAt(5, 5).A != 0 {
+		t.Errorf("transparency was lost")
+	}
+
+	if err := cropGIF(bytes.NewReader(buf.Bytes()), out, image.Rect(8, 8, 20, 20)); err == nil {
+		t.Errorf("expected crop outside the image to fail")
+	}
+}
+
+func Test_generateAnimatedThumbnail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "i2-host-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// 40 frames of a dot moving across the image:
+	palette := color.Palette{color.RGBA{0, 0, 0, 255}, color.RGBA{255, 255, 255, 255}}
+	src := &gif.GIF{Config: image.Config{Width: 40, Height: 40, ColorModel: palette}}
+	for i := 0; i < 40; i++ {
+		frame := image.NewPaletted(image.Rect(0, 0, 40, 40), palette)
+		frame.SetColorIndex(i, 20, 1)
+		src.Image = append(src.Image, frame)
+		src.Delay = append(src.Delay, 5)
+	}
+	src_path, thumb_path := path.Join(dir, "anim.gif"), path.Join(dir, "thumb.gif")
+	f, _ := os.Create(src_path)
+	gif.EncodeAll(f, src)
+	f.Close()
+
+	defer func(frames, size int) { animThumbMaxFrames, animThumbSize = frames, size }(animThumbMaxFrames, animThumbSize)
+	animThumbMaxFrames, animThumbSize = 12, 20
+
+	if err := generateAnimatedThumbnail(src_path, thumb_path); err != nil {
+		t.Fatal(err)
+	}
+	f, _ = os.Open(thumb_path)
+	g, err := gif.DecodeAll(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	total := 0
+	for _, d := range g.Delay {
+		total += d
+	}
+	if len(g.Image) > 12 || total != 200 {
+		t.Errorf("expected at most 12 frames lasting 200cs, got %d lasting %dcs", len(g.Image), total)
+	}
+	if g.Config.Width != 20 || g.Config.Height != 20 {
+		t.Errorf("unexpected thumbnail size %+v", g.Config)
+	}
+
+	// Still GIFs have no animated thumbnail:
+	src.Image, src.Delay = src.Image[:1], src.Delay[:1]
+	f, _ = os.Create(src_path)
+	gif.EncodeAll(f, src)
+	f.Close()
+	if err := generateAnimatedThumbnail(src_path, thumb_path); err != errNotAnimated {
+		t.Errorf("expected errNotAnimated, got %v", err)
+	}
+}
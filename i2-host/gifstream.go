@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"image"
+	"image/gif"
+	"io"
+	"os"
+)
+
+// gif.DecodeAll holds every frame of an animation in memory at once, though thumbnails and single
+// frame exports only need the frames up to the one they show. A gifFrameReader reads a GIF block by
+// block and decodes one frame at a time, leaving the rest of the file unread.
+
+type gifFrameReader struct {
+	br     *bufio.Reader
+	header []byte // signature, logical screen descriptor and global color table
+	buf    bytes.Buffer
+	frames int
+
+	Width, Height int
+	// As in gif.GIF; known once the NETSCAPE2.0 extension was read, which encoders put before the first frame:
+	LoopCount int
+}
+
+func newGIFFrameReader(r io.Reader) (*gifFrameReader, error) {
+	br := bufio.NewReader(r)
+	header := make([]byte, 13)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, err
+	}
+	if s := string(header[:6]); s != "GIF87a" && s != "GIF89a" {
+		return nil, fmt.Errorf("Not a GIF")
+	}
+	if fields := header[10]; fields&0x80 != 0 {
+		palette := make([]byte, 3<<((fields&7)+1))
+		if _, err := io.ReadFull(br, palette); err != nil {
+			return nil, err
+		}
+		header = append(header, palette...)
+	}
+
+	fr := &gifFrameReader{
+		br:        br,
+		header:    header,
+		Width:     int(header[6]) | int(header[7])<<8,
+		Height:    int(header[8]) | int(header[9])<<8,
+		LoopCount: -1,
+	}
+	fr.buf.Write(header)
+
+	// Read ahead to the first frame so that the loop count is known:
+	if err := fr.readExtensions(); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return fr, nil
+}
+
+// Opens a GIF for compositing a frame at a time:
+func newGIFStreamCompositor(r io.Reader) (*gifCompositor, error) {
+	fr, err := newGIFFrameReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return newFrameCompositor(fr, image.Rect(0, 0, fr.Width, fr.Height)), nil
+}
+
+// Opens a GIF file for compositing a frame at a time once there is room in the decode budget for it.
+// done closes the file and releases the room.
+func openGIFStream(local_path string) (comp *gifCompositor, done func(), err error) {
+	imf, err := os.Open(local_path)
+	if err != nil {
+		return nil, nil, err
+	}
+	release, err := acquireDecode(imf, false)
+	if err != nil {
+		imf.Close()
+		return nil, nil, err
+	}
+	done = func() {
+		release()
+		imf.Close()
+	}
+
+	comp, err = newGIFStreamCompositor(imf)
+	if err != nil {
+		done()
+		return nil, nil, err
+	}
+	return comp, done, nil
+}
+
+// Reads up to the next frame and decodes it on its own, as a GIF of just the header and that frame.
+func (fr *gifFrameReader) Next() (frame *image.Paletted, delay int, disposal byte, err error) {
+	if err = fr.readExtensions(); err == io.EOF && fr.frames > 0 {
+		// Tolerate a missing trailer:
+		return nil, 0, 0, io.EOF
+	} else if err != nil {
+		return nil, 0, 0, unexpectedEOF(err)
+	}
+
+	b, err := fr.br.ReadByte()
+	if err != nil {
+		return nil, 0, 0, unexpectedEOF(err)
+	}
+	switch b {
+	case 0x2C:
+		// Image descriptor, local color table, LZW minimum code size then the compressed sub-blocks:
+		var desc [10]byte
+		desc[0] = b
+		if _, err = io.ReadFull(fr.br, desc[1:]); err != nil {
+			return nil, 0, 0, unexpectedEOF(err)
+		}
+		fr.buf.Write(desc[:])
+		if fields := desc[9]; fields&0x80 != 0 {
+			if _, err = io.CopyN(&fr.buf, fr.br, int64(3<<((fields&7)+1))); err != nil {
+				return nil, 0, 0, unexpectedEOF(err)
+			}
+		}
+		if b, err = fr.br.ReadByte(); err != nil {
+			return nil, 0, 0, unexpectedEOF(err)
+		}
+		fr.buf.WriteByte(b)
+		if err = copyGIFSubBlocks(fr.br, &fr.buf); err != nil {
+			return nil, 0, 0, unexpectedEOF(err)
+		}
+		fr.buf.WriteByte(0x3B)
+
+		g, err := gif.DecodeAll(&fr.buf)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		fr.frames++
+
+		// Start the next frame's GIF:
+		fr.buf.Reset()
+		fr.buf.Write(fr.header)
+		return g.Image[0], g.Delay[0], g.Disposal[0], nil
+	case 0x3B:
+		// Trailer:
+		return nil, 0, 0, io.EOF
+	default:
+		return nil, 0, 0, fmt.Errorf("Corrupt GIF: unknown block type 0x%02x", b)
+	}
+}
+
+// Reads the extensions before the next frame or the trailer, keeping the graphic control extension
+// for the frame's GIF. Returns io.EOF untouched at the end of the file.
+func (fr *gifFrameReader) readExtensions() error {
+	for {
+		b, err := fr.br.ReadByte()
+		if err != nil {
+			return err
+		}
+		if b != 0x21 {
+			return fr.br.UnreadByte()
+		}
+
+		label, err := fr.br.ReadByte()
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		switch label {
+		case 0xF9:
+			// Graphic control extension with the next frame's delay, disposal and transparency:
+			fr.buf.Write([]byte{b, label})
+			err = copyGIFSubBlocks(fr.br, &fr.buf)
+		case 0xFF:
+			err = fr.readApplication()
+		default:
+			err = skipGIFSubBlocks(fr.br)
+		}
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+	}
+}
+
+// Reads an application extension, picking the loop count out of a NETSCAPE2.0 one:
+func (fr *gifFrameReader) readApplication() error {
+	n, err := fr.br.ReadByte()
+	if err != nil {
+		return err
+	}
+	id := make([]byte, n)
+	if _, err = io.ReadFull(fr.br, id); err != nil {
+		return err
+	}
+	if n == 0 {
+		return nil
+	}
+	if string(id) == "NETSCAPE2.0" {
+		if data, err := fr.br.Peek(4); err == nil && data[0] == 3 && data[1] == 1 {
+			fr.LoopCount = int(data[2]) | int(data[3])<<8
+		}
+	}
+	return skipGIFSubBlocks(fr.br)
+}
+
+func copyGIFSubBlocks(br *bufio.Reader, w io.Writer) error {
+	for {
+		n, err := br.ReadByte()
+		if err != nil {
+			return err
+		}
+		if _, err = w.Write([]byte{n}); err != nil {
+			return err
+		}
+		if n == 0 {
+			return nil
+		}
+		if _, err = io.CopyN(w, br, int64(n)); err != nil {
+			return err
+		}
+	}
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"io"
+	"sync"
+	"testing"
+)
+
+// Counts the bytes read through it:
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+func Test_gifFrameReader(t *testing.T) {
+	buf := &bytes.Buffer{}
+	if err := gif.EncodeAll(buf, testAnimation()); err != nil {
+		t.Fatal(err)
+	}
+	g, err := gif.DecodeAll(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Streamed frames composite to the same pictures as fully decoded ones:
+	expected, expectedDelays := displayedFrames(g, image.Rect(0, 0, 16, 16))
+	fr, err := newGIFFrameReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The loop count is known before the first frame is decoded:
+	if fr.LoopCount != 3 {
+		t.Errorf("expected loop count 3, got %d", fr.LoopCount)
+	}
+	comp := newFrameCompositor(fr, image.Rect(0, 0, fr.Width, fr.Height))
+	for i := range expected {
+		canvas, delay := comp.Next()
+		if canvas == nil || !sameRGBA(canvas, expected[i]) || delay != expectedDelays[i] {
+			t.Fatalf("frame %d differs (%v)", i, comp.Err())
+		}
+	}
+	if canvas, _ := comp.Next(); canvas != nil || comp.Err() != nil {
+		t.Errorf("expected the end of the frames, got %v", comp.Err())
+	}
+
+	// Truncated files stop with an error:
+	comp, err = newGIFStreamCompositor(bytes.NewReader(buf.Bytes()[:buf.Len()/2]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for canvas, _ := comp.Next(); canvas != nil; canvas, _ = comp.Next() {
+	}
+	if comp.Err() == nil {
+		t.Errorf("expected a truncated GIF to fail")
+	}
+}
+
+func Test_decodeGIFThumbFrame_stopsEarly(t *testing.T) {
+	data := largeTestGIF()
+	r := &countingReader{r: bytes.NewReader(data)}
+	comp, err := newGIFStreamCompositor(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = representativeGIFFrame(comp); err != nil {
+		t.Fatal(err)
+	}
+	if r.n > len(data)/4 {
+		t.Errorf("read %d of %d bytes for the first frame", r.n, len(data))
+	}
+
+	// A picked frame out of range falls back to a representative one:
+	frame := int64(1000)
+	img, err := decodeGIFThumbFrame(bytes.NewReader(data), &frame)
+	if err != nil || img.Bounds().Dx() != 640 {
+		t.Errorf("expected a fallback frame, got %v", err)
+	}
+}
+
+var largeGIF struct {
+	sync.Once
+	data []byte
+}
+
+// A 640x480 animation of 120 full frames with a moving band:
+func largeTestGIF() []byte {
+	largeGIF.Do(func() {
+		palette := color.Palette{}
+		for i := 0; i < 256; i++ {
+			palette = append(palette, color.RGBA{uint8(i), uint8(255 - i), uint8(i * 7), 255})
+		}
+		g := &gif.GIF{}
+		for n := 0; n < 120; n++ {
+			frame := image.NewPaletted(image.Rect(0, 0, 640, 480), palette)
+			for y := 0; y < 480; y++ {
+				for x := 0; x < 640; x++ {
+					frame.Pix[y*frame.Stride+x] = uint8((x + y + n*8) / 16)
+				}
+			}
+			g.Image = append(g.Image, frame)
+			g.Delay = append(g.Delay, 4)
+		}
+		buf := &bytes.Buffer{}
+		gif.EncodeAll(buf, g)
+		largeGIF.data = buf.Bytes()
+	})
+	return largeGIF.data
+}
+
+func Benchmark_thumbFrame_streamed(b *testing.B) {
+	data := largeTestGIF()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := decodeGIFThumbFrame(bytes.NewReader(data), nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func Benchmark_thumbFrame_decodeAll(b *testing.B) {
+	data := largeTestGIF()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		g, err := gif.DecodeAll(bytes.NewReader(data))
+		if err != nil {
+			b.Fatal(err)
+		}
+		representativeGIFFrame(newGIFCompositor(g))
+	}
+}
+
+func Benchmark_lateFrame_streamed(b *testing.B) {
+	data := largeTestGIF()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		comp, err := newGIFStreamCompositor(bytes.NewReader(data))
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err = compositeGIFFrame(comp, 100); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func Benchmark_lateFrame_decodeAll(b *testing.B) {
+	data := largeTestGIF()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		g, err := gif.DecodeAll(bytes.NewReader(data))
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err = compositeGIFFrame(newGIFCompositor(g), 100); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
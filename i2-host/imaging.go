@@ -10,7 +10,6 @@ import (
 
 import (
 	"github.com/JamesDunne/go-util/imaging"
-	"github.com/JamesDunne/go-util/imaging/gif" // my own patches to image/gif
 	"image"
 	//"image/color"
 	"image/jpeg"
@@ -25,11 +24,38 @@ func getImageInfo(image_path string) (w int, h int, kind string, err error) {
 	}
 	defer imf.Close()
 
+	// Videos report their container's dimensions:
+	if kind := sniffVideoFile(image_path); kind != "" {
+		info, err := getVideoInfo(image_path)
+		if err != nil {
+			return 0, 0, "", err
+		}
+		return info.Width, info.Height, kind, nil
+	}
+
+	// SVGs report the size they are rasterized at:
+	if isSVGFile(image_path) {
+		icon, err := readSVG(image_path)
+		if err != nil {
+			return 0, 0, "", err
+		}
+		w, h = svgSize(icon)
+		return w, h, "svg", nil
+	}
+
 	config, kind, err := image.DecodeConfig(imf)
 	if err != nil {
 		return 0, 0, "", err
 	}
 
+	// Report the dimensions as displayed; EXIF orientations 5-8 are rotated by 90 degrees:
+	if kind == "jpeg" {
+		imf.Seek(0, 0)
+		if decodeJPEGMetadata(imf).Orientation >= 5 {
+			return config.Height, config.Width, kind, nil
+		}
+	}
+
 	return config.Width, config.Height, kind, nil
 }
 
@@ -44,6 +70,13 @@ func cropImage(image_path string, left, top, right, bottom int) (tmp_output stri
 	}
 	defer imf.Close()
 
+	// Refuse images too large to decode and wait for room to decode them in; GIFs are cropped a frame at a time:
+	release, err := acquireDecode(imf, false)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+
 	// Figure out what kind of image it is:
 	_, imageKind, err := image.DecodeConfig(imf)
 	if err != nil {
@@ -54,43 +87,18 @@ func cropImage(image_path string, left, top, right, bottom int) (tmp_output stri
 	// Crop images:
 	switch imageKind {
 	case "gif":
-		// Decode all GIF frames and crop them:
-
-		// FIXME(jsd): This approach clearly does not work. An integrated decoder-encoder needs to be written
-		// for animated GIFs so as to preserve as much of the encoding details as possible and crop the
-		// transparent animation subframes over the full image.
-
-		var g *gif.GIF
-		g, err = gif.DecodeAll(imf)
-		if err != nil {
-			return "", err
-		}
-
-		// Crop all the frames:
-		for i, img := range g.Image {
-			if !cropBounds.In(img.Bounds()) {
-				return "", fmt.Errorf("Crop boundaries are not contained within image boundaries")
-			}
-
-			g.Image[i] = imaging.CloneKind(imaging.SubImageKind(img, cropBounds)).(*image.Paletted)
-		}
-
-		// Write the cropped images to a new GIF:
+		// Composite, crop and re-encode each GIF frame in turn:
 		tmpf, err := TempFile(tmp_folder(), "crop-", ".gif")
 		if err != nil {
 			return "", err
 		}
 		defer tmpf.Close()
 
-		err = gif.EncodeAll(tmpf, g)
-		if err != nil {
+		if err = cropGIF(imf, tmpf, cropBounds); err != nil {
+			os.Remove(tmpf.Name())
 			return "", err
 		}
 
-		g.Image = nil
-		g.Delay = nil
-		g = nil
-
 		return tmpf.Name(), nil
 	case "jpeg":
 		img, err := jpeg.Decode(imf)
@@ -98,6 +106,10 @@ func cropImage(image_path string, left, top, right, bottom int) (tmp_output stri
 			return "", err
 		}
 
+		// Crop boundaries are given in displayed coordinates; the output has the orientation applied:
+		imf.Seek(0, 0)
+		img = applyOrientation(img, decodeJPEGMetadata(imf).Orientation)
+
 		if !cropBounds.In(img.Bounds()) {
 			return "", fmt.Errorf("Crop boundaries are not contained within image boundaries")
 		}
@@ -153,11 +165,13 @@ func ensureThumbnail(image_path, thumb_path string) (err error) {
 	var firstImage image.Image
 	var imageKind string
 
-	firstImage, imageKind, err = decodeFirstImage(image_path)
-	defer func() { firstImage = nil }()
+	var release func()
+
+	firstImage, imageKind, release, err = decodeFirstImage(image_path)
 	if err != nil {
 		return err
 	}
+	defer release()
 
 	return generateThumbnail(firstImage, imageKind, thumb_path)
 }
@@ -205,16 +219,13 @@ func generateThumbnail(firstImage image.Image, imageKind string, thumb_path stri
 		encoder = func(w io.Writer, img image.Image) error { return jpeg.Encode(w, img, &jpeg.Options{Quality: 100}) }
 	case "png":
 		encoder = png.Encode
-	case "gif":
+	default:
+		// GIFs and the formats we cannot encode get PNG thumbnails:
 		encoder = png.Encode
 	}
 
 	// Generate the thumbnail image:
 	thumbImg := makeThumbnail(firstImage, thumbnail_dimensions)
-	defer func() {
-		firstImage = nil
-		thumbImg = nil
-	}()
 
 	// Save it to a file:
 	os.Remove(thumb_path)
@@ -233,39 +244,56 @@ func generateThumbnail(firstImage image.Image, imageKind string, thumb_path stri
 	return nil
 }
 
-func decodeFirstImage(local_path string) (firstImage image.Image, imageKind string, err error) {
+// Decodes the image a file's thumbnail is made from, once there is room in the decode budget for it;
+// release must be called once firstImage is no longer needed:
+func decodeFirstImage(local_path string) (firstImage image.Image, imageKind string, release func(), err error) {
+	if kind := sniffVideoFile(local_path); kind != "" {
+		firstImage, release, err = decodeVideoPoster(local_path)
+		return firstImage, kind, release, err
+	}
+	if isSVGFile(local_path) {
+		if firstImage, release, err = rasterizeSVG(local_path); err != nil {
+			return nil, "", nil, err
+		}
+		return firstImage, "svg", release, nil
+	}
+
 	imf, err := os.Open(local_path)
 	if err != nil {
-		return nil, "", err
+		return nil, "", nil, err
 	}
 	defer imf.Close()
 
+	// Refuse images too large to decode and wait for room to decode them in:
+	if release, err = acquireDecode(imf, false); err != nil {
+		return nil, "", nil, err
+	}
+
 	_, imageKind, err = image.DecodeConfig(imf)
 	if err != nil {
-		return nil, "", err
+		release()
+		return nil, "", nil, err
 	}
 	imf.Seek(0, 0)
 
 	switch imageKind {
 	case "gif":
-		// Decode GIF frames until we reach the first fully opaque image:
-		var g *gif.GIF
-		g, err = gif.DecodeAll(imf)
-		if err != nil {
-			return nil, "", err
-		}
-
-		firstFrame := g.Image[0]
-		g.Image = nil
-		g.Delay = nil
-		g = nil
-
-		return firstFrame, imageKind, nil
+		// Composite GIF frames until we reach a representative one, leaving the rest unread:
+		firstImage, err = decodeGIFThumbFrame(imf, nil)
+	case "webp":
+		firstImage, err = decodeWebP(imf)
 	default:
 		firstImage, imageKind, err = image.Decode(imf)
-		if err != nil {
-			return nil, "", err
+
+		// Turn JPEGs the right way up:
+		if err == nil && imageKind == "jpeg" {
+			imf.Seek(0, 0)
+			firstImage = applyOrientation(firstImage, decodeJPEGMetadata(imf).Orientation)
 		}
-		return
 	}
+	if err != nil {
+		release()
+		return nil, "", nil, err
+	}
+	return firstImage, imageKind, release, nil
 }
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+import "github.com/JamesDunne/go-util/web"
+
+// File extensions rehosted locally for imgur-gifv images:
+var imgurGifvExts = []string{".webm", ".mp4", ".gif"}
+
+// Extracts the imgur hash from an imgur-gifv image's SourceURL:
+func imgurHash(sourceURL string) string {
+	hash := filename(sourceURL)
+	if strings.HasPrefix(hash, "/") {
+		hash = hash[1:]
+	}
+	return hash
+}
+
+func storePath(id int64, ext string) string {
+	return path.Join(store_folder(), strconv.FormatInt(id, 10)+ext)
+}
+
+func fileExists(local_path string) bool {
+	_, err := os.Stat(local_path)
+	return err == nil
+}
+
+// Determines whether an imgur-gifv image has a playable local video:
+func hasLocalGifv(id int64) bool {
+	return fileExists(storePath(id, ".mp4")) || fileExists(storePath(id, ".webm"))
+}
+
+// Starts background downloads of the given imgur media files and returns a function that waits
+// for them and moves them into the store for the given image ID, generating a thumbnail from the GIF.
+func downloadImgurGifv(hash string, exts []string) func(id int64) *web.Error {
+	wg := &sync.WaitGroup{}
+	paths := make([]string, len(exts))
+	for i, ext := range exts {
+		wg.Add(1)
+		go func(ext string, path *string) {
+			defer wg.Done()
+
+			var werr *web.Error
+			*path, _, werr = downloadFile(imgurMediaBase + hash + ext)
+			if werr != nil {
+				log.Println(werr.Error)
+				*path = ""
+				return
+			}
+		}(ext, &paths[i])
+	}
+
+	return func(id int64) *web.Error {
+		// Wait for all files to download:
+		wg.Wait()
+
+		// Move temp files to final storage; missing files fall back to imgur:
+		for i, ext := range exts {
+			if paths[i] == "" {
+				continue
+			}
+			if werr := moveToStoreFolder(paths[i], id, ext); werr != nil {
+				return werr
+			}
+		}
+
+		// Generate a thumbnail from the GIF version:
+		gif_path := storePath(id, ".gif")
+		if fileExists(gif_path) {
+			os.MkdirAll(thumb_folder(), 0755)
+			thumb_path := path.Join(thumb_folder(), strconv.FormatInt(id, 10)+".png")
+			if err := ensureThumbnail(gif_path, thumb_path); err != nil {
+				log.Println(err)
+			}
+		}
+
+		if !hasLocalGifv(id) {
+			return web.AsError(fmt.Errorf("Could not download imgur video for '%s'", hash), http.StatusBadGateway)
+		}
+		return nil
+	}
+}
+
+// Downloads any missing local files for existing imgur-gifv images, e.g. `i2-host backfill-gifv`:
+func backfillGifvCommand(args []string) error {
+	fs := flag.NewFlagSet("backfill-gifv", flag.ExitOnError)
+	concurrency := fs.Int("j", 4, "Number of images to download concurrently")
+	fs.Parse(args)
+	if *concurrency < 1 {
+		*concurrency = 1
+	}
+
+	list, werr := getList("all", true, ImagesOrderByIDASC)
+	if werr != nil {
+		return werr.Error
+	}
+
+	work := make(chan *Image)
+	wg := &sync.WaitGroup{}
+	failed := 0
+	failedLock := &sync.Mutex{}
+	for w := 0; w < *concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for img := range work {
+				// Only fetch what is missing:
+				missing := make([]string, 0, len(imgurGifvExts))
+				for _, ext := range imgurGifvExts {
+					if !fileExists(storePath(img.ID, ext)) {
+						missing = append(missing, ext)
+					}
+				}
+				thumb_path := path.Join(thumb_folder(), strconv.FormatInt(img.ID, 10)+".png")
+				if len(missing) == 0 && fileExists(thumb_path) {
+					continue
+				}
+
+				hash := imgurHash(*img.SourceURL)
+				if werr := downloadImgurGifv(hash, missing)(img.ID); werr != nil {
+					log.Printf("%s (%d): failed: %s\n", b62.Encode(img.ID+10000), img.ID, werr.Error)
+					failedLock.Lock()
+					failed++
+					failedLock.Unlock()
+					continue
+				}
+				log.Printf("%s (%d): fetched %s\n", b62.Encode(img.ID+10000), img.ID, strings.Join(missing, " "))
+			}
+		}()
+	}
+
+	for i := range list {
+		img := &list[i]
+		if img.Kind != "imgur-gifv" || img.SourceURL == nil {
+			continue
+		}
+		work <- img
+	}
+	close(work)
+	wg.Wait()
+
+	if failed > 0 {
+		return fmt.Errorf("%d images could not be backfilled", failed)
+	}
+	return nil
+}
+
+// Base URLs of the imgur API, web pages and media host and the client ID used to call the API:
+var (
+	imgurAPIBase   = "https://api.imgur.com/3"
+	imgurPageBase  = "https://imgur.com"
+	imgurMediaBase = "http://i.imgur.com/"
+	imgurClientID  = ""
+)
+
+// Recognizes imgur album and gallery links, e.g. `https://imgur.com/a/Xy12z` or `https://imgur.com/gallery/funny-cat-Xy12z`:
+func imgurAlbumID(source string) (endpoint, id string, ok bool) {
+	u, err := url.Parse(source)
+	if err != nil {
+		return "", "", false
+	}
+	switch u.Host {
+	case "imgur.com", "www.imgur.com", "m.imgur.com":
+	default:
+		return "", "", false
+	}
+
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(parts) != 2 || parts[1] == "" {
+		return "", "", false
+	}
+
+	// Newer links prefix the ID with a slug of the title:
+	id = parts[1][strings.LastIndex(parts[1], "-")+1:]
+	switch parts[0] {
+	case "a":
+		return "album", id, true
+	case "gallery":
+		return "gallery", id, true
+	}
+	return "", "", false
+}
+
+// An image of an album, or a single gallery image:
+type imgurItem struct {
+	ID       string `json:"id"`
+	Title    string `json:"title"`
+	Animated bool   `json:"animated"`
+	Link     string `json:"link"`
+}
+
+type imgurAlbum struct {
+	imgurItem
+	IsAlbum bool        `json:"is_album"`
+	Images  []imgurItem `json:"images"`
+}
+
+// Fetches an album or gallery post from the imgur API, or from its web page without a client ID;
+// a gallery post of a single image yields that image:
+func fetchImgurAlbum(endpoint, id string) (*imgurAlbum, error) {
+	if imgurClientID == "" {
+		return fetchImgurAlbumPage(endpoint, id)
+	}
+
+	req, err := http.NewRequest("GET", imgurAPIBase+"/"+endpoint+"/"+url.PathEscape(id), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Client-ID "+imgurClientID)
+
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("imgur API returned %s for %s '%s'", rsp.Status, endpoint, id)
+	}
+
+	body := &struct {
+		Data imgurAlbum `json:"data"`
+	}{}
+	if err = json.NewDecoder(rsp.Body).Decode(body); err != nil {
+		return nil, err
+	}
+
+	album := &body.Data
+	if len(album.Images) == 0 && !album.IsAlbum && album.Link != "" {
+		album.Images = []imgurItem{album.imgurItem}
+	}
+	return album, nil
+}
+
+// Media links on imgur pages, e.g. `https://i.imgur.com/one.jpeg`:
+var imgurMediaLink = regexp.MustCompile(`//i\.imgur\.com/([A-Za-z0-9]+)\.(jpe?g|png|gif|gifv|mp4|webm)`)
+
+// Fetches an album or gallery post from its imgur web page:
+func fetchImgurAlbumPage(endpoint, id string) (*imgurAlbum, error) {
+	page := "/a/"
+	if endpoint == "gallery" {
+		page = "/gallery/"
+	}
+	rsp, err := http.Get(imgurPageBase + page + url.PathEscape(id))
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("imgur returned %s for %s '%s'", rsp.Status, endpoint, id)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(rsp.Body, 8<<20))
+	if err != nil {
+		return nil, err
+	}
+	return scrapeImgurAlbumPage(body), nil
+}
+
+// Reads an album from an imgur page, preferring the post data embedded for its scripts over the media links in its markup:
+func scrapeImgurAlbumPage(body []byte) *imgurAlbum {
+	album := &imgurAlbum{IsAlbum: true}
+
+	post := &struct {
+		Title string `json:"title"`
+		Media []struct {
+			ID       string `json:"id"`
+			URL      string `json:"url"`
+			Ext      string `json:"ext"`
+			Type     string `json:"type"`
+			Metadata struct {
+				Title string `json:"title"`
+			} `json:"metadata"`
+		} `json:"media"`
+	}{}
+	if data, ok := imgurPostData(body); ok && json.Unmarshal([]byte(data), post) == nil && len(post.Media) > 0 {
+		album.Title = post.Title
+		for _, m := range post.Media {
+			item := imgurItem{ID: m.ID, Title: m.Metadata.Title, Link: m.URL}
+			if item.Link == "" {
+				item.Link = imgurMediaBase + m.ID + "." + m.Ext
+			}
+			item.Animated = m.Type == "video" || m.Ext == "gif" || m.Ext == "mp4"
+			album.Images = append(album.Images, item)
+		}
+		return album
+	}
+
+	// Take the title from the page and each linked image once in page order, skipping thumbnails of
+	// images already listed, which imgur names by appending a size letter to the image ID:
+	info := scrapePage(bytes.NewReader(body), nil)
+	album.Title = strings.TrimSuffix(strings.TrimSuffix(info.Title, " - Imgur"), " - Album on Imgur")
+	linked := make(map[string]bool)
+	matches := imgurMediaLink.FindAllStringSubmatch(string(body), -1)
+	for _, m := range matches {
+		linked[m[1]] = true
+	}
+	listed := make(map[string]bool)
+	for _, m := range matches {
+		itemID, ext := m[1], m[2]
+		if listed[itemID] || linked[itemID[:len(itemID)-1]] {
+			continue
+		}
+		listed[itemID] = true
+		album.Images = append(album.Images, imgurItem{
+			ID:       itemID,
+			Link:     imgurMediaBase + itemID + "." + ext,
+			Animated: ext != "jpg" && ext != "jpeg" && ext != "png",
+		})
+	}
+	return album
+}
+
+// Extracts the JSON of the post data script string, e.g. `window.postDataJSON="{\"title\":...}"`:
+func imgurPostData(body []byte) (string, bool) {
+	const marker = "postDataJSON="
+	i := bytes.Index(body, []byte(marker))
+	if i < 0 {
+		return "", false
+	}
+	rest := body[i+len(marker):]
+	if len(rest) == 0 || rest[0] != '"' {
+		return "", false
+	}
+
+	// Find the closing quote of the script string and decode its escapes:
+	for j := 1; j < len(rest); j++ {
+		switch rest[j] {
+		case '\\':
+			j++
+		case '"':
+			var data string
+			if err := json.Unmarshal(rest[:j+1], &data); err != nil {
+				return "", false
+			}
+			return data, true
+		}
+	}
+	return "", false
+}
+
+// Stores each item of an imgur album as its own image in album order, tagged with the album's title.
+// The base request supplies the collection, submitter, keywords and nsfw flag; failed items are reported.
+func storeImgurAlbum(base *imageStoreRequest, endpoint, id string) ([]uploadResult, *web.Error) {
+	album, err := fetchImgurAlbum(endpoint, id)
+	if werr := web.AsError(err, http.StatusBadGateway); werr != nil {
+		return nil, werr
+	}
+	if len(album.Images) == 0 {
+		return nil, web.AsError(fmt.Errorf("imgur %s '%s' has no images", endpoint, id), http.StatusBadRequest)
+	}
+
+	albumTitle := firstNonEmpty(base.Title, album.Title)
+	albumKeywords := titleToKeywords(album.Title)
+
+	results := make([]uploadResult, 0, len(album.Images))
+	for i, item := range album.Images {
+		store := &imageStoreRequest{
+			CollectionName: base.CollectionName,
+			Submitter:      base.Submitter,
+			IsClean:        base.IsClean,
+			SourceURL:      item.Link,
+			Title:          item.Title,
+		}
+		if item.Animated {
+			// Rehost animations as gifv:
+			store.SourceURL = "https://i.imgur.com/" + item.ID + ".mp4"
+		}
+		if store.Title == "" && albumTitle != "" {
+			store.Title = albumTitle
+			if len(album.Images) > 1 {
+				store.Title += " " + strconv.Itoa(i+1)
+			}
+		}
+		if store.Title == "" {
+			store.Title = item.ID
+		}
+		store.Keywords = strings.TrimSpace(firstNonEmpty(base.Keywords, titleToKeywords(store.Title)) + " " + albumKeywords)
+
+		result := uploadResult{FileName: firstNonEmpty(item.Link, item.ID), Title: store.Title}
+		werr := downloadImageFor(store)
+		if werr == nil {
+			result.ID, werr = storeImage(store)
+		}
+		if werr != nil {
+			result.Error = werr.Error.Error()
+			result.ID = 0
+		} else {
+			result.Base62ID = b62.Encode(result.ID + 10000)
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
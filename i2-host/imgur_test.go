@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func Test_imgurAlbumID(t *testing.T) {
+	tests := []struct {
+		url      string
+		endpoint string
+		id       string
+	}{
+		{"https://imgur.com/a/Xy12z", "album", "Xy12z"},
+		{"http://imgur.com/gallery/Xy12z", "gallery", "Xy12z"},
+		{"https://imgur.com/gallery/funny-cat-Xy12z", "gallery", "Xy12z"},
+		{"https://i.imgur.com/Xy12z.gifv", "", ""},
+		{"https://imgur.com/Xy12z", "", ""},
+	}
+	for _, test := range tests {
+		endpoint, id, _ := imgurAlbumID(test.url)
+		if endpoint != test.endpoint || id != test.id {
+			t.Errorf("%s: expected %s/%s, got %s/%s", test.url, test.endpoint, test.id, endpoint, id)
+		}
+	}
+}
+
+func Test_storeImgurAlbum(t *testing.T) {
+	_, done := withTempStore(t)
+	defer done()
+
+	api, err := NewAPI()
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.Close()
+
+	buf := &bytes.Buffer{}
+	png.Encode(buf, image.NewRGBA(image.Rect(0, 0, 8, 8)))
+
+	// A local stand-in for the imgur API and its image host:
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(rsp http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/3/album/Xy12z":
+			if req.Header.Get("Authorization") != "Client-ID test" {
+				rsp.WriteHeader(http.StatusForbidden)
+				return
+			}
+			fmt.Fprintf(rsp, `{"data": {"title": "Cat Pics", "is_album": true, "images": [
+				{"id": "one", "title": "", "link": "%[1]s/one.png"},
+				{"id": "two", "title": "Sleepy", "link": "%[1]s/two.png"},
+				{"id": "gone", "title": "", "link": "%[1]s/gone.png"}
+			]}, "success": true}`, srv.URL)
+		case "/one.png", "/two.png":
+			rsp.Header().Set("Content-Type", "image/png")
+			rsp.Write(buf.Bytes())
+		default:
+			http.NotFound(rsp, req)
+		}
+	}))
+	defer srv.Close()
+
+	defer func(base, id string) { imgurAPIBase, imgurClientID = base, id }(imgurAPIBase, imgurClientID)
+	imgurAPIBase = srv.URL + "/3"
+	imgurClientID = "test"
+
+	results, werr := storeImgurAlbum(&imageStoreRequest{CollectionName: "cats", IsClean: true}, "album", "Xy12z")
+	if werr != nil {
+		t.Fatal(werr.Error)
+	}
+	if len(results) != 3 {
+		t.Fatalf("expected 3 results, got %+v", results)
+	}
+	if results[0].Error != "" || results[1].Error != "" || results[2].Error == "" {
+		t.Fatalf("expected only the last item to fail: %+v", results)
+	}
+	if results[0].ID >= results[1].ID {
+		t.Errorf("album order was not preserved: %+v", results)
+	}
+
+	img, _ := getImage(results[0].ID)
+	if img.Title != "Cat Pics 1" || img.Keywords != "cat pics 1 cat pics" || img.CollectionName != "cats" {
+		t.Errorf("unexpected first image %+v", img)
+	}
+	img, _ = getImage(results[1].ID)
+	if img.Title != "Sleepy" || img.Keywords != "sleepy cat pics" {
+		t.Errorf("unexpected second image %+v", img)
+	}
+}
+
+func Test_storeImgurAlbum_page(t *testing.T) {
+	_, done := withTempStore(t)
+	defer done()
+
+	api, err := NewAPI()
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.Close()
+
+	buf := &bytes.Buffer{}
+	png.Encode(buf, image.NewRGBA(image.Rect(0, 0, 8, 8)))
+
+	// A local stand-in for imgur's web pages and image host:
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(rsp http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/a/Xy12z":
+			post := fmt.Sprintf(`{"title": "Cat Pics", "media": [
+				{"id": "one", "url": "%[1]s/one.png", "ext": "png", "type": "image", "metadata": {"title": ""}},
+				{"id": "two", "url": "%[1]s/two.png", "ext": "png", "type": "image", "metadata": {"title": "Sleepy"}},
+				{"id": "gone", "url": "%[1]s/gone.png", "ext": "png", "type": "image", "metadata": {"title": ""}}
+			]}`, srv.URL)
+			quoted, _ := json.Marshal(post)
+			fmt.Fprintf(rsp, `<html><head><title>Cat Pics - Album on Imgur</title></head><body><script>window.postDataJSON=%s</script></body></html>`, quoted)
+		case "/gallery/Gal12":
+			fmt.Fprint(rsp, `<html><head><meta property="og:title" content="Dog Pics - Imgur" />
+				<meta property="og:image" content="https://i.imgur.com/two.png?fb" /></head>
+				<body><img src="//i.imgur.com/twob.png"><a href="https://i.imgur.com/one.png">one</a></body></html>`)
+		case "/one.png", "/two.png":
+			rsp.Header().Set("Content-Type", "image/png")
+			rsp.Write(buf.Bytes())
+		default:
+			http.NotFound(rsp, req)
+		}
+	}))
+	defer srv.Close()
+
+	defer func(page, media, id string) {
+		imgurPageBase, imgurMediaBase, imgurClientID = page, media, id
+	}(imgurPageBase, imgurMediaBase, imgurClientID)
+	imgurPageBase = srv.URL
+	imgurMediaBase = srv.URL + "/"
+	imgurClientID = ""
+
+	// Without a client ID, albums are read from the page's post data:
+	results, werr := storeImgurAlbum(&imageStoreRequest{CollectionName: "cats"}, "album", "Xy12z")
+	if werr != nil {
+		t.Fatal(werr.Error)
+	}
+	if len(results) != 3 || results[0].Error != "" || results[1].Error != "" || results[2].Error == "" {
+		t.Fatalf("expected only the last item to fail: %+v", results)
+	}
+	if results[0].ID >= results[1].ID {
+		t.Errorf("album order was not preserved: %+v", results)
+	}
+	img, _ := getImage(results[0].ID)
+	if img.Title != "Cat Pics 1" || img.Keywords != "cat pics 1 cat pics" || img.CollectionName != "cats" {
+		t.Errorf("unexpected first image %+v", img)
+	}
+	img, _ = getImage(results[1].ID)
+	if img.Title != "Sleepy" || img.Keywords != "sleepy cat pics" {
+		t.Errorf("unexpected second image %+v", img)
+	}
+
+	// Gallery links are titled by imgur and expanded from the page's media links, skipping thumbnails:
+	source := "https://imgur.com/gallery/dog-pics-Gal12"
+	if needsTitle(source) {
+		t.Errorf("expected a gallery link to be titled by imgur")
+	}
+	endpoint, id, _ := imgurAlbumID(source)
+	results, werr = storeImgurAlbum(&imageStoreRequest{}, endpoint, id)
+	if werr != nil {
+		t.Fatal(werr.Error)
+	}
+	if len(results) != 2 || results[0].Error != "" || results[1].Error != "" {
+		t.Fatalf("expected two stored images: %+v", results)
+	}
+	img, _ = getImage(results[0].ID)
+	if img.Title != "Dog Pics 1" || img.Kind != "png" || *img.SourceURL != srv.URL+"/two.png" {
+		t.Errorf("unexpected first gallery image %+v", img)
+	}
+}
+
+func Test_xlatImageViewModel_gifv(t *testing.T) {
+	_, done := withTempStore(t)
+	defer done()
+	os.MkdirAll(store_folder(), 0755)
+
+	source := "AbCd"
+	img := &Image{ID: 1, Kind: "imgur-gifv", SourceURL: &source}
+	ioutil.WriteFile(storePath(1, ".mp4"), []byte("mp4"), 0644)
+
+	// Without the GIF there is nothing to make a local thumbnail from:
+	if o := xlatImageViewModel(img, nil); o.ImageURL != "/"+o.Base62ID || o.ThumbURL != "http://i.imgur.com/AbCdb.jpg" {
+		t.Errorf("unexpected URLs %s %s", o.ImageURL, o.ThumbURL)
+	}
+
+	ioutil.WriteFile(storePath(1, ".gif"), []byte("gif"), 0644)
+	if o := xlatImageViewModel(img, nil); o.ThumbURL != "/t/"+o.Base62ID+".png" {
+		t.Errorf("expected a local thumbnail, got %s", o.ThumbURL)
+	}
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+import "github.com/JamesDunne/go-util/web"
+
+// A single image to import as described by a manifest:
+type manifestRow struct {
+	URL        string `json:"url"`
+	Path       string `json:"path"`
+	Title      string `json:"title"`
+	Keywords   string `json:"keywords"`
+	Collection string `json:"collection"`
+	NSFW       bool   `json:"nsfw"`
+	Submitter  string `json:"submitter"`
+	ID         int64  `json:"id"`
+
+	// 1-based row number within the manifest:
+	Row int `json:"-"`
+}
+
+// Identifies a row across runs so that imports can be resumed:
+func (row *manifestRow) key() string {
+	source := row.URL
+	if source == "" {
+		source = "file://" + row.Path
+	}
+	return strconv.FormatInt(row.ID, 10) + "\t" + row.Collection + "\t" + source
+}
+
+// Reads a CSV (with a header row) or JSON array manifest:
+func readManifest(manifest_path string) (rows []*manifestRow, err error) {
+	f, err := os.Open(manifest_path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if strings.ToLower(filepath.Ext(manifest_path)) == ".json" {
+		err = json.NewDecoder(f).Decode(&rows)
+		if err != nil {
+			return nil, err
+		}
+		for i, row := range rows {
+			row.Row = i + 1
+		}
+	} else {
+		rows, err = readCSVManifest(f)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Resolve local paths relative to the manifest:
+	for _, row := range rows {
+		if row.URL == "" && row.Path == "" {
+			return nil, fmt.Errorf("Row %d: requires either 'url' or 'path'", row.Row)
+		}
+		if row.Path != "" && !filepath.IsAbs(row.Path) {
+			row.Path = filepath.Join(filepath.Dir(manifest_path), row.Path)
+		}
+	}
+	return rows, nil
+}
+
+func readCSVManifest(r io.Reader) (rows []*manifestRow, err error) {
+	csvr := csv.NewReader(r)
+	csvr.TrimLeadingSpace = true
+
+	header, err := csvr.Read()
+	if err != nil {
+		return nil, err
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+
+	for n := 1; ; n++ {
+		record, err := csvr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		get := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+
+		row := &manifestRow{
+			URL:        get("url"),
+			Path:       get("path"),
+			Title:      get("title"),
+			Keywords:   get("keywords"),
+			Collection: get("collection"),
+			Submitter:  get("submitter"),
+			Row:        n,
+		}
+		switch strings.ToLower(get("nsfw")) {
+		case "1", "true", "yes", "y":
+			row.NSFW = true
+		}
+		if id_s := get("id"); id_s != "" {
+			row.ID, err = strconv.ParseInt(id_s, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("Row %d: bad id: %s", n, err)
+			}
+		}
+
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// Copies a local file into the tmp folder so the original is left untouched:
+func copyToTemp(local_path string) (string, error) {
+	src, err := os.Open(local_path)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	os.MkdirAll(tmp_folder(), 0755)
+	tmpf, err := TempFile(tmp_folder(), "imp-", path.Ext(local_path))
+	if err != nil {
+		return "", err
+	}
+	defer tmpf.Close()
+
+	if _, err = io.Copy(tmpf, src); err != nil {
+		os.Remove(tmpf.Name())
+		return "", err
+	}
+	return tmpf.Name(), nil
+}
+
+// Runs a manifest row through the same ingestion pipeline as /col/add and /col/upload:
+func importRow(row *manifestRow, storeLock *sync.Mutex) (id int64, skipped string, werr *web.Error) {
+	// Fixed IDs that already exist are considered imported:
+	if row.ID > 0 {
+		img, werr := getImage(row.ID)
+		if werr != nil {
+			return 0, "", werr
+		}
+		if img != nil {
+			return row.ID, "ID already exists", nil
+		}
+	}
+
+	store := &imageStoreRequest{
+		ID:             row.ID,
+		CollectionName: row.Collection,
+		Submitter:      row.Submitter,
+		Title:          row.Title,
+		Keywords:       strings.ToLower(row.Keywords),
+		IsClean:        !row.NSFW,
+	}
+	if store.Submitter == "" {
+		store.Submitter = "import"
+	}
+
+	if row.URL != "" {
+		store.SourceURL = row.URL
+		if werr = downloadImageFor(store); werr != nil {
+			return 0, "", werr
+		}
+		if store.Title == "" {
+			if u, err := url.Parse(row.URL); err == nil {
+				store.Title = filenameToTitle(u.Path)
+			}
+		}
+	} else {
+		local_path, err := copyToTemp(row.Path)
+		if werr = web.AsError(err, http.StatusBadRequest); werr != nil {
+			return 0, "", werr
+		}
+		defer os.Remove(local_path)
+
+		store.SourceURL = "file://" + filepath.Base(row.Path)
+		store.PostCreation = func(id int64, newImage *Image) *web.Error {
+			return moveFiles(local_path, id, newImage)
+		}
+		if store.Title == "" {
+			store.Title = filenameToTitle(row.Path)
+		}
+	}
+
+	// SQLite prefers a single writer:
+	storeLock.Lock()
+	defer storeLock.Unlock()
+
+	id, werr = storeImage(store)
+	return id, "", werr
+}
+
+type importResult struct {
+	Row     *manifestRow
+	ID      int64
+	Skipped string
+	Error   error
+}
+
+func importCommand(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	concurrency := fs.Int("j", 4, "Number of rows to download and process concurrently")
+	state_path := fs.String("state", "", "File recording imported rows so the import can be resumed (default: <manifest>.imported)")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: i2-host [flags] import [-j N] [-state file] <manifest.csv|manifest.json>")
+		fmt.Fprintln(os.Stderr, "Manifest columns: url or path, title, keywords, collection, nsfw, submitter, id")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("Expected a single manifest file")
+	}
+	manifest_path := fs.Arg(0)
+	if *state_path == "" {
+		*state_path = manifest_path + ".imported"
+	}
+	if *concurrency < 1 {
+		*concurrency = 1
+	}
+
+	rows, err := readManifest(manifest_path)
+	if err != nil {
+		return err
+	}
+
+	// Load the keys of rows imported by previous runs:
+	imported := make(map[string]int64)
+	if sf, err := os.Open(*state_path); err == nil {
+		scanner := bufio.NewScanner(sf)
+		for scanner.Scan() {
+			line := scanner.Text()
+			i := strings.LastIndex(line, "\t")
+			if i < 0 {
+				continue
+			}
+			id, err := strconv.ParseInt(line[i+1:], 10, 64)
+			if err != nil {
+				continue
+			}
+			imported[line[:i]] = id
+		}
+		sf.Close()
+	}
+
+	sf, err := os.OpenFile(*state_path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer sf.Close()
+
+	results := make([]importResult, len(rows))
+	seen := make(map[string]bool)
+
+	// Feed rows to a bounded pool of workers:
+	work := make(chan int)
+	wg := &sync.WaitGroup{}
+	storeLock := &sync.Mutex{}
+	stateLock := &sync.Mutex{}
+	for w := 0; w < *concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				row := rows[i]
+				id, skipped, werr := importRow(row, storeLock)
+				if werr != nil {
+					results[i].Error = werr.Error
+					log.Printf("row %d: failed: %s\n", row.Row, werr.Error)
+					continue
+				}
+
+				results[i].ID = id
+				if skipped != "" {
+					results[i].Skipped = skipped
+					continue
+				}
+				log.Printf("row %d: created %s\n", row.Row, b62.Encode(id+10000))
+
+				// Record progress so a rerun skips this row:
+				stateLock.Lock()
+				fmt.Fprintf(sf, "%s\t%d\n", row.key(), id)
+				sf.Sync()
+				stateLock.Unlock()
+			}
+		}()
+	}
+
+	for i, row := range rows {
+		results[i].Row = row
+		key := row.key()
+		if id, ok := imported[key]; ok {
+			results[i].ID = id
+			results[i].Skipped = "already imported"
+			continue
+		}
+		if seen[key] {
+			results[i].Skipped = "duplicate row"
+			continue
+		}
+		seen[key] = true
+
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+
+	// Print the per-row report:
+	created, skipped, failed := 0, 0, 0
+	for _, r := range results {
+		source := r.Row.URL
+		if source == "" {
+			source = r.Row.Path
+		}
+
+		switch {
+		case r.Error != nil:
+			failed++
+			fmt.Printf("%5d  FAILED   %-8s %s: %s\n", r.Row.Row, "", source, r.Error)
+		case r.Skipped != "":
+			skipped++
+			b62id := ""
+			if r.ID > 0 {
+				b62id = b62.Encode(r.ID + 10000)
+			}
+			fmt.Printf("%5d  SKIPPED  %-8s %s: %s\n", r.Row.Row, b62id, source, r.Skipped)
+		default:
+			created++
+			fmt.Printf("%5d  CREATED  %-8s %s\n", r.Row.Row, b62.Encode(r.ID+10000), source)
+		}
+	}
+	fmt.Printf("%d created, %d skipped, %d failed\n", created, skipped, failed)
+
+	if failed > 0 {
+		return fmt.Errorf("%d rows failed to import; rerun to retry them", failed)
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func Test_readCSVManifest(t *testing.T) {
+	manifest := `url,title,keywords,collection,nsfw,id
+http://example.com/a.gif,First,"cat dance",memes,1,
+, Second ,,,no,1234
+`
+	rows, err := readCSVManifest(strings.NewReader(manifest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 {
+		t.Fatalf("expected 2 rows, got %d", len(rows))
+	}
+
+	if r := rows[0]; r.URL != "http://example.com/a.gif" || r.Keywords != "cat dance" || r.Collection != "memes" || !r.NSFW || r.ID != 0 || r.Row != 1 {
+		t.Errorf("row 1 = %+v", *r)
+	}
+	if r := rows[1]; r.Title != "Second" || r.NSFW || r.ID != 1234 || r.Row != 2 {
+		t.Errorf("row 2 = %+v", *r)
+	}
+}
+
+func Test_filenameToTitle(t *testing.T) {
+	if title := filenameToTitle("/tmp/happy_cat-dance.gif"); title != "happy cat dance" {
+		t.Errorf("title = %q", title)
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+import "github.com/fsnotify/fsnotify"
+import "github.com/JamesDunne/go-util/web"
+
+// Watched drop folders: files saved into a collection's inbox directory are ingested once they
+// stop changing, then moved into its processed/ or failed/ subfolder.
+
+// Time a file's size and modification time must stay unchanged before it is ingested:
+var inboxSettle = 2 * time.Second
+
+// Optional `<file>.json` sidecar supplying details for a dropped file:
+type inboxSidecar struct {
+	Title    string `json:"title"`
+	Keywords string `json:"keywords"`
+	NSFW     bool   `json:"nsfw"`
+}
+
+// Last observed state of a file waiting to settle:
+type inboxPending struct {
+	size    int64
+	modTime time.Time
+	since   time.Time
+}
+
+// Determines whether a file in the inbox should be ingested; sidecars, hidden files and partial downloads are not:
+func isInboxCandidate(name string) bool {
+	lower := strings.ToLower(name)
+	if strings.HasPrefix(name, ".") || strings.HasSuffix(name, "~") {
+		return false
+	}
+	switch path.Ext(lower) {
+	case ".json", ".part", ".crdownload", ".tmp":
+		return false
+	}
+	return true
+}
+
+// Starts watching the inbox of every configured collection:
+func startInboxes() {
+	names := make([]string, 0, len(config.Collections))
+	for name := range config.Collections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, collectionName := range names {
+		dir := configFor(collectionName).Inbox
+		if dir == "" {
+			continue
+		}
+		go func(collectionName, dir string) {
+			if err := watchInbox(collectionName, dir); err != nil {
+				log.Printf("inbox %s: %s\n", dir, err)
+			}
+		}(collectionName, dir)
+	}
+}
+
+// Watches an inbox directory and ingests new files into the collection once they are stable:
+func watchInbox(collectionName, dir string) error {
+	for _, sub := range []string{"processed", "failed"} {
+		if err := os.MkdirAll(path.Join(dir, sub), 0775); err != nil {
+			return err
+		}
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+	if err = watcher.Add(dir); err != nil {
+		return err
+	}
+	log.Printf("inbox %s: watching for collection '%s'\n", dir, collectionName)
+
+	pending := make(map[string]*inboxPending)
+
+	// Pick up files dropped while the server was down:
+	if infos, err := ioutil.ReadDir(dir); err == nil {
+		for _, fi := range infos {
+			if fi.Mode().IsRegular() && isInboxCandidate(fi.Name()) {
+				pending[fi.Name()] = &inboxPending{size: -1}
+			}
+		}
+	}
+
+	tick := time.NewTicker(inboxSettle / 2)
+	defer tick.Stop()
+	for {
+		select {
+		case ev, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if ev.Op&(fsnotify.Create|fsnotify.Write) == 0 {
+				continue
+			}
+			name := path.Base(ev.Name)
+			if strings.HasSuffix(name, ".json") {
+				// A sidecar written after its file restarts the wait for that file:
+				if p, ok := pending[strings.TrimSuffix(name, ".json")]; ok {
+					p.size = -1
+				}
+				continue
+			}
+			if isInboxCandidate(name) {
+				if _, ok := pending[name]; !ok {
+					pending[name] = &inboxPending{size: -1}
+				}
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			log.Printf("inbox %s: %s\n", dir, err)
+		case now := <-tick.C:
+			for name, p := range pending {
+				fi, err := os.Stat(path.Join(dir, name))
+				if err != nil || !fi.Mode().IsRegular() {
+					// Removed or renamed away before it settled:
+					delete(pending, name)
+					continue
+				}
+				if fi.Size() != p.size || !fi.ModTime().Equal(p.modTime) {
+					p.size, p.modTime, p.since = fi.Size(), fi.ModTime(), now
+					continue
+				}
+				if now.Sub(p.since) < inboxSettle {
+					continue
+				}
+
+				delete(pending, name)
+				id, err := ingestInboxFile(collectionName, dir, name)
+				if err != nil {
+					log.Printf("inbox %s: %s: failed: %s\n", dir, name, err)
+				} else {
+					log.Printf("inbox %s: %s: stored as %s (%d)\n", dir, name, b62.Encode(id+10000), id)
+				}
+				if err = fileInboxResult(dir, name, err); err != nil {
+					log.Printf("inbox %s: %s: %s\n", dir, name, err)
+				}
+			}
+		}
+	}
+}
+
+// Reads the sidecar for a dropped file if there is one:
+func readInboxSidecar(local_path string) (*inboxSidecar, error) {
+	sidecar := &inboxSidecar{}
+	b, err := ioutil.ReadFile(local_path + ".json")
+	if os.IsNotExist(err) {
+		return sidecar, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(b, sidecar); err != nil {
+		return nil, fmt.Errorf("Bad sidecar %s.json: %s", path.Base(local_path), err)
+	}
+	return sidecar, nil
+}
+
+// Stores a dropped file through the usual ingestion pipeline, leaving the original in place:
+func ingestInboxFile(collectionName, dir, name string) (int64, error) {
+	local_path := path.Join(dir, name)
+	if !isImageFileName(name) {
+		return 0, fmt.Errorf("Not an image file")
+	}
+
+	sidecar, err := readInboxSidecar(local_path)
+	if err != nil {
+		return 0, err
+	}
+
+	// Work on a copy so the original can be filed away afterwards:
+	tmp_path, err := copyToTemp(local_path)
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp_path)
+
+	store := &imageStoreRequest{
+		CollectionName: collectionName,
+		Submitter:      "inbox",
+		SourceURL:      "file://" + name,
+		Title:          sidecar.Title,
+		Keywords:       strings.ToLower(sidecar.Keywords),
+		IsClean:        !sidecar.NSFW,
+		PostCreation: func(id int64, newImage *Image) *web.Error {
+			return moveFiles(tmp_path, id, newImage)
+		},
+	}
+	if store.Title == "" {
+		store.Title = filenameToTitle(name)
+	}
+
+	id, werr := storeImage(store)
+	if werr != nil {
+		return 0, werr.Error
+	}
+	return id, nil
+}
+
+// Picks a name in dir that does not clash with an earlier file of the same name:
+func uniqueInboxName(dir, name string) string {
+	if !fileExists(path.Join(dir, name)) {
+		return name
+	}
+	ext := path.Ext(name)
+	return strings.TrimSuffix(name, ext) + "-" + strconv.FormatInt(time.Now().UnixNano(), 10) + ext
+}
+
+// Moves a dropped file and its sidecar into processed/ or, with a note of the error, into failed/:
+func fileInboxResult(dir, name string, ingestErr error) error {
+	sub := path.Join(dir, "processed")
+	if ingestErr != nil {
+		sub = path.Join(dir, "failed")
+	}
+
+	dest := uniqueInboxName(sub, name)
+	if err := os.Rename(path.Join(dir, name), path.Join(sub, dest)); err != nil {
+		return err
+	}
+	if fileExists(path.Join(dir, name+".json")) {
+		if err := os.Rename(path.Join(dir, name+".json"), path.Join(sub, dest+".json")); err != nil {
+			return err
+		}
+	}
+
+	if ingestErr != nil {
+		return ioutil.WriteFile(path.Join(sub, dest+".error.txt"), []byte(ingestErr.Error()+"\n"), 0664)
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func Test_ingestInboxFile(t *testing.T) {
+	dir, done := withTempStore(t)
+	defer done()
+
+	api, err := NewAPI()
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.Close()
+
+	inbox := path.Join(dir, "inbox")
+	os.MkdirAll(path.Join(inbox, "processed"), 0755)
+	os.MkdirAll(path.Join(inbox, "failed"), 0755)
+
+	buf := &bytes.Buffer{}
+	png.Encode(buf, image.NewRGBA(image.Rect(0, 0, 8, 8)))
+	ioutil.WriteFile(path.Join(inbox, "tiny_square.png"), buf.Bytes(), 0644)
+	ioutil.WriteFile(path.Join(inbox, "tiny_square.png.json"), []byte(`{"keywords": "Tiny Test", "nsfw": true}`), 0644)
+	ioutil.WriteFile(path.Join(inbox, "notes.txt"), []byte("hello"), 0644)
+
+	// A good file is stored with its sidecar's details and filed under processed/:
+	id, err := ingestInboxFile("memes", inbox, "tiny_square.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = fileInboxResult(inbox, "tiny_square.png", err); err != nil {
+		t.Fatal(err)
+	}
+	img, werr := getImage(id)
+	if werr != nil {
+		t.Fatal(werr.Error)
+	}
+	if img.Title != "tiny square" || img.Keywords != "tiny test" || img.IsClean || img.CollectionName != "memes" {
+		t.Errorf("unexpected image %+v", img)
+	}
+	for _, name := range []string{"processed/tiny_square.png", "processed/tiny_square.png.json"} {
+		if !fileExists(path.Join(inbox, name)) {
+			t.Errorf("expected %s", name)
+		}
+	}
+
+	// Anything else lands in failed/ with a note of the error:
+	_, err = ingestInboxFile("memes", inbox, "notes.txt")
+	if err == nil {
+		t.Fatal("expected notes.txt to fail")
+	}
+	if err = fileInboxResult(inbox, "notes.txt", err); err != nil {
+		t.Fatal(err)
+	}
+	note, _ := ioutil.ReadFile(path.Join(inbox, "failed", "notes.txt.error.txt"))
+	if len(note) == 0 || !fileExists(path.Join(inbox, "failed", "notes.txt")) {
+		t.Errorf("expected notes.txt and its error note in failed/")
+	}
+}
+
+func Test_isInboxCandidate(t *testing.T) {
+	for name, expect := range map[string]bool{
+		"cat.gif":              true,
+		"cat.gif.json":         false,
+		".DS_Store":            false,
+		"cat.gif.part":         false,
+		"cat.gif.crdownload":   false,
+		"cat.gif~":             false,
+		"Lolcat FINAL (2).GIF": true,
+	} {
+		if isInboxCandidate(name) != expect {
+			t.Errorf("%s: expected %v", name, expect)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Licenses are stored as SPDX identifiers, e.g. "CC-BY-SA-4.0", "CC0-1.0" or "MIT".
+
+var ccLicenseKinds = []string{"BY", "BY-SA", "BY-ND", "BY-NC", "BY-NC-SA", "BY-NC-ND"}
+var ccLicenseVersions = []string{"1.0", "2.0", "2.5", "3.0", "4.0"}
+
+var otherLicenses = []string{
+	"CC0-1.0",
+	"CC-PDDC",
+	"MIT",
+	"Apache-2.0",
+	"BSD-2-Clause",
+	"BSD-3-Clause",
+	"GPL-2.0-only",
+	"GPL-2.0-or-later",
+	"GPL-3.0-only",
+	"GPL-3.0-or-later",
+	"LGPL-3.0-only",
+	"LGPL-3.0-or-later",
+	"MPL-2.0",
+	"OFL-1.1",
+	"Unlicense",
+	"WTFPL",
+}
+
+// Known identifiers keyed by their lowercase form:
+var knownLicenses = func() map[string]string {
+	m := make(map[string]string)
+	for _, kind := range ccLicenseKinds {
+		for _, version := range ccLicenseVersions {
+			id := "CC-" + kind + "-" + version
+			m[strings.ToLower(id)] = id
+		}
+	}
+	for _, id := range otherLicenses {
+		m[strings.ToLower(id)] = id
+	}
+	return m
+}()
+
+// Canonicalizes a license identifier, accepting forms like "cc by-sa 4.0"; "" means no license given.
+// Identifiers outside the known set must use SPDX's "LicenseRef-" prefix.
+func normalizeLicense(s string) (string, error) {
+	s = strings.Join(strings.Fields(s), "-")
+	if s == "" {
+		return "", nil
+	}
+	if id, ok := knownLicenses[strings.ToLower(s)]; ok {
+		return id, nil
+	}
+	if strings.HasPrefix(strings.ToLower(s), "licenseref-") && len(s) > len("LicenseRef-") {
+		for _, c := range s {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '.') {
+				return "", fmt.Errorf("Invalid license identifier '%s'", s)
+			}
+		}
+		return "LicenseRef-" + s[len("LicenseRef-"):], nil
+	}
+	return "", fmt.Errorf("Unknown license '%s'; use an SPDX identifier such as CC-BY-4.0", s)
+}
+
+// Link to a license's deed or text:
+func licenseURL(id string) string {
+	switch {
+	case id == "" || strings.HasPrefix(id, "LicenseRef-"):
+		return ""
+	case id == "CC0-1.0":
+		return "https://creativecommons.org/publicdomain/zero/1.0/"
+	case strings.HasPrefix(id, "CC-BY"):
+		i := strings.LastIndex(id, "-")
+		return "https://creativecommons.org/licenses/" + strings.ToLower(id[len("CC-"):i]) + "/" + id[i+1:] + "/"
+	default:
+		return "https://spdx.org/licenses/" + id + ".html"
+	}
+}
+
+// Builds an SQL condition for images whose license matches one of the given identifiers or families,
+// e.g. `?license=CC-BY&license=CC0-1.0`, numbering its parameters from `firstArg`. "CC-BY" matches any
+// version of CC-BY but not CC-BY-SA. An empty condition matches everything.
+func licenseCondition(licenses []string, firstArg int) (cond string, args []interface{}) {
+	conds := make([]string, 0, len(licenses))
+	for _, l := range licenses {
+		for _, id := range strings.Split(l, ",") {
+			if id = strings.TrimSpace(id); id == "" {
+				continue
+			}
+
+			n := "?" + strconv.Itoa(firstArg+len(args))
+			args = append(args, strings.ToLower(id))
+			// The identifier itself, or the identifier followed by "-" and a version made of digits and dots:
+			conds = append(conds, `(lower(License) = `+n+` or (lower(substr(License, 1, length(`+n+`) + 1)) = `+n+` || '-'`+
+				` and substr(License, length(`+n+`) + 2) <> '' and substr(License, length(`+n+`) + 2) not glob '*[^0-9.]*'))`)
+		}
+	}
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return "(" + strings.Join(conds, " or ") + ")", args
+}
+
+// Validates and canonicalizes an image's attribution fields:
+func normalizeAttribution(img *Image) error {
+	img.Author = strings.TrimSpace(img.Author)
+	img.AuthorURL = strings.TrimSpace(img.AuthorURL)
+	if img.AuthorURL != "" {
+		u, err := url.Parse(img.AuthorURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("Author URL must be an absolute http or https URL")
+		}
+	}
+
+	var err error
+	img.License, err = normalizeLicense(img.License)
+	return err
+}
@@ -0,0 +1,97 @@
+package main
+
+import "testing"
+
+func Test_normalizeLicense(t *testing.T) {
+	tests := []struct {
+		in  string
+		out string
+		ok  bool
+	}{
+		{"", "", true},
+		{"cc-by-4.0", "CC-BY-4.0", true},
+		{" CC BY-SA 4.0 ", "CC-BY-SA-4.0", true},
+		{"cc0-1.0", "CC0-1.0", true},
+		{"mit", "MIT", true},
+		{"licenseref-Getty.Editorial", "LicenseRef-Getty.Editorial", true},
+		{"LicenseRef-", "", false},
+		{"LicenseRef-a/b", "", false},
+		{"All rights reserved", "", false},
+	}
+	for _, test := range tests {
+		out, err := normalizeLicense(test.in)
+		if out != test.out || (err == nil) != test.ok {
+			t.Errorf("%q: expected %q (ok=%v), got %q (%v)", test.in, test.out, test.ok, out, err)
+		}
+	}
+}
+
+func Test_licenseURL(t *testing.T) {
+	tests := map[string]string{
+		"CC-BY-NC-SA-4.0": "https://creativecommons.org/licenses/by-nc-sa/4.0/",
+		"CC0-1.0":         "https://creativecommons.org/publicdomain/zero/1.0/",
+		"MIT":             "https://spdx.org/licenses/MIT.html",
+		"LicenseRef-x":    "",
+	}
+	for id, expected := range tests {
+		if u := licenseURL(id); u != expected {
+			t.Errorf("%s: expected %q, got %q", id, expected, u)
+		}
+	}
+}
+
+func Test_searchByLicense(t *testing.T) {
+	_, done := withTempStore(t)
+	defer done()
+
+	api, err := NewAPI()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer api.Close()
+
+	for _, license := range []string{"CC-BY-4.0", "CC-BY-SA-4.0", "CC-BY-2.0", "", "CC0-1.0", "CC-BY-NC-4.0"} {
+		if _, err = api.NewImage(&Image{Kind: "png", Title: "cat", Keywords: "cat", CollectionName: "cats", License: license}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ids := func(licenses ...string) (ids []int64) {
+		list, err := api.Search([]string{"cat"}, "cats", false, licenses, ImagesOrderByIDASC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, img := range list {
+			ids = append(ids, img.ID)
+		}
+		return
+	}
+
+	if got := ids("cc-by"); len(got) != 2 || got[0] != 1 || got[1] != 3 {
+		t.Errorf("CC-BY family: got %v", got)
+	}
+	if got := ids("CC-BY-SA-4.0,CC0-1.0"); len(got) != 2 || got[0] != 2 || got[1] != 5 {
+		t.Errorf("exact identifiers: got %v", got)
+	}
+	if got := ids("CC-BY-NC", "CC0"); len(got) != 2 || got[0] != 5 || got[1] != 6 {
+		t.Errorf("several families: got %v", got)
+	}
+	if got := ids(); len(got) != 6 {
+		t.Errorf("no filter should keep all images, got %v", got)
+	}
+}
+
+func Test_normalizeAttribution(t *testing.T) {
+	img := &Image{Author: " Jane ", AuthorURL: "https://example.com/jane", License: "cc by 4.0"}
+	if err := normalizeAttribution(img); err != nil {
+		t.Fatal(err)
+	}
+	if img.Author != "Jane" || img.License != "CC-BY-4.0" {
+		t.Errorf("unexpected attribution %+v", img)
+	}
+
+	img.AuthorURL = "javascript:alert(1)"
+	if err := normalizeAttribution(img); err == nil {
+		t.Errorf("expected a non-http author URL to be rejected")
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+	"net/http"
+	"sync"
+)
+
+import "github.com/JamesDunne/go-util/web"
+
+// Limits checked before decoding an image so that small files declaring huge dimensions or
+// thousands of frames cannot exhaust memory:
+var (
+	decodeMaxPixels = int64(50000000)
+	decodeMaxFrames = 2000
+	decodeMaxBytes  = int64(1 << 30)
+)
+
+// Approximate bytes of decoded image data held across all requests at once. Decodes wait for room
+// in the budget; one that needs more than all of it waits to run alone.
+var decodeMemoryBudget = int64(1 << 30)
+
+// An image that may not be decoded, with the HTTP status to report it with:
+type imageLimitError struct {
+	msg        string
+	statusCode int
+}
+
+func (e *imageLimitError) Error() string { return e.msg }
+
+func tooLarge(format string, args ...interface{}) error {
+	return &imageLimitError{msg: fmt.Sprintf(format, args...), statusCode: http.StatusRequestEntityTooLarge}
+}
+
+// Reports decoding errors with 413 or 422 for rejected images and 500 otherwise:
+func asDecodeError(err error) *web.Error {
+	if lerr, ok := err.(*imageLimitError); ok {
+		return web.AsError(lerr, lerr.statusCode)
+	}
+	return web.AsError(err, http.StatusInternalServerError)
+}
+
+// Checks an image against the limits and estimates the bytes needed to decode it a frame at a time
+// and all at once, rewinding it for decoding:
+func decodeCost(r io.ReadSeeker) (frame int64, all int64, err error) {
+	config, kind, err := image.DecodeConfig(r)
+	if err != nil {
+		return 0, 0, &imageLimitError{msg: "Unrecognized or corrupt image: " + err.Error(), statusCode: http.StatusUnprocessableEntity}
+	}
+	if _, err = r.Seek(0, 0); err != nil {
+		return 0, 0, err
+	}
+
+	pixels := int64(config.Width) * int64(config.Height)
+	if pixels > decodeMaxPixels {
+		return 0, 0, tooLarge("Image is %dx%d; at most %d pixels are allowed", config.Width, config.Height, decodeMaxPixels)
+	}
+
+	if kind != "gif" {
+		// Decoded images take at most 4 bytes per pixel:
+		if pixels*4 > decodeMaxBytes {
+			return 0, 0, tooLarge("Image would take more than %d bytes to decode", decodeMaxBytes)
+		}
+		return pixels * 4, pixels * 4, nil
+	}
+
+	_, frameBytes, err := checkGIFFrames(bufio.NewReader(r))
+	if _, serr := r.Seek(0, 0); err == nil {
+		err = serr
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// Compositing takes a canvas, another to restore disposed frames from and a copy of the result;
+	// a frame at a time takes at most a byte per pixel:
+	canvases := pixels * 4 * 3
+	return canvases + pixels, canvases + frameBytes, nil
+}
+
+// Holds room in the decode budget:
+type decodeSemaphore struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	held int64
+}
+
+var decodeGate = newDecodeSemaphore()
+
+func newDecodeSemaphore() *decodeSemaphore {
+	s := &decodeSemaphore{}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// Waits until n bytes fit within the budget and holds them until release is called:
+func (s *decodeSemaphore) acquire(n int64) (release func()) {
+	s.mu.Lock()
+	if n > decodeMemoryBudget {
+		n = decodeMemoryBudget
+	}
+	for s.held > 0 && s.held+n > decodeMemoryBudget {
+		s.cond.Wait()
+	}
+	s.held += n
+	s.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.mu.Lock()
+			s.held -= n
+			s.cond.Broadcast()
+			s.mu.Unlock()
+		})
+	}
+}
+
+// Checks an image against the limits and waits for room in the decode budget, rewinding it for decoding.
+// allFrames makes room for every frame of a GIF rather than one at a time. release must be called once
+// the decoded image is no longer needed.
+func acquireDecode(r io.ReadSeeker, allFrames bool) (release func(), err error) {
+	frame, all, err := decodeCost(r)
+	if err != nil {
+		return nil, err
+	}
+	if allFrames {
+		return decodeGate.acquire(all), nil
+	}
+	return decodeGate.acquire(frame), nil
+}
+
+// Counts the frames of a GIF without decoding them and rewinds it:
+func countGIFFrames(r io.ReadSeeker) (int, error) {
+	frames, _, err := checkGIFFrames(bufio.NewReader(r))
+	if _, serr := r.Seek(0, 0); err == nil {
+		err = serr
+	}
+	return frames, err
+}
+
+// Walks the blocks of a GIF without decompressing them, counting frames and the bytes
+// needed to decode them all:
+func checkGIFFrames(br *bufio.Reader) (int, int64, error) {
+	var header [13]byte
+	if _, err := io.ReadFull(br, header[:]); err != nil {
+		return 0, 0, err
+	}
+	if fields := header[10]; fields&0x80 != 0 {
+		if _, err := br.Discard(3 << ((fields & 7) + 1)); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	frames := 0
+	bytes := int64(0)
+	for {
+		b, err := br.ReadByte()
+		if err == io.EOF && frames > 0 {
+			// Leave a missing trailer for the decoder to judge:
+			return frames, bytes, nil
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+
+		switch b {
+		case 0x21:
+			// Extension: label then data sub-blocks:
+			if _, err = br.ReadByte(); err != nil {
+				return 0, 0, err
+			}
+			if err = skipGIFSubBlocks(br); err != nil {
+				return 0, 0, err
+			}
+		case 0x2C:
+			// Image descriptor: each frame decodes to one byte per pixel:
+			var desc [9]byte
+			if _, err = io.ReadFull(br, desc[:]); err != nil {
+				return 0, 0, err
+			}
+			w := int64(binary.LittleEndian.Uint16(desc[4:6]))
+			h := int64(binary.LittleEndian.Uint16(desc[6:8]))
+
+			frames++
+			if frames > decodeMaxFrames {
+				return 0, 0, tooLarge("GIF has more than %d frames", decodeMaxFrames)
+			}
+			bytes += w * h
+			if bytes > decodeMaxBytes {
+				return 0, 0, tooLarge("GIF would take more than %d bytes to decode", decodeMaxBytes)
+			}
+
+			if fields := desc[8]; fields&0x80 != 0 {
+				if _, err = br.Discard(3 << ((fields & 7) + 1)); err != nil {
+					return 0, 0, err
+				}
+			}
+			// LZW minimum code size then the compressed sub-blocks:
+			if _, err = br.ReadByte(); err != nil {
+				return 0, 0, err
+			}
+			if err = skipGIFSubBlocks(br); err != nil {
+				return 0, 0, err
+			}
+		case 0x3B:
+			// Trailer:
+			return frames, bytes, nil
+		default:
+			return 0, 0, &imageLimitError{msg: fmt.Sprintf("Corrupt GIF: unknown block type 0x%02x", b), statusCode: http.StatusUnprocessableEntity}
+		}
+	}
+}
+
+func skipGIFSubBlocks(br *bufio.Reader) error {
+	for {
+		n, err := br.ReadByte()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return nil
+		}
+		if _, err = br.Discard(int(n)); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"testing"
+	"time"
+)
+
+func Test_acquireDecode_limits(t *testing.T) {
+	defer func(pixels int64, frames int, b int64) {
+		decodeMaxPixels, decodeMaxFrames, decodeMaxBytes = pixels, frames, b
+	}(decodeMaxPixels, decodeMaxFrames, decodeMaxBytes)
+
+	pngBuf := &bytes.Buffer{}
+	png.Encode(pngBuf, image.NewRGBA(image.Rect(0, 0, 20, 10)))
+
+	g := &gif.GIF{}
+	for i := 0; i < 3; i++ {
+		g.Image = append(g.Image, image.NewPaletted(image.Rect(0, 0, 10, 10), color.Palette{color.Black, color.White}))
+		g.Delay = append(g.Delay, 10)
+	}
+	gifBuf := &bytes.Buffer{}
+	gif.EncodeAll(gifBuf, g)
+
+	tests := []struct {
+		name       string
+		data       []byte
+		maxPixels  int64
+		maxFrames  int
+		maxBytes   int64
+		statusCode int
+	}{
+		{"png within limits", pngBuf.Bytes(), 200, 10, 800, 0},
+		{"png too many pixels", pngBuf.Bytes(), 199, 10, 1 << 20, http.StatusRequestEntityTooLarge},
+		{"png too many bytes", pngBuf.Bytes(), 200, 10, 799, http.StatusRequestEntityTooLarge},
+		{"gif within limits", gifBuf.Bytes(), 100, 3, 300, 0},
+		{"gif too many frames", gifBuf.Bytes(), 100, 2, 1 << 20, http.StatusRequestEntityTooLarge},
+		{"gif too many bytes", gifBuf.Bytes(), 100, 10, 299, http.StatusRequestEntityTooLarge},
+		{"garbage", []byte("not an image at all"), 100, 10, 1 << 20, http.StatusUnprocessableEntity},
+	}
+	for _, test := range tests {
+		decodeMaxPixels, decodeMaxFrames, decodeMaxBytes = test.maxPixels, test.maxFrames, test.maxBytes
+
+		r := bytes.NewReader(test.data)
+		release, err := acquireDecode(r, true)
+		if release != nil {
+			release()
+		}
+		werr := asDecodeError(err)
+		if test.statusCode == 0 {
+			if werr != nil {
+				t.Errorf("%s: unexpected error %s", test.name, werr.Error)
+			} else if pos, _ := r.Seek(0, 1); pos != 0 {
+				t.Errorf("%s: reader was not rewound", test.name)
+			}
+			continue
+		}
+		if werr == nil || werr.StatusCode != test.statusCode {
+			t.Errorf("%s: expected status %d, got %v", test.name, test.statusCode, werr)
+		}
+	}
+}
+
+func Test_checkGIFFrames(t *testing.T) {
+	buf := &bytes.Buffer{}
+	if err := gif.EncodeAll(buf, testAnimation()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Frames are counted and sized without decoding them:
+	frames, n, err := checkGIFFrames(bufio.NewReader(bytes.NewReader(buf.Bytes())))
+	if err != nil || frames != 5 {
+		t.Fatalf("expected 5 frames, got %d (%v)", frames, err)
+	}
+	g, _ := gif.DecodeAll(bytes.NewReader(buf.Bytes()))
+	expected := int64(0)
+	for _, frame := range g.Image {
+		expected += int64(frame.Rect.Dx() * frame.Rect.Dy())
+	}
+	if n != expected {
+		t.Errorf("expected %d bytes to decode the frames, got %d", expected, n)
+	}
+
+	if _, _, err = checkGIFFrames(bufio.NewReader(bytes.NewReader(buf.Bytes()[:buf.Len()/2]))); err == nil {
+		t.Errorf("expected a truncated GIF to fail")
+	}
+}
+
+func Test_decodeSemaphore(t *testing.T) {
+	defer func(old int64) { decodeMemoryBudget = old }(decodeMemoryBudget)
+	decodeMemoryBudget = 100
+	s := newDecodeSemaphore()
+
+	first := s.acquire(60)
+	// More than the whole budget is held as all of it:
+	acquired := make(chan func())
+	go func() { acquired <- s.acquire(500) }()
+
+	select {
+	case <-acquired:
+		t.Fatal("expected a decode to wait for room in the budget")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	first()
+	first()
+	select {
+	case second := <-acquired:
+		if s.held != 100 {
+			t.Errorf("expected the budget to be held, got %d", s.held)
+		}
+		second()
+	case <-time.After(time.Second):
+		t.Fatal("expected a decode to proceed once room was released")
+	}
+	if s.held != 0 {
+		t.Errorf("expected nothing held, got %d", s.held)
+	}
+}
+
+func Test_decodeFirstImage_holdsBudget(t *testing.T) {
+	dir, done := withTempStore(t)
+	defer done()
+
+	local_path := path.Join(dir, "a.png")
+	buf := &bytes.Buffer{}
+	png.Encode(buf, image.NewRGBA(image.Rect(0, 0, 20, 10)))
+	ioutil.WriteFile(local_path, buf.Bytes(), 0644)
+
+	// Room for the decoded image is held until the caller releases it:
+	held := decodeGate.held
+	_, _, release, err := decodeFirstImage(local_path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decodeGate.held != held+20*10*4 {
+		t.Errorf("expected the decoded image to be held in the budget, got %d", decodeGate.held-held)
+	}
+	release()
+	if decodeGate.held != held {
+		t.Errorf("expected the budget to be released, got %d", decodeGate.held-held)
+	}
+
+	// So is room for a rasterized SVG:
+	svg_path := path.Join(dir, "a.svg")
+	ioutil.WriteFile(svg_path, []byte(`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 30 15"><rect width="30" height="15" fill="#0f0"/></svg>`), 0644)
+	_, _, release, err = decodeFirstImage(svg_path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decodeGate.held != held+30*15*4 {
+		t.Errorf("expected the rasterized SVG to be held in the budget, got %d", decodeGate.held-held)
+	}
+	release()
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Images made from other images record their ParentID and a DerivationOp describing what was done,
+// e.g. "crop(10,0,110,50)" or "rotate(90) grayscale".
+
+// Lineage chains are followed at most this deep:
+const lineageMaxDepth = 64
+
+// An image in a lineage tree:
+type lineageNode struct {
+	ID           int64          `json:"id"`
+	Base62ID     string         `json:"base62id"`
+	Title        string         `json:"title"`
+	DerivationOp string         `json:"derivationOp,omitempty"`
+	Variants     []*lineageNode `json:"variants,omitempty"`
+}
+
+func newLineageNode(img *Image) *lineageNode {
+	return &lineageNode{
+		ID:           img.ID,
+		Base62ID:     b62.Encode(img.ID + 10000),
+		Title:        img.Title,
+		DerivationOp: img.DerivationOp,
+	}
+}
+
+// Describes transform operations for DerivationOp:
+func describeOps(ops []transformOp) string {
+	parts := make([]string, 0, len(ops))
+	for _, op := range ops {
+		switch op.Op {
+		case "crop":
+			parts = append(parts, fmt.Sprintf("crop(%d,%d,%d,%d)", op.Left, op.Top, op.Right, op.Bottom))
+		case "rotate":
+			parts = append(parts, fmt.Sprintf("rotate(%d)", op.Degrees))
+		case "flip":
+			parts = append(parts, "flip("+op.Axis+")")
+		case "resize":
+			parts = append(parts, fmt.Sprintf("resize(%d,%d)", op.Width, op.Height))
+		case "speed":
+			parts = append(parts, fmt.Sprintf("speed(%g)", op.Factor))
+		case "fps":
+			parts = append(parts, fmt.Sprintf("fps(%g)", op.FPS))
+		case "trim":
+			if op.Start != nil || op.End != nil {
+				start, end := "0s", "end"
+				if op.Start != nil {
+					start = fmt.Sprintf("%gs", *op.Start)
+				}
+				if op.End != nil {
+					end = fmt.Sprintf("%gs", *op.End)
+				}
+				parts = append(parts, "trim("+start+","+end+")")
+			} else if op.To != nil {
+				parts = append(parts, fmt.Sprintf("trim(%d,%d)", op.From, *op.To))
+			} else {
+				parts = append(parts, fmt.Sprintf("trim(%d,end)", op.From))
+			}
+		case "loop":
+			parts = append(parts, fmt.Sprintf("loop(%d)", *op.Count))
+		default:
+			parts = append(parts, op.Op)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// Lists the images an image was derived from, the original first:
+func getAncestors(api *API, img *Image) (ancestors []*lineageNode, err error) {
+	seen := map[int64]bool{img.ID: true}
+	for parentID := img.ParentID; parentID != nil && !seen[*parentID] && len(ancestors) < lineageMaxDepth; {
+		seen[*parentID] = true
+		parent, err := api.GetImage(*parentID)
+		if err != nil {
+			return nil, err
+		}
+		if parent == nil {
+			// The parent was deleted:
+			break
+		}
+		ancestors = append([]*lineageNode{newLineageNode(parent)}, ancestors...)
+		parentID = parent.ParentID
+	}
+	return ancestors, nil
+}
+
+// Builds the tree of images derived from an image:
+func getVariants(api *API, img *Image) ([]*lineageNode, error) {
+	seen := map[int64]bool{img.ID: true}
+
+	var walk func(id int64, depth int) ([]*lineageNode, error)
+	walk = func(id int64, depth int) ([]*lineageNode, error) {
+		if depth >= lineageMaxDepth {
+			return nil, nil
+		}
+		children, err := api.GetDerivedImages(id)
+		if err != nil {
+			return nil, err
+		}
+
+		nodes := make([]*lineageNode, 0, len(children))
+		for i := range children {
+			child := &children[i]
+			if seen[child.ID] {
+				continue
+			}
+			seen[child.ID] = true
+
+			node := newLineageNode(child)
+			if node.Variants, err = walk(child.ID, depth+1); err != nil {
+				return nil, err
+			}
+			nodes = append(nodes, node)
+		}
+		return nodes, nil
+	}
+
+	return walk(img.ID, 0)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_lineage(t *testing.T) {
+	_, done := withTempStore(t)
+	defer done()
+
+	api, err := NewAPI()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer api.Close()
+
+	add := func(title string, parentID *int64, op string) int64 {
+		id, err := api.NewImage(&Image{Kind: "png", Title: title, ParentID: parentID, DerivationOp: op})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	root := add("root", nil, "")
+	crop := add("crop", &root, describeOps([]transformOp{{Op: "crop", Left: 1, Top: 2, Right: 3, Bottom: 4}}))
+	turned := add("turned", &crop, describeOps([]transformOp{{Op: "rotate", Degrees: 90}, {Op: "grayscale"}}))
+	add("flipped", &root, "flip(horizontal)")
+
+	img, _ := api.GetImage(turned)
+	if img.DerivationOp != "rotate(90) grayscale" || img.ParentID == nil || *img.ParentID != crop {
+		t.Fatalf("lineage was not stored: %+v", img)
+	}
+	ancestors, err := getAncestors(api, img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ancestors) != 2 || ancestors[0].ID != root || ancestors[1].ID != crop || ancestors[1].DerivationOp != "crop(1,2,3,4)" {
+		t.Errorf("unexpected ancestors %+v", ancestors)
+	}
+
+	img, _ = api.GetImage(root)
+	variants, err := getVariants(api, img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(variants) != 2 || variants[0].ID != crop || len(variants[0].Variants) != 1 || variants[0].Variants[0].ID != turned || variants[1].Title != "flipped" {
+		t.Errorf("unexpected variant tree %+v", variants)
+	}
+}
+
+func Test_apiUpdate_editableFields(t *testing.T) {
+	_, done := withTempStore(t)
+	defer done()
+
+	api, err := NewAPI()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parentID := int64(1)
+	source := "http://example.com/cat.png"
+	id, err := api.NewImage(&Image{Kind: "png", Title: "cat", Keywords: "cat", SourceURL: &source, ParentID: &parentID, DerivationOp: "crop", ContentHash: "abc"})
+	api.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Lineage, hashes and link state are not editable:
+	body := `{"Title": "Sleepy cat", "author": "Jo", "ParentID": 7, "DerivationOp": "rotate", "ContentHash": "forged", "LinkStatus": "dead"}`
+	req, _ := http.NewRequest("POST", "/api/v1/update/"+b62.Encode(id+10000), strings.NewReader(body))
+	rsp := httptest.NewRecorder()
+	if werr := requestHandler(rsp, req); werr != nil {
+		t.Fatal(werr.Error)
+	}
+
+	img, _ := getImage(id)
+	if img.Title != "Sleepy cat" || img.Author != "Jo" || img.Keywords != "cat" || img.SourceURL == nil || *img.SourceURL != source {
+		t.Errorf("editable fields were not updated as requested: %+v", img)
+	}
+	if img.ParentID == nil || *img.ParentID != 1 || img.DerivationOp != "crop" || img.ContentHash != "abc" || img.LinkStatus != "" {
+		t.Errorf("protected fields were changed: %+v", img)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+import "github.com/JamesDunne/go-util/web"
+
+// Link statuses recorded against images whose content depends on a remote source:
+const (
+	linkAlive   = "alive"
+	linkDead    = "dead"
+	linkUnknown = "unknown"
+)
+
+var (
+	// Re-check links last checked longer ago than this; 0 disables the background checker:
+	linkCheckMaxAge = time.Duration(0)
+	// Delay between probes so as not to hammer remote hosts:
+	linkCheckDelay = 2 * time.Second
+)
+
+var linkCheckClient = &http.Client{Timeout: 30 * time.Second}
+
+// Determines the remote URL an image depends on, or "" if it has none:
+func linkCheckURL(img *Image) string {
+	if img.SourceURL == nil || *img.SourceURL == "" {
+		return ""
+	}
+
+	switch img.Kind {
+	case "youtube":
+		// oEmbed answers 404 for removed videos and 401 for videos that may no longer be embedded:
+		return "https://www.youtube.com/oembed?format=json&url=" + url.QueryEscape("https://www.youtube.com/watch?v="+*img.SourceURL)
+	case "imgur-gifv":
+		return "http://i.imgur.com/" + imgurHash(*img.SourceURL) + ".mp4"
+	}
+
+	// Uploaded files have no remote source:
+	if !strings.HasPrefix(*img.SourceURL, "http://") && !strings.HasPrefix(*img.SourceURL, "https://") {
+		return ""
+	}
+	return *img.SourceURL
+}
+
+// Classifies a probe response:
+func linkStatusOf(kind string, rsp *http.Response) string {
+	// imgur redirects removed media to a placeholder image:
+	if strings.Contains(rsp.Request.URL.Path, "/removed.") {
+		return linkDead
+	}
+
+	switch {
+	case rsp.StatusCode >= 200 && rsp.StatusCode < 300:
+		return linkAlive
+	case rsp.StatusCode == http.StatusNotFound, rsp.StatusCode == http.StatusGone:
+		return linkDead
+	case kind == "youtube" && rsp.StatusCode == http.StatusUnauthorized:
+		return linkDead
+	}
+	return linkUnknown
+}
+
+// Probes a URL with HEAD, falling back to a GET of its first byte for hosts that do not support HEAD:
+func probeLink(kind, link string) string {
+	rsp, err := linkCheckClient.Head(link)
+	if err == nil {
+		rsp.Body.Close()
+		switch rsp.StatusCode {
+		case http.StatusBadRequest, http.StatusForbidden, http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		default:
+			return linkStatusOf(kind, rsp)
+		}
+	}
+
+	req, err := http.NewRequest("GET", link, nil)
+	if err != nil {
+		return linkUnknown
+	}
+	req.Header.Set("Range", "bytes=0-0")
+	rsp, err = linkCheckClient.Do(req)
+	if err != nil {
+		log.Printf("linkcheck: %s: %s\n", link, err)
+		return linkUnknown
+	}
+	rsp.Body.Close()
+	return linkStatusOf(kind, rsp)
+}
+
+// Probes an image's remote source and records the outcome:
+func checkImageLink(img *Image) (string, *web.Error) {
+	link := linkCheckURL(img)
+	if link == "" {
+		return "", web.AsError(fmt.Errorf("Image has no remote source"), http.StatusBadRequest)
+	}
+
+	status := probeLink(img.Kind, link)
+	checkedAt := time.Now().Unix()
+	if werr := useAPI(func(api *API) *web.Error {
+		return web.AsError(api.UpdateLinkStatus(img.ID, status, checkedAt), http.StatusInternalServerError)
+	}); werr != nil {
+		return "", werr
+	}
+
+	img.LinkStatus = status
+	img.LinkCheckedAt = &checkedAt
+	return status, nil
+}
+
+// Lists images with a remote source not checked within maxAge, least recently checked first:
+func staleLinks(list []Image, maxAge time.Duration, now time.Time) []*Image {
+	stale := make([]*Image, 0, len(list))
+	for i := range list {
+		img := &list[i]
+		if linkCheckURL(img) == "" {
+			continue
+		}
+		if img.LinkCheckedAt != nil && now.Sub(time.Unix(*img.LinkCheckedAt, 0)) < maxAge {
+			continue
+		}
+		stale = append(stale, img)
+	}
+
+	sort.SliceStable(stale, func(i, j int) bool {
+		if stale[i].LinkCheckedAt == nil || stale[j].LinkCheckedAt == nil {
+			return stale[i].LinkCheckedAt == nil && stale[j].LinkCheckedAt != nil
+		}
+		return *stale[i].LinkCheckedAt < *stale[j].LinkCheckedAt
+	})
+	return stale
+}
+
+// Periodically probes the remote sources of all images:
+func checkLinks() {
+	for {
+		list, werr := getList("all", true, ImagesOrderByIDASC)
+		if werr != nil {
+			log.Println(werr.Error)
+		}
+
+		for _, img := range staleLinks(list, linkCheckMaxAge, time.Now()) {
+			status, werr := checkImageLink(img)
+			if werr != nil {
+				log.Println(werr.Error)
+			} else if status == linkDead {
+				log.Printf("linkcheck: %s (%d) is dead\n", b62.Encode(img.ID+10000), img.ID)
+			}
+			time.Sleep(linkCheckDelay)
+		}
+
+		time.Sleep(time.Hour)
+	}
+}
+
+// Re-downloads each image whose source is still alive, reporting each outcome:
+func redownloadImages(ids []int64) []uploadResult {
+	results := make([]uploadResult, 0, len(ids))
+	for _, id := range ids {
+		result := uploadResult{FileName: b62.Encode(id + 10000)}
+
+		var img *Image
+		if werr := useAPI(func(api *API) *web.Error {
+			var err error
+			img, err = api.GetImage(id)
+			return web.AsError(err, http.StatusInternalServerError)
+		}); werr != nil {
+			result.Error = werr.Error.Error()
+			results = append(results, result)
+			continue
+		}
+		if img == nil {
+			result.Error = "Could not find image by ID"
+			results = append(results, result)
+			continue
+		}
+		result.Title = img.Title
+
+		// Check the source first so dead sources are never downloaded:
+		status, werr := checkImageLink(img)
+		if werr != nil {
+			result.Skipped = werr.Error.Error()
+		} else if status != linkAlive {
+			result.Skipped = "source is " + status
+		} else if img.Kind == "youtube" {
+			result.Skipped = "nothing to download"
+		} else if werr = redownloadImage(img); werr != nil {
+			result.Error = werr.Error.Error()
+		} else {
+			result.ID = img.ID
+			result.Base62ID = b62.Encode(img.ID + 10000)
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// Keeps only images whose last link check found them dead:
+func filterDeadLinks(list []Image) []Image {
+	dead := make([]Image, 0, len(list))
+	for _, img := range list {
+		if img.LinkStatus == linkDead {
+			dead = append(dead, img)
+		}
+	}
+	return dead
+}
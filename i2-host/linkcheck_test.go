@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func Test_probeLink(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(rsp http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/alive.gif":
+			rsp.WriteHeader(http.StatusOK)
+		case "/nohead.gif":
+			// Hosts that reject HEAD must still be probed with a ranged GET:
+			if req.Method == "HEAD" {
+				rsp.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			if req.Header.Get("Range") != "bytes=0-0" {
+				t.Errorf("expected ranged GET, got Range %q", req.Header.Get("Range"))
+			}
+			rsp.WriteHeader(http.StatusPartialContent)
+		case "/gone.mp4":
+			http.Redirect(rsp, req, "/removed.png", http.StatusFound)
+		case "/removed.png":
+			rsp.WriteHeader(http.StatusOK)
+		case "/error.gif":
+			rsp.WriteHeader(http.StatusInternalServerError)
+		default:
+			http.NotFound(rsp, req)
+		}
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		path   string
+		expect string
+	}{
+		{"/alive.gif", linkAlive},
+		{"/nohead.gif", linkAlive},
+		{"/gone.mp4", linkDead},
+		{"/missing.gif", linkDead},
+		{"/error.gif", linkUnknown},
+	}
+	for _, test := range tests {
+		if status := probeLink("gif", srv.URL+test.path); status != test.expect {
+			t.Errorf("%s: expected %q, got %q", test.path, test.expect, status)
+		}
+	}
+}
+
+func Test_staleLinks(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	recent := now.Add(-time.Hour).Unix()
+	old := now.Add(-48 * time.Hour).Unix()
+	older := now.Add(-72 * time.Hour).Unix()
+	src := "http://example.com/a.gif"
+	local := "file://a.gif"
+
+	list := []Image{
+		{ID: 1, Kind: "gif", SourceURL: &src, LinkCheckedAt: &old},
+		{ID: 2, Kind: "gif", SourceURL: &src, LinkCheckedAt: &recent},
+		{ID: 3, Kind: "gif", SourceURL: &local},
+		{ID: 4, Kind: "gif", SourceURL: &src},
+		{ID: 5, Kind: "gif", SourceURL: &src, LinkCheckedAt: &older},
+	}
+
+	stale := staleLinks(list, 24*time.Hour, now)
+	ids := make([]int64, len(stale))
+	for i, img := range stale {
+		ids[i] = img.ID
+	}
+	if len(ids) != 3 || ids[0] != 4 || ids[1] != 5 || ids[2] != 1 {
+		t.Fatalf("expected never-checked then oldest first [4 5 1], got %v", ids)
+	}
+}
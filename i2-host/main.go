@@ -20,6 +20,7 @@ var (
 	base_folder = "."
 	xrGif       = "/p-g/"
 	xrThumb     = "/p-t/"
+	xrSized     = "/p-s/"
 )
 
 const thumbnail_dimensions = 200
@@ -29,6 +30,8 @@ func db_path() string      { return base_folder + "/sqlite.db" }
 func store_folder() string { return base_folder + "/store" }
 func thumb_folder() string { return base_folder + "/thumb" }
 func tmp_folder() string   { return base_folder + "/tmp" }
+func sized_folder() string { return base_folder + "/sized" }
+func config_path() string  { return base_folder + "/config.json" }
 
 var uiTmpl *template.Template
 var b62 *base62.Encoder = base62.NewEncoderOrPanic(base62.ShuffledAlphabet)
@@ -38,6 +41,24 @@ func main() {
 	fs := flag.String("fs", ".", "Root directory of served files and templates")
 	xrGifArg := flag.String("xrg", "", "X-Accel-Redirect header prefix for serving images or blank to disable")
 	xrThumbArg := flag.String("xrt", "", "X-Accel-Redirect header prefix for serving thumbnails or blank to disable")
+	xrSizedArg := flag.String("xrs", "", "X-Accel-Redirect header prefix for serving resized images or blank to disable")
+	flag.IntVar(&archiveMaxEntries, "archive-entries", archiveMaxEntries, "Maximum number of entries in an uploaded archive")
+	flag.Int64Var(&archiveMaxBytes, "archive-bytes", archiveMaxBytes, "Maximum total extracted size in bytes of an uploaded archive")
+	flag.Int64Var(&rawUploadMaxSize, "upload-max-size", rawUploadMaxSize, "Maximum size in bytes of a raw body or data URI upload")
+	flag.Int64Var(&tusMaxSize, "tus-max-size", tusMaxSize, "Maximum size in bytes of a resumable (tus) upload")
+	flag.DurationVar(&tusExpiry, "tus-expiry", tusExpiry, "Time after which abandoned resumable (tus) uploads are removed")
+	flag.DurationVar(&linkCheckMaxAge, "linkcheck", linkCheckMaxAge, "Interval at which remote sources of images are re-checked for link rot or 0 to disable")
+	flag.DurationVar(&linkCheckDelay, "linkcheck-delay", linkCheckDelay, "Delay between link checks")
+	flag.Int64Var(&decodeMaxPixels, "max-pixels", decodeMaxPixels, "Maximum width times height of an image to decode")
+	flag.IntVar(&decodeMaxFrames, "max-frames", decodeMaxFrames, "Maximum number of frames of an animated GIF to decode")
+	flag.Int64Var(&decodeMaxBytes, "max-decoded-bytes", decodeMaxBytes, "Maximum total bytes of decoded image data for a single image")
+	flag.Int64Var(&decodeMemoryBudget, "decode-memory", decodeMemoryBudget, "Approximate total bytes of decoded image data held at once across all requests")
+	flag.StringVar(&imgurClientID, "imgur-client-id", imgurClientID, "imgur API client ID used to expand album and gallery links; without one their pages are scraped")
+	flag.DurationVar(&inboxSettle, "inbox-settle", inboxSettle, "Time a file dropped into an inbox must stay unchanged before it is ingested")
+	flag.StringVar(&variantSizes, "sizes", variantSizes, "Comma-separated sizes allowed for resized images, e.g. 400x (width), 400x300 (fit) or 200x200-fill")
+	flag.IntVar(&animThumbMaxFrames, "anim-thumb-frames", animThumbMaxFrames, "Maximum number of frames in animated GIF thumbnails or 0 to disable them")
+	flag.IntVar(&animThumbSize, "anim-thumb-size", animThumbSize, "Width and height in pixels of animated GIF thumbnails")
+	flag.IntVar(&animThumbColors, "anim-thumb-colors", animThumbColors, "Maximum number of colors in animated GIF thumbnails")
 
 	fl_listen_uri := flag.String("l", "tcp://0.0.0.0:8080", "listen URI (schemes available are tcp, unix)")
 	flag.Parse()
@@ -54,9 +75,15 @@ func main() {
 	os.MkdirAll(store_folder(), 0775)
 	os.MkdirAll(thumb_folder(), 0775)
 	os.MkdirAll(tmp_folder(), 0775)
+	os.MkdirAll(sized_folder(), 0775)
+
+	// Load per-collection settings:
+	config, err = loadConfig(config_path())
+	base.PanicIf(err)
 
 	xrGif = *xrGifArg
 	xrThumb = *xrThumbArg
+	xrSized = *xrSizedArg
 
 	// Create/update the DB schema if needed:
 	log.Println("NewAPI()")
@@ -68,6 +95,14 @@ func main() {
 	log.Println("api.Close()")
 	api.Close()
 
+	// Run a maintenance command instead of the server if one is given:
+	if flag.NArg() > 0 {
+		if err := runCommand(flag.Args()); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	// Watch the html templates for changes and reload them:
 	log.Println("watchTemplates()")
 	_, cleanup, err := web.WatchTemplates("ui", html_path(), "*.html", nil, &uiTmpl)
@@ -77,6 +112,17 @@ func main() {
 	}
 	defer cleanup()
 
+	// Clean up abandoned resumable uploads:
+	go expireTusUploads()
+
+	// Ingest files dropped into collection inboxes:
+	startInboxes()
+
+	// Check remote sources for link rot:
+	if linkCheckMaxAge > 0 {
+		go checkLinks()
+	}
+
 	// Start profiler:
 	go func() {
 		log.Println(http.ListenAndServe("localhost:6060", nil))
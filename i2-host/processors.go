@@ -0,0 +1,417 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+import "github.com/JamesDunne/go-util/web"
+
+// A step run for each newly stored or re-downloaded image once its files are in the store.
+// Processors may amend the image record, which is saved afterwards, or reject the image by returning an error.
+// local_path is the stored file, or "" for kinds without a local file.
+type Processor interface {
+	Name() string
+	Process(img *Image, local_path string) error
+}
+
+type processorFunc struct {
+	name string
+	fn   func(img *Image, local_path string) error
+}
+
+func (p *processorFunc) Name() string                                { return p.name }
+func (p *processorFunc) Process(img *Image, local_path string) error { return p.fn(img, local_path) }
+
+// Built-in processors in the order they run:
+var builtinProcessors = []Processor{
+	&processorFunc{"metadata", extractMetadata},
+	&processorFunc{"strip-metadata", stripMetadata},
+	&processorFunc{"hash", hashContent},
+	&processorFunc{"keywords", filenameKeywords},
+}
+
+// Processors run when the config does not list any:
+var defaultProcessorNames = []string{"metadata", "strip-metadata", "hash"}
+
+// Looks up a built-in processor or configured hook by name:
+func findProcessor(name string) Processor {
+	for _, p := range builtinProcessors {
+		if p.Name() == name {
+			return p
+		}
+	}
+	for i := range config.Hooks {
+		if config.Hooks[i].Name == name {
+			return &commandProcessor{hook: &config.Hooks[i]}
+		}
+	}
+	return nil
+}
+
+// Resolves processor names in order; nil names select the configured processors:
+func selectProcessors(names []string) ([]Processor, error) {
+	if names == nil {
+		names = config.Processors
+		if len(names) == 0 {
+			names = defaultProcessorNames
+		}
+	}
+
+	procs := make([]Processor, 0, len(names))
+	for _, name := range names {
+		p := findProcessor(name)
+		if p == nil {
+			return nil, fmt.Errorf("Unknown processor '%s'", name)
+		}
+		procs = append(procs, p)
+	}
+	return procs, nil
+}
+
+// Path of an image's stored file or "" if it has none:
+func imageLocalPath(img *Image) string {
+	_, ext, _ := imageKindTo(img.Kind)
+	if ext == "" {
+		return ""
+	}
+	local_path := storePath(img.ID, ext)
+	if !fileExists(local_path) {
+		return ""
+	}
+	return local_path
+}
+
+// Runs processors over an image in order, returning a record of each run; the first error rejects the image:
+func runProcessors(img *Image, procs []Processor) (runs []ProcessorRun, werr *web.Error) {
+	local_path := imageLocalPath(img)
+	for _, p := range procs {
+		start := time.Now()
+		err := p.Process(img, local_path)
+
+		run := ProcessorRun{
+			ImageID:    img.ID,
+			Processor:  p.Name(),
+			StartedAt:  start.Unix(),
+			DurationMS: int64(time.Since(start) / time.Millisecond),
+		}
+		if err != nil {
+			run.Error = err.Error()
+		}
+		runs = append(runs, run)
+
+		if err != nil {
+			return runs, web.AsError(fmt.Errorf("Processor '%s' rejected the image: %s", p.Name(), err), http.StatusUnprocessableEntity)
+		}
+	}
+	return runs, nil
+}
+
+// Runs the configured processors over a newly stored image:
+func processNewImage(img *Image) ([]ProcessorRun, *web.Error) {
+	procs, err := selectProcessors(nil)
+	if werr := web.AsError(err, http.StatusInternalServerError); werr != nil {
+		return nil, werr
+	}
+	return runProcessors(img, procs)
+}
+
+func recordProcessorRuns(api *API, runs []ProcessorRun) {
+	for i := range runs {
+		if err := api.AddProcessorRun(&runs[i]); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// Removes an image's stored files, thumbnails and resized variants:
+func removeImageFiles(id int64) {
+	name := strconv.FormatInt(id, 10)
+	for _, folder := range []string{store_folder(), thumb_folder()} {
+		files, _ := filepath.Glob(path.Join(folder, name+".*"))
+		for _, f := range files {
+			os.Remove(f)
+		}
+	}
+	removeVariants(id)
+}
+
+// Moves an image's stored files and thumbnails aside while new ones are stored. finish removes the new
+// files and puts the old ones back if the new ones were rejected; otherwise it only puts back files
+// that were not replaced, e.g. a snapshot, and drops the rest.
+func setAsideImageFiles(id int64) (finish func(rejected bool), err error) {
+	os.MkdirAll(tmp_folder(), 0755)
+	dir, err := ioutil.TempDir(tmp_folder(), "aside-")
+	if err != nil {
+		return nil, err
+	}
+
+	name := strconv.FormatInt(id, 10)
+	moved := make(map[string]string)
+	for i, folder := range []string{store_folder(), thumb_folder()} {
+		files, _ := filepath.Glob(path.Join(folder, name+".*"))
+		for _, f := range files {
+			aside := path.Join(dir, strconv.Itoa(i)+"-"+path.Base(f))
+			if err = os.Rename(f, aside); err != nil {
+				for orig, aside := range moved {
+					os.Rename(aside, orig)
+				}
+				os.RemoveAll(dir)
+				return nil, err
+			}
+			moved[f] = aside
+		}
+	}
+
+	return func(rejected bool) {
+		if rejected {
+			removeImageFiles(id)
+		}
+		for orig, aside := range moved {
+			if rejected || !fileExists(orig) {
+				if err := os.Rename(aside, orig); err != nil {
+					log.Println(err)
+				}
+			}
+		}
+		os.RemoveAll(dir)
+	}, nil
+}
+
+// Keeps the capture date and camera from a JPEG's EXIF metadata:
+func extractMetadata(img *Image, local_path string) error {
+	if img.Kind != "jpeg" || local_path == "" {
+		return nil
+	}
+
+	md, err := readJPEGMetadata(local_path)
+	if err != nil {
+		return err
+	}
+
+	// Metadata already stripped from the file is not lost from the record:
+	if md.CapturedAt != nil {
+		img.CapturedAt = md.CapturedAt
+	}
+	if md.Camera != "" {
+		img.Camera = md.Camera
+	}
+	return nil
+}
+
+// Removes EXIF, XMP and IPTC metadata from JPEGs in collections configured to do so:
+func stripMetadata(img *Image, local_path string) error {
+	if img.Kind != "jpeg" || local_path == "" || !configFor(img.CollectionName).StripMetadata {
+		return nil
+	}
+
+	md, err := readJPEGMetadata(local_path)
+	if err != nil {
+		return err
+	}
+	return stripJPEGFile(local_path, md.Orientation)
+}
+
+// Records the SHA-256 of the stored file:
+func hashContent(img *Image, local_path string) error {
+	if local_path == "" {
+		return nil
+	}
+
+	f, err := os.Open(local_path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return err
+	}
+	img.ContentHash = hex.EncodeToString(h.Sum(nil))
+	return nil
+}
+
+// Adds keywords from the source file name, e.g. "file://happy_cat.gif" adds "happy cat":
+func filenameKeywords(img *Image, local_path string) error {
+	if img.SourceURL == nil || img.Kind == "youtube" || img.Kind == "imgur-gifv" {
+		return nil
+	}
+
+	name := *img.SourceURL
+	if strings.HasPrefix(name, "file://") {
+		name = strings.TrimPrefix(name, "file://")
+	} else if u, err := url.Parse(name); err == nil {
+		name = u.Path
+	}
+
+	existing := make(map[string]bool)
+	for _, word := range strings.Fields(img.Keywords) {
+		existing[word] = true
+	}
+
+	keywords := strings.Fields(img.Keywords)
+	for _, word := range strings.Fields(titleToKeywords(filenameToTitle(path.Base(name)))) {
+		if !existing[word] {
+			existing[word] = true
+			keywords = append(keywords, word)
+		}
+	}
+	img.Keywords = strings.Join(keywords, " ")
+	return nil
+}
+
+// Runs an external command configured as a hook, passing the stored file's path as its last argument
+// and details of the image in IMAGE_* environment variables. A non-zero exit status rejects the image.
+// Output that is a JSON object may amend the title, add keywords or mark the image NSFW.
+type commandProcessor struct {
+	hook *hookConfig
+}
+
+// Hooks run while an upload waits for its response:
+const hookDefaultTimeout = 10 * time.Second
+
+// Amendments a hook command may print:
+type hookAmendment struct {
+	Title    *string `json:"title"`
+	Keywords string  `json:"keywords"`
+	NSFW     *bool   `json:"nsfw"`
+}
+
+func (p *commandProcessor) Name() string { return p.hook.Name }
+
+func (p *commandProcessor) Process(img *Image, local_path string) error {
+	if local_path == "" || len(p.hook.Command) == 0 {
+		return nil
+	}
+
+	timeout := hookDefaultTimeout
+	if p.hook.Timeout > 0 {
+		timeout = time.Duration(p.hook.Timeout) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	args := append(append([]string{}, p.hook.Command[1:]...), local_path)
+	cmd := exec.CommandContext(ctx, p.hook.Command[0], args...)
+	cmd.Env = append(os.Environ(),
+		"IMAGE_ID="+strconv.FormatInt(img.ID, 10),
+		"IMAGE_BASE62ID="+b62.Encode(img.ID+10000),
+		"IMAGE_KIND="+img.Kind,
+		"IMAGE_TITLE="+img.Title,
+		"IMAGE_COLLECTION="+img.CollectionName,
+	)
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("timed out after %s", timeout)
+		}
+		if msg := strings.TrimSpace(stderr.String() + " " + stdout.String()); msg != "" {
+			return fmt.Errorf("%s: %s", err, msg)
+		}
+		return err
+	}
+
+	out := bytes.TrimSpace(stdout.Bytes())
+	if !bytes.HasPrefix(out, []byte("{")) {
+		return nil
+	}
+	amend := &hookAmendment{}
+	if err := json.Unmarshal(out, amend); err != nil {
+		return fmt.Errorf("bad output: %s", err)
+	}
+	if amend.Title != nil && *amend.Title != "" {
+		img.Title = *amend.Title
+	}
+	if amend.Keywords != "" {
+		img.Keywords = strings.TrimSpace(img.Keywords + " " + strings.ToLower(amend.Keywords))
+	}
+	if amend.NSFW != nil && *amend.NSFW {
+		img.IsClean = false
+	}
+	return nil
+}
+
+// Re-runs processors over existing images, e.g. `i2-host reprocess -p hash,metadata 2Bc 2Bd`:
+func reprocessCommand(args []string) error {
+	fs := flag.NewFlagSet("reprocess", flag.ExitOnError)
+	names := fs.String("p", "", "Comma-separated processors to run (default: the configured processors)")
+	collectionName := fs.String("c", "all", "Collection of images to reprocess when no image IDs are given")
+	fs.Parse(args)
+
+	var procs []Processor
+	var err error
+	if *names == "" {
+		procs, err = selectProcessors(nil)
+	} else {
+		procs, err = selectProcessors(strings.Split(*names, ","))
+	}
+	if err != nil {
+		return err
+	}
+
+	// Select images by base62 ID or else by collection:
+	var list []Image
+	if fs.NArg() > 0 {
+		for _, id_s := range fs.Args() {
+			img, werr := getImage(b62.Decode(id_s) - 10000)
+			if werr != nil {
+				return werr.Error
+			}
+			if img == nil {
+				return fmt.Errorf("Could not find image '%s'", id_s)
+			}
+			list = append(list, *img)
+		}
+	} else {
+		var werr *web.Error
+		if list, werr = getList(*collectionName, false, ImagesOrderByIDASC); werr != nil {
+			return werr.Error
+		}
+	}
+
+	done, failed := 0, 0
+	for i := range list {
+		img := &list[i]
+		runs, werr := runProcessors(img, procs)
+		werr = useAPI(func(api *API) *web.Error {
+			recordProcessorRuns(api, runs)
+			if werr != nil {
+				return werr
+			}
+			return web.AsError(api.Update(img), http.StatusInternalServerError)
+		})
+		if werr != nil {
+			fmt.Printf("FAILED  %-8s %s\n", b62.Encode(img.ID+10000), werr.Error)
+			failed++
+			continue
+		}
+		fmt.Printf("OK      %-8s %s\n", b62.Encode(img.ID+10000), img.Title)
+		done++
+	}
+	fmt.Printf("%d reprocessed, %d failed\n", done, failed)
+
+	if failed > 0 {
+		return fmt.Errorf("%d images failed to reprocess", failed)
+	}
+	return nil
+}
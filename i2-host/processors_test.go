@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/gif"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+)
+
+import "github.com/JamesDunne/go-util/web"
+
+func Test_filenameKeywords(t *testing.T) {
+	src := "file://reactions/happy_cat-dance.gif"
+	img := &Image{Kind: "gif", SourceURL: &src, Keywords: "cat funny"}
+	filenameKeywords(img, "")
+	if img.Keywords != "cat funny happy dance" {
+		t.Errorf("unexpected keywords %q", img.Keywords)
+	}
+}
+
+func Test_processorPipeline(t *testing.T) {
+	_, done := withTempStore(t)
+	defer done()
+	defer func(old *serverConfig) { config = old }(config)
+
+	api, err := NewAPI()
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.Close()
+
+	storePNG := func(name string) (int64, string) {
+		buf := &bytes.Buffer{}
+		png.Encode(buf, image.NewRGBA(image.Rect(0, 0, 8, 8)))
+		os.MkdirAll(tmp_folder(), 0755)
+		local_path := path.Join(tmp_folder(), name)
+		ioutil.WriteFile(local_path, buf.Bytes(), 0644)
+
+		id, werr := storeImage(&imageStoreRequest{
+			Title:     "test",
+			SourceURL: "file://" + name,
+			LocalPath: local_path,
+			PostCreation: func(id int64, newImage *Image) *web.Error {
+				return moveFiles(local_path, id, newImage)
+			},
+		})
+		if werr != nil {
+			return 0, werr.Error.Error()
+		}
+		return id, ""
+	}
+
+	// A hook may amend the record:
+	config = &serverConfig{
+		Processors: []string{"hash", "tagger"},
+		Hooks: []hookConfig{
+			{Name: "tagger", Command: []string{"sh", "-c", `echo '{"keywords": "Tagged", "nsfw": true}'`}},
+		},
+	}
+	id, errmsg := storePNG("ok.png")
+	if errmsg != "" {
+		t.Fatal(errmsg)
+	}
+	img, _ := getImage(id)
+	if img.ContentHash == "" || img.Keywords != "test tagged" || img.IsClean {
+		t.Errorf("processors did not amend the image: %+v", img)
+	}
+
+	var runs []ProcessorRun
+	useAPI(func(api *API) *web.Error {
+		runs, _ = api.GetProcessorRuns(id)
+		return nil
+	})
+	if len(runs) != 2 || runs[0].Processor != "tagger" || runs[1].Processor != "hash" {
+		t.Errorf("unexpected processor runs %+v", runs)
+	}
+
+	// A failing hook rejects the image and leaves nothing behind:
+	config = &serverConfig{
+		Processors: []string{"scanner"},
+		Hooks: []hookConfig{
+			{Name: "scanner", Command: []string{"sh", "-c", `echo infected >&2; exit 1`}},
+		},
+	}
+	_, errmsg = storePNG("bad.png")
+	if errmsg == "" {
+		t.Fatal("expected the scanner to reject the image")
+	}
+	img, _ = getImage(id + 1)
+	if img != nil {
+		t.Errorf("rejected image record was kept")
+	}
+	if fileExists(storePath(id+1, ".png")) || fileExists(path.Join(tmp_folder(), "bad.png")) {
+		t.Errorf("rejected image file was kept")
+	}
+	useAPI(func(api *API) *web.Error {
+		runs, _ = api.GetProcessorRuns(id + 1)
+		return nil
+	})
+	if len(runs) != 0 {
+		t.Errorf("processor runs of the rejected image were kept: %+v", runs)
+	}
+
+	// A rejected re-download keeps the image's previous file and record:
+	srv := httptest.NewServer(http.HandlerFunc(func(rsp http.ResponseWriter, req *http.Request) {
+		rsp.Header().Set("Content-Type", "image/gif")
+		gif.EncodeAll(rsp, testAnimation())
+	}))
+	defer srv.Close()
+
+	before, _ := ioutil.ReadFile(storePath(id, ".png"))
+	img, _ = getImage(id)
+	source := srv.URL + "/other.gif"
+	img.SourceURL = &source
+	if werr := redownloadImage(img); werr == nil {
+		t.Fatal("expected the scanner to reject the re-download")
+	}
+	if after, _ := ioutil.ReadFile(storePath(id, ".png")); !bytes.Equal(before, after) {
+		t.Errorf("rejected re-download replaced the stored file")
+	}
+	if fileExists(storePath(id, ".gif")) || !fileExists(path.Join(thumb_folder(), strconv.FormatInt(id, 10)+".png")) {
+		t.Errorf("rejected re-download did not restore the previous files")
+	}
+	if img.Kind != "png" || *img.SourceURL != source {
+		t.Errorf("rejected re-download changed the record: %+v", img)
+	}
+
+	// Deleting an image deletes its runs:
+	useAPI(func(api *API) *web.Error {
+		api.Delete(id)
+		runs, _ = api.GetProcessorRuns(id)
+		return nil
+	})
+	if len(runs) != 0 {
+		t.Errorf("processor runs of a deleted image were kept: %+v", runs)
+	}
+}
+
+func Test_loadConfig_stripMetadata(t *testing.T) {
+	dir, done := withTempStore(t)
+	defer done()
+
+	tests := map[string]bool{
+		`{"collections": {"memes": {"stripMetadata": true}}}`:                                           true,
+		`{"collections": {"memes": {"stripMetadata": true}}, "processors": ["hash", "strip-metadata"]}`: true,
+		`{"collections": {"memes": {"stripMetadata": true}}, "processors": ["hash"]}`:                   false,
+		`{"collections": {"memes": {}}, "processors": ["hash"]}`:                                        true,
+	}
+	config_path := path.Join(dir, "config.json")
+	for text, ok := range tests {
+		ioutil.WriteFile(config_path, []byte(text), 0644)
+		if _, err := loadConfig(config_path); (err == nil) != ok {
+			t.Errorf("%s: unexpected error %v", text, err)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+import (
+	"github.com/JamesDunne/go-util/web"
+	"golang.org/x/net/html"
+)
+
+// Information scraped from an HTML page (OpenGraph, Twitter cards and plain markup):
+type pageInfo struct {
+	Title string
+	URL   string
+	// Media candidates in order of preference:
+	Media []string
+}
+
+// Scrapes an HTML page for its title, canonical URL and media candidates:
+func scrapePage(r io.Reader, base *url.URL) *pageInfo {
+	var (
+		ogTitle, twTitle, docTitle string
+		ogURL                      string
+		ogVideos, ogImages         []string
+		twImages                   []string
+		largestImg                 string
+		largestArea                int
+		inTitle                    bool
+	)
+
+	// Resolve relative URLs against the page URL:
+	resolve := func(s string) string {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			return ""
+		}
+		u, err := url.Parse(s)
+		if err != nil {
+			return ""
+		}
+		if base != nil {
+			u = base.ResolveReference(u)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return ""
+		}
+		return u.String()
+	}
+
+	z := html.NewTokenizer(r)
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+
+		switch tt {
+		case html.StartTagToken, html.SelfClosingTagToken:
+			t := z.Token()
+			switch t.Data {
+			case "title":
+				inTitle = tt == html.StartTagToken
+			case "meta":
+				key := strings.ToLower(attr(t, "property"))
+				if key == "" {
+					key = strings.ToLower(attr(t, "name"))
+				}
+				content := attr(t, "content")
+
+				switch key {
+				case "og:title":
+					ogTitle = content
+				case "twitter:title":
+					twTitle = content
+				case "og:url":
+					ogURL = resolve(content)
+				case "og:video", "og:video:url", "og:video:secure_url":
+					ogVideos = appendUnique(ogVideos, resolve(content))
+				case "og:image", "og:image:url", "og:image:secure_url":
+					ogImages = appendUnique(ogImages, resolve(content))
+				case "twitter:image", "twitter:image:src":
+					twImages = appendUnique(twImages, resolve(content))
+				}
+			case "img":
+				// Only images with declared dimensions can be compared:
+				w, _ := strconv.Atoi(attr(t, "width"))
+				h, _ := strconv.Atoi(attr(t, "height"))
+				if w*h > largestArea {
+					if src := resolve(attr(t, "src")); src != "" {
+						largestArea = w * h
+						largestImg = src
+					}
+				}
+			}
+		case html.EndTagToken:
+			if t := z.Token(); t.Data == "title" {
+				inTitle = false
+			}
+		case html.TextToken:
+			if inTitle && docTitle == "" {
+				docTitle = strings.TrimSpace(string(z.Text()))
+			}
+		}
+	}
+
+	info := &pageInfo{
+		Title: firstNonEmpty(ogTitle, twTitle, docTitle),
+		URL:   ogURL,
+		Media: make([]string, 0, len(ogVideos)+len(ogImages)+len(twImages)+1),
+	}
+	for _, list := range [][]string{ogVideos, ogImages, twImages, {largestImg}} {
+		for _, m := range list {
+			info.Media = appendUnique(info.Media, m)
+		}
+	}
+	return info
+}
+
+func attr(t html.Token, name string) string {
+	for _, a := range t.Attr {
+		if a.Key == name {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+func appendUnique(list []string, s string) []string {
+	if s == "" {
+		return list
+	}
+	for _, e := range list {
+		if e == s {
+			return list
+		}
+	}
+	return append(list, s)
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v = strings.TrimSpace(v); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// Ingests the best media candidate found on a downloaded HTML page:
+func downloadPageMediaFor(store *imageStoreRequest, page_path, mimeType string) *web.Error {
+	defer os.Remove(page_path)
+
+	pageurl, err := url.Parse(store.SourceURL)
+	if err != nil {
+		return web.AsError(err, http.StatusBadRequest)
+	}
+
+	f, err := os.Open(page_path)
+	if err != nil {
+		return web.AsError(err, http.StatusInternalServerError)
+	}
+	info := scrapePage(f, pageurl)
+	f.Close()
+
+	if len(info.Media) == 0 {
+		return web.AsError(fmt.Errorf("No image or video found on page"), http.StatusBadRequest)
+	}
+
+	// Try each candidate in order of preference until one ingests:
+	var werr *web.Error
+	for _, media := range info.Media {
+		candidate := *store
+		candidate.SourceURL = media
+		if werr = downloadImage(&candidate, false); werr != nil {
+			log.Printf("%s: skipping media candidate %s: %s\n", store.SourceURL, media, werr.Error)
+			continue
+		}
+
+		store.Kind = candidate.Kind
+		store.PostCreation = candidate.PostCreation
+		store.LocalPath = candidate.LocalPath
+		if candidate.Kind == "youtube" || candidate.Kind == "imgur-gifv" {
+			// These kinds identify their media by SourceURL:
+			store.SourceURL = candidate.SourceURL
+		} else if info.URL != "" {
+			// Keep the page as provenance, preferring its canonical URL:
+			store.SourceURL = info.URL
+		}
+
+		// Prefill a missing title from the page:
+		if store.Title == "" {
+			store.Title = info.Title
+		}
+
+		if store.Snapshot {
+			snapshotPage(store, pageurl, page_path, mimeType)
+		}
+		return nil
+	}
+
+	return werr
+}
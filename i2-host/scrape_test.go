@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func Test_scrapePage(t *testing.T) {
+	page := `<!DOCTYPE html>
+<html>
+<head>
+	<title>Fallback title</title>
+	<meta property="og:title" content="A funny cat" />
+	<meta property="og:url" content="https://example.com/posts/1" />
+	<meta property="og:image" content="/media/cat.gif" />
+	<meta name="twitter:image" content="https://cdn.example.com/cat-large.jpg">
+</head>
+<body>
+	<img src="logo.png" width="32" height="32">
+	<img src="big.jpg" width="800" height="600">
+	<img src="unsized.jpg">
+</body>
+</html>`
+
+	base, _ := url.Parse("https://example.com/posts/1?ref=share")
+	info := scrapePage(strings.NewReader(page), base)
+
+	if info.Title != "A funny cat" {
+		t.Errorf("Title = %q", info.Title)
+	}
+	if info.URL != "https://example.com/posts/1" {
+		t.Errorf("URL = %q", info.URL)
+	}
+
+	expected := []string{
+		"https://example.com/media/cat.gif",
+		"https://cdn.example.com/cat-large.jpg",
+		"https://example.com/posts/big.jpg",
+	}
+	if strings.Join(info.Media, " ") != strings.Join(expected, " ") {
+		t.Errorf("Media = %v", info.Media)
+	}
+}
+
+func Test_scrapePage_titleFallback(t *testing.T) {
+	info := scrapePage(strings.NewReader(`<html><head><title> Just a title </title></head><body></body></html>`), nil)
+	if info.Title != "Just a title" {
+		t.Errorf("Title = %q", info.Title)
+	}
+	if len(info.Media) != 0 {
+		t.Errorf("Media = %v", info.Media)
+	}
+}
+
+func Test_needsTitle(t *testing.T) {
+	tests := map[string]bool{
+		"http://example.com/cat.gif":          true,
+		"https://i.imgur.com/abc.gifv":        true,
+		"https://www.youtube.com/watch?v=abc": true,
+		"http://example.com/articles/cats":    false,
+		"http://example.com/index.html":       false,
+	}
+	for source, expected := range tests {
+		if needsTitle(source) != expected {
+			t.Errorf("%s: expected needsTitle %v", source, expected)
+		}
+	}
+}
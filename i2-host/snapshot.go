@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	crand "crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+import (
+	"github.com/JamesDunne/go-util/web"
+	"golang.org/x/net/html"
+)
+
+// Snapshots of submitted pages and the media they reference, kept as store/<id>.warc for provenance.
+
+// Limits on what a snapshot captures beyond the page itself; the submission waits for it:
+var (
+	snapshotMaxResources = 50
+	snapshotMaxBytes     = int64(64 << 20)
+	snapshotMaxTime      = 20 * time.Second
+)
+
+var snapshotClient = &http.Client{Timeout: 10 * time.Second}
+
+func newWARCRecordID() string {
+	b := make([]byte, 16)
+	crand.Read(b)
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("<urn:uuid:%x-%x-%x-%x-%x>", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// Writes a single WARC 1.0 record:
+func writeWARCRecord(w io.Writer, warcType, targetURI, contentType string, block []byte) error {
+	hdr := &bytes.Buffer{}
+	hdr.WriteString("WARC/1.0\r\n")
+	hdr.WriteString("WARC-Type: " + warcType + "\r\n")
+	hdr.WriteString("WARC-Record-ID: " + newWARCRecordID() + "\r\n")
+	hdr.WriteString("WARC-Date: " + time.Now().UTC().Format("2006-01-02T15:04:05Z") + "\r\n")
+	if targetURI != "" {
+		hdr.WriteString("WARC-Target-URI: " + targetURI + "\r\n")
+	}
+	hdr.WriteString("Content-Type: " + contentType + "\r\n")
+	hdr.WriteString("Content-Length: " + strconv.Itoa(len(block)) + "\r\n\r\n")
+
+	if _, err := w.Write(hdr.Bytes()); err != nil {
+		return err
+	}
+	if _, err := w.Write(block); err != nil {
+		return err
+	}
+	_, err := w.Write([]byte("\r\n\r\n"))
+	return err
+}
+
+// Writes a response record holding an HTTP response's status line, headers and body:
+func writeWARCResponse(w io.Writer, targetURI string, status string, header http.Header, body []byte) error {
+	block := &bytes.Buffer{}
+	block.WriteString("HTTP/1.1 " + status + "\r\n")
+	header.Write(block)
+	block.WriteString("\r\n")
+	block.Write(body)
+	return writeWARCRecord(w, "response", targetURI, "application/http; msgtype=response", block.Bytes())
+}
+
+// Lists the media and stylesheets a page references, resolved against the page URL:
+func pageResources(r io.Reader, base *url.URL) []string {
+	var resources []string
+	add := func(s string) {
+		u, err := url.Parse(strings.TrimSpace(s))
+		if err != nil || s == "" {
+			return
+		}
+		u = base.ResolveReference(u)
+		if u.Scheme == "http" || u.Scheme == "https" {
+			u.Fragment = ""
+			resources = appendUnique(resources, u.String())
+		}
+	}
+
+	z := html.NewTokenizer(r)
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			return resources
+		}
+		if tt != html.StartTagToken && tt != html.SelfClosingTagToken {
+			continue
+		}
+
+		t := z.Token()
+		switch t.Data {
+		case "img", "source", "audio":
+			add(attr(t, "src"))
+		case "video":
+			add(attr(t, "src"))
+			add(attr(t, "poster"))
+		case "link":
+			switch strings.ToLower(attr(t, "rel")) {
+			case "stylesheet", "icon", "shortcut icon", "image_src":
+				add(attr(t, "href"))
+			}
+		case "meta":
+			switch strings.ToLower(firstNonEmpty(attr(t, "property"), attr(t, "name"))) {
+			case "og:image", "og:image:url", "og:image:secure_url", "og:video", "og:video:url", "og:video:secure_url", "twitter:image":
+				add(attr(t, "content"))
+			}
+		}
+	}
+}
+
+// Captures a downloaded page and the resources it references into a temporary WARC file:
+func captureSnapshot(pageURL *url.URL, page_path, mimeType string) (warc_path string, err error) {
+	page, err := ioutil.ReadFile(page_path)
+	if err != nil {
+		return "", err
+	}
+
+	os.MkdirAll(tmp_folder(), 0755)
+	f, err := TempFile(tmp_folder(), "snap-", ".warc")
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		f.Close()
+		if err != nil {
+			os.Remove(f.Name())
+		}
+	}()
+	w := bufio.NewWriter(f)
+
+	info := "software: i2-host\r\nformat: WARC File Format 1.0\r\n"
+	if err = writeWARCRecord(w, "warcinfo", "", "application/warc-fields", []byte(info)); err != nil {
+		return "", err
+	}
+
+	// The page's original headers are not kept by the downloader:
+	header := http.Header{}
+	header.Set("Content-Type", mimeType)
+	if err = writeWARCResponse(w, pageURL.String(), "200 OK", header, page); err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), snapshotMaxTime)
+	defer cancel()
+
+	total := int64(len(page))
+	for i, resource := range pageResources(bytes.NewReader(page), pageURL) {
+		if i >= snapshotMaxResources || total >= snapshotMaxBytes || ctx.Err() != nil {
+			break
+		}
+
+		req, err := http.NewRequest("GET", resource, nil)
+		if err != nil {
+			continue
+		}
+		rsp, err := snapshotClient.Do(req.WithContext(ctx))
+		if err != nil {
+			log.Printf("snapshot %s: %s\n", resource, err)
+			continue
+		}
+		body, err := ioutil.ReadAll(io.LimitReader(rsp.Body, snapshotMaxBytes-total+1))
+		rsp.Body.Close()
+		if err != nil || total+int64(len(body)) > snapshotMaxBytes {
+			continue
+		}
+		total += int64(len(body))
+
+		rsp.Header.Del("Content-Length")
+		rsp.Header.Del("Transfer-Encoding")
+		rsp.Header.Del("Content-Encoding")
+		if err = writeWARCResponse(w, resource, rsp.Status, rsp.Header, body); err != nil {
+			return "", err
+		}
+	}
+
+	if err = w.Flush(); err != nil {
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// A response record read back from a WARC file:
+type warcResponse struct {
+	TargetURI   string
+	StatusCode  int
+	ContentType string
+	Body        []byte
+}
+
+// Reads all response records from a WARC file in order:
+func readWARCResponses(warc_path string) ([]warcResponse, error) {
+	f, err := os.Open(warc_path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	responses := make([]warcResponse, 0, 8)
+	tr := textproto.NewReader(bufio.NewReader(f))
+	for {
+		line, err := tr.ReadLine()
+		if err == io.EOF {
+			return responses, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if line == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, "WARC/") {
+			return nil, fmt.Errorf("Malformed WARC record: %q", line)
+		}
+
+		hdr, err := tr.ReadMIMEHeader()
+		if err != nil {
+			return nil, err
+		}
+		n, err := strconv.ParseInt(hdr.Get("Content-Length"), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Malformed WARC record length")
+		}
+		block := make([]byte, n)
+		if _, err = io.ReadFull(tr.R, block); err != nil {
+			return nil, err
+		}
+
+		if hdr.Get("WARC-Type") != "response" {
+			continue
+		}
+		rsp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(block)), nil)
+		if err != nil {
+			return nil, err
+		}
+		body, err := ioutil.ReadAll(rsp.Body)
+		if err != nil {
+			return nil, err
+		}
+		responses = append(responses, warcResponse{
+			TargetURI:   hdr.Get("WARC-Target-URI"),
+			StatusCode:  rsp.StatusCode,
+			ContentType: rsp.Header.Get("Content-Type"),
+			Body:        body,
+		})
+	}
+}
+
+func hasSnapshot(id int64) bool {
+	return fileExists(storePath(id, ".warc"))
+}
+
+// Rewrites references in an archived page to resources captured in the same snapshot:
+func rewriteSnapshotPage(page []byte, pageURL *url.URL, replayURL func(target string) string) []byte {
+	out := &bytes.Buffer{}
+	z := html.NewTokenizer(bytes.NewReader(page))
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			return out.Bytes()
+		}
+		if tt != html.StartTagToken && tt != html.SelfClosingTagToken {
+			out.Write(z.Raw())
+			continue
+		}
+
+		t := z.Token()
+		changed := false
+		for i, a := range t.Attr {
+			switch a.Key {
+			case "src", "href", "poster", "content":
+			default:
+				continue
+			}
+			u, err := url.Parse(strings.TrimSpace(a.Val))
+			if err != nil {
+				continue
+			}
+			if replay := replayURL(pageURL.ResolveReference(u).String()); replay != "" {
+				t.Attr[i].Val = replay
+				changed = true
+			}
+		}
+		if changed {
+			out.WriteString(t.String())
+		} else {
+			out.Write(z.Raw())
+		}
+	}
+}
+
+// Serves an archived snapshot of an image's source page, or the captured resource given by `?url=`:
+func serveSnapshot(rsp http.ResponseWriter, req *http.Request, id_s string) *web.Error {
+	id := b62.Decode(id_s) - 10000
+	if !hasSnapshot(id) {
+		return web.AsError(fmt.Errorf("No snapshot for image"), http.StatusNotFound)
+	}
+
+	responses, err := readWARCResponses(storePath(id, ".warc"))
+	if werr := web.AsError(err, http.StatusInternalServerError); werr != nil {
+		return werr
+	}
+	if len(responses) == 0 {
+		return web.AsError(fmt.Errorf("Snapshot is empty"), http.StatusNotFound)
+	}
+
+	captured := make(map[string]*warcResponse, len(responses))
+	for i := range responses {
+		captured[responses[i].TargetURI] = &responses[i]
+	}
+
+	// The first response is the page itself:
+	page := &responses[0]
+	if target := req.URL.Query().Get("url"); target != "" {
+		var ok bool
+		if page, ok = captured[target]; !ok {
+			return web.AsError(fmt.Errorf("Resource was not captured"), http.StatusNotFound)
+		}
+	}
+
+	body := page.Body
+	if strings.HasPrefix(page.ContentType, "text/html") || strings.HasPrefix(page.ContentType, "application/xhtml+xml") {
+		pageURL, err := url.Parse(page.TargetURI)
+		if err == nil {
+			body = rewriteSnapshotPage(body, pageURL, func(target string) string {
+				if _, ok := captured[target]; ok {
+					return "/admin/snapshot/" + id_s + "?url=" + url.QueryEscape(target)
+				}
+				return ""
+			})
+		}
+	}
+
+	// Archived content must not run scripts, load anything from outside the snapshot or act as the app's origin:
+	h := rsp.Header()
+	h.Set("Content-Type", page.ContentType)
+	h.Set("Content-Security-Policy", "default-src 'self' data:; style-src 'self' 'unsafe-inline'; script-src 'none'; frame-src 'none'; sandbox")
+	h.Set("X-Content-Type-Options", "nosniff")
+	rsp.WriteHeader(page.StatusCode)
+	rsp.Write(body)
+	return nil
+}
+
+// Captures a snapshot of the submitted page and arranges for it to be stored beside the image.
+// Failing to capture does not fail the submission.
+func snapshotPage(store *imageStoreRequest, pageURL *url.URL, page_path, mimeType string) {
+	warc_path, err := captureSnapshot(pageURL, page_path, mimeType)
+	if err != nil {
+		log.Printf("snapshot %s: %s\n", pageURL, err)
+		return
+	}
+
+	postCreation := store.PostCreation
+	store.PostCreation = func(id int64, newImage *Image) *web.Error {
+		if postCreation != nil {
+			if werr := postCreation(id, newImage); werr != nil {
+				os.Remove(warc_path)
+				return werr
+			}
+		}
+		return moveToStoreFolder(warc_path, id, ".warc")
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_snapshot(t *testing.T) {
+	dir, done := withTempStore(t)
+	defer done()
+
+	buf := &bytes.Buffer{}
+	png.Encode(buf, image.NewRGBA(image.Rect(0, 0, 8, 8)))
+
+	srv := httptest.NewServer(http.HandlerFunc(func(rsp http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/cat.png":
+			rsp.Header().Set("Content-Type", "image/png")
+			rsp.Write(buf.Bytes())
+		case "/style.css":
+			rsp.Header().Set("Content-Type", "text/css")
+			rsp.Write([]byte("body { color: red }"))
+		default:
+			http.NotFound(rsp, req)
+		}
+	}))
+	defer srv.Close()
+
+	page := `<html><head><link rel="stylesheet" href="/style.css"><script src="/app.js"></script></head>` +
+		`<body><img src="cat.png"><img src="/missing.png"></body></html>`
+	page_path := path.Join(dir, "page.html")
+	ioutil.WriteFile(page_path, []byte(page), 0644)
+
+	pageURL, _ := url.Parse(srv.URL + "/post")
+	warc_path, err := captureSnapshot(pageURL, page_path, "text/html")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The page plus its stylesheet and images are captured, scripts are not:
+	responses, err := readWARCResponses(warc_path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(responses) != 4 {
+		t.Fatalf("expected 4 responses, got %d", len(responses))
+	}
+	if responses[0].TargetURI != pageURL.String() || string(responses[0].Body) != page {
+		t.Errorf("unexpected page record %+v", responses[0])
+	}
+	for _, r := range responses[1:] {
+		if strings.HasSuffix(r.TargetURI, "/cat.png") && !bytes.Equal(r.Body, buf.Bytes()) {
+			t.Errorf("image body was not archived intact")
+		}
+		if strings.HasSuffix(r.TargetURI, "/missing.png") && r.StatusCode != http.StatusNotFound {
+			t.Errorf("expected the 404 to be archived, got %d", r.StatusCode)
+		}
+	}
+
+	// Replay rewrites captured references into the snapshot:
+	if werr := moveToStoreFolder(warc_path, 1, ".warc"); werr != nil {
+		t.Fatal(werr.Error)
+	}
+	id_s := b62.Encode(1 + 10000)
+	rsp := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/admin/snapshot/"+id_s, nil)
+	if werr := serveSnapshot(rsp, req, id_s); werr != nil {
+		t.Fatal(werr.Error)
+	}
+	body := rsp.Body.String()
+	if !strings.Contains(body, `src="/admin/snapshot/`+id_s+`?url=`+url.QueryEscape(srv.URL+"/cat.png")+`"`) {
+		t.Errorf("image reference was not rewritten: %s", body)
+	}
+	if csp := rsp.Header().Get("Content-Security-Policy"); !strings.Contains(csp, "script-src 'none'") || !strings.Contains(csp, "sandbox") {
+		t.Errorf("expected scripts to be blocked and the page sandboxed: %s", csp)
+	}
+
+	rsp = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/admin/snapshot/"+id_s+"?url="+url.QueryEscape(srv.URL+"/style.css"), nil)
+	if werr := serveSnapshot(rsp, req, id_s); werr != nil {
+		t.Fatal(werr.Error)
+	}
+	if rsp.Body.String() != "body { color: red }" || rsp.Header().Get("Content-Type") != "text/css" {
+		t.Errorf("unexpected stylesheet replay %q", rsp.Body.String())
+	}
+}
+
+func Test_snapshot_slowResources(t *testing.T) {
+	dir, done := withTempStore(t)
+	defer done()
+
+	unblock := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(rsp http.ResponseWriter, req *http.Request) {
+		select {
+		case <-unblock:
+		case <-time.After(10 * time.Second):
+		}
+	}))
+	defer srv.Close()
+	defer close(unblock)
+
+	defer func(d time.Duration) { snapshotMaxTime = d }(snapshotMaxTime)
+	snapshotMaxTime = 200 * time.Millisecond
+
+	page_path := path.Join(dir, "page.html")
+	ioutil.WriteFile(page_path, []byte(`<img src="/a.png"><img src="/b.png"><img src="/c.png">`), 0644)
+
+	// Resources that do not arrive in time are left out rather than holding up the submission:
+	pageURL, _ := url.Parse(srv.URL + "/post")
+	start := time.Now()
+	warc_path, err := captureSnapshot(pageURL, page_path, "text/html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("snapshot took %s", elapsed)
+	}
+	responses, err := readWARCResponses(warc_path)
+	if err != nil || len(responses) != 1 {
+		t.Errorf("expected only the page to be captured, got %d (%v)", len(responses), err)
+	}
+}
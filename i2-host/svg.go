@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+)
+
+import (
+	"github.com/srwiley/oksvg"
+	"github.com/srwiley/rasterx"
+)
+
+// SVG uploads are sanitized before they are stored: scripts, event handlers, embedded documents
+// and references to anything outside the file itself are removed, so that an SVG opened directly
+// cannot run code or fetch other resources. Thumbnails are rasterized from the sanitized file.
+
+// Largest width or height SVGs are rasterized at:
+const svgRasterMax = 1024
+
+// Width and height of SVGs that declare neither a viewBox nor a size:
+const svgDefaultSize = 512
+
+// Elements removed from SVGs along with everything inside them:
+var svgBlockedElements = map[string]bool{
+	"script":        true,
+	"foreignobject": true,
+	"iframe":        true,
+	"embed":         true,
+	"object":        true,
+	"audio":         true,
+	"video":         true,
+	"handler":       true,
+	"listener":      true,
+}
+
+// Finds the targets of CSS `url(...)` references:
+var cssURLRe = regexp.MustCompile(`(?i)url\(\s*['"]?\s*([^'")\s]*)`)
+
+// Detects SVG documents, which http.DetectContentType reports as text/xml or text/plain:
+func isSVG(head []byte) bool {
+	head = bytes.TrimPrefix(head, []byte("\xEF\xBB\xBF"))
+	head = bytes.TrimLeft(head, " \t\r\n")
+	if len(head) == 0 || head[0] != '<' {
+		return false
+	}
+	if len(head) > 1024 {
+		head = head[:1024]
+	}
+	return bytes.Contains(bytes.ToLower(head), []byte("<svg"))
+}
+
+func isSVGFile(local_path string) bool {
+	f, err := os.Open(local_path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	head := make([]byte, 1024)
+	n, _ := io.ReadFull(f, head)
+	return isSVG(head[:n])
+}
+
+// Determines whether a reference may stay in a sanitized SVG; only fragments and embedded raster images may:
+func safeSVGReference(ref string) bool {
+	ref = strings.ToLower(strings.TrimSpace(ref))
+	if strings.HasPrefix(ref, "#") {
+		return true
+	}
+	for _, prefix := range []string{"data:image/png", "data:image/jpeg", "data:image/gif", "data:image/webp"} {
+		if strings.HasPrefix(ref, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Determines whether CSS may stay in a sanitized SVG:
+func safeSVGStyle(css string) bool {
+	lower := strings.ToLower(css)
+	if strings.Contains(lower, "@import") || strings.Contains(lower, "expression(") {
+		return false
+	}
+	for _, m := range cssURLRe.FindAllStringSubmatch(css, -1) {
+		if !safeSVGReference(m[1]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Determines whether an attribute may stay in a sanitized SVG:
+func safeSVGAttr(attr xml.Attr) bool {
+	name := strings.ToLower(attr.Name.Local)
+	compact := strings.ToLower(strings.Join(strings.Fields(attr.Value), ""))
+	switch {
+	case strings.HasPrefix(name, "on"):
+		// Event handlers:
+		return false
+	case strings.Contains(compact, "javascript:") || strings.Contains(compact, "vbscript:"):
+		return false
+	case name == "href" || name == "src":
+		return safeSVGReference(attr.Value)
+	}
+	// Styles and presentation attributes such as `fill="url(...)"` may only refer to fragments:
+	return safeSVGStyle(attr.Value)
+}
+
+func writeSVGStartElement(w io.Writer, t xml.StartElement) error {
+	var b bytes.Buffer
+	b.WriteString("<" + xmlName(t.Name))
+	for _, attr := range t.Attr {
+		b.WriteString(" " + xmlName(attr.Name) + `="`)
+		xml.EscapeText(&b, []byte(attr.Value))
+		b.WriteString(`"`)
+	}
+	b.WriteString(">")
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// Names as written in the source; RawToken leaves namespace prefixes in Space:
+func xmlName(n xml.Name) string {
+	if n.Space == "" {
+		return n.Local
+	}
+	return n.Space + ":" + n.Local
+}
+
+// Copies an SVG document leaving out anything that could run code or load other resources:
+func sanitizeSVG(r io.Reader, w io.Writer) error {
+	d := xml.NewDecoder(r)
+	d.Entity = xml.HTMLEntity
+
+	// Depth within a removed element:
+	skip := 0
+	// Whether the text being copied belongs to a <style> element:
+	inStyle := false
+	sawSVG := false
+
+	for {
+		tok, err := d.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("Invalid SVG: %s", err)
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if skip > 0 {
+				skip++
+				continue
+			}
+			name := strings.ToLower(t.Name.Local)
+			if svgBlockedElements[name] {
+				skip = 1
+				continue
+			}
+			if name == "svg" {
+				sawSVG = true
+			}
+			if strings.HasPrefix(name, "animate") || name == "set" {
+				// Animations could set links or handlers after the fact:
+				target := ""
+				for _, attr := range t.Attr {
+					if attr.Name.Local == "attributeName" {
+						target = strings.ToLower(attr.Value)
+					}
+				}
+				if strings.HasSuffix(target, "href") || strings.HasPrefix(target, "on") {
+					skip = 1
+					continue
+				}
+			}
+
+			attrs := t.Attr[:0]
+			for _, attr := range t.Attr {
+				if safeSVGAttr(attr) {
+					attrs = append(attrs, attr)
+				}
+			}
+			t.Attr = attrs
+			inStyle = name == "style"
+			if err = writeSVGStartElement(w, t); err != nil {
+				return err
+			}
+		case xml.EndElement:
+			if skip > 0 {
+				skip--
+				continue
+			}
+			inStyle = false
+			if _, err = io.WriteString(w, "</"+xmlName(t.Name)+">"); err != nil {
+				return err
+			}
+		case xml.CharData:
+			if skip > 0 || (inStyle && !safeSVGStyle(string(t))) {
+				continue
+			}
+			if err = xml.EscapeText(w, t); err != nil {
+				return err
+			}
+		case xml.Comment, xml.ProcInst, xml.Directive:
+			// Dropped, including DOCTYPEs declaring entities:
+		}
+	}
+
+	if !sawSVG {
+		return fmt.Errorf("Invalid SVG: no <svg> element")
+	}
+	return nil
+}
+
+// Sanitizes an SVG file in place:
+func sanitizeSVGFile(local_path string) error {
+	data, err := ioutil.ReadFile(local_path)
+	if err != nil {
+		return err
+	}
+
+	var b bytes.Buffer
+	if err = sanitizeSVG(bytes.NewReader(data), &b); err != nil {
+		return &imageLimitError{msg: err.Error(), statusCode: http.StatusUnprocessableEntity}
+	}
+	return ioutil.WriteFile(local_path, b.Bytes(), 0644)
+}
+
+func readSVG(local_path string) (*oksvg.SvgIcon, error) {
+	f, err := os.Open(local_path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	icon, err := oksvg.ReadIconStream(f)
+	if err != nil {
+		return nil, &imageLimitError{msg: "Unrecognized or corrupt SVG: " + err.Error(), statusCode: http.StatusUnprocessableEntity}
+	}
+	return icon, nil
+}
+
+// Works out the size an SVG is rasterized at, keeping its aspect ratio within svgRasterMax:
+func svgSize(icon *oksvg.SvgIcon) (w, h int) {
+	vw, vh := icon.ViewBox.W, icon.ViewBox.H
+	if vw <= 0 || vh <= 0 {
+		vw, vh = svgDefaultSize, svgDefaultSize
+	}
+	scale := 1.0
+	if m := math.Max(vw, vh); m > svgRasterMax {
+		scale = svgRasterMax / m
+	}
+	w, h = int(vw*scale+0.5), int(vh*scale+0.5)
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+	return
+}
+
+// Renders an SVG file to an image once there is room in the decode budget for it;
+// release must be called once the image is no longer needed:
+func rasterizeSVG(local_path string) (img image.Image, release func(), err error) {
+	icon, err := readSVG(local_path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	w, h := svgSize(icon)
+	icon.SetTarget(0, 0, float64(w), float64(h))
+
+	release = decodeGate.acquire(int64(w) * int64(h) * 4)
+	rgba := image.NewRGBA(image.Rect(0, 0, w, h))
+	scanner := rasterx.NewScannerGV(w, h, rgba, rgba.Bounds())
+	icon.Draw(rasterx.NewDasher(w, h, scanner), 1)
+	return rgba, release, nil
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"net/http"
+)
+
+// Timeline operations change when and in what order the frames of an animated GIF are shown:
+//
+//	{"op": "speed", "factor": 2}              play twice as fast
+//	{"op": "fps", "fps": 15}                  show frames at a fixed rate
+//	{"op": "reverse"}                         play backwards
+//	{"op": "boomerang"}                       play forwards then backwards
+//	{"op": "trim", "from": 10, "to": 40}      keep frames 10 to 40
+//	{"op": "trim", "start": 1.5, "end": 3}    keep what is shown from 1.5s to 3s
+//	{"op": "loop", "count": 1}                play once; 0 loops forever
+//
+// They apply to the frames as left by the operations before them and may be combined with picture
+// operations in a transform. Only GIFs have timelines.
+
+// Browsers show frames with delays under 2 hundredths of a second for 10:
+const (
+	gifMinDelay     = 2
+	gifDefaultDelay = 10
+)
+
+// A frame of the source GIF shown for a time:
+type gifShownFrame struct {
+	Index int
+	Delay int // hundredths of a second
+}
+
+func isTimelineOp(op string) bool {
+	switch op {
+	case "speed", "fps", "reverse", "boomerang", "trim", "loop":
+		return true
+	}
+	return false
+}
+
+func hasTimelineOps(ops []transformOp) bool {
+	for _, op := range ops {
+		if isTimelineOp(op.Op) {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks the parameters of a timeline operation that do not depend on the GIF:
+func checkTimelineOp(op transformOp) error {
+	switch op.Op {
+	case "speed":
+		if op.Factor <= 0 || op.Factor > 100 {
+			return fmt.Errorf("speed factor must be more than 0 and at most 100")
+		}
+	case "fps":
+		// A frame must show for at least the minimum delay:
+		if op.FPS <= 0 || op.FPS > 100/gifMinDelay {
+			return fmt.Errorf("fps must be more than 0 and at most %d", 100/gifMinDelay)
+		}
+	case "trim":
+		if op.Start != nil || op.End != nil {
+			if op.Start != nil && *op.Start < 0 {
+				return fmt.Errorf("trim start must not be negative")
+			}
+			if op.Start != nil && op.End != nil && *op.End <= *op.Start {
+				return fmt.Errorf("trim end must be after its start")
+			}
+		} else if op.From < 0 || (op.To != nil && *op.To < op.From) {
+			return fmt.Errorf("trim needs frames from <= to")
+		}
+	case "loop":
+		if op.Count == nil || *op.Count < 0 || *op.Count > 65535 {
+			return fmt.Errorf("loop count must be from 0 (forever) to 65535")
+		}
+	}
+	return nil
+}
+
+func effectiveDelay(delay int) int {
+	if delay < gifMinDelay {
+		return gifDefaultDelay
+	}
+	return delay
+}
+
+// Refusals of timeline operations that do not fit the GIF at hand:
+func timelineError(format string, args ...interface{}) error {
+	return &imageLimitError{msg: fmt.Sprintf(format, args...), statusCode: http.StatusUnprocessableEntity}
+}
+
+// Applies timeline operations to a GIF's frames, returning the frames to show and the new loop count:
+func planTimeline(ops []transformOp, delays []int, frameCount, loopCount int) ([]gifShownFrame, int, error) {
+	frames := make([]gifShownFrame, frameCount)
+	for i := range frames {
+		frames[i] = gifShownFrame{Index: i}
+		if i < len(delays) {
+			frames[i].Delay = delays[i]
+		}
+	}
+
+	for n, op := range ops {
+		switch op.Op {
+		case "speed":
+			for i := range frames {
+				delay := int(math.Floor(float64(effectiveDelay(frames[i].Delay))/op.Factor + 0.5))
+				if delay < gifMinDelay {
+					delay = gifMinDelay
+				}
+				frames[i].Delay = delay
+			}
+		case "fps":
+			// Sample what is shown at each tick; the encoder merges ticks showing the same frame:
+			tick := int(math.Floor(100/op.FPS + 0.5))
+			total := 0
+			for _, f := range frames {
+				total += effectiveDelay(f.Delay)
+			}
+			count := (total + tick - 1) / tick
+			if count > decodeMaxFrames {
+				return nil, 0, tooLarge("Operation %d: %d frames is more than %d", n+1, count, decodeMaxFrames)
+			}
+
+			sampled := make([]gifShownFrame, 0, count)
+			shown, end := 0, effectiveDelay(frames[0].Delay)
+			for t := 0; t < total; t += tick {
+				for t >= end {
+					shown++
+					end += effectiveDelay(frames[shown].Delay)
+				}
+				sampled = append(sampled, gifShownFrame{Index: frames[shown].Index, Delay: tick})
+			}
+			frames = sampled
+		case "reverse":
+			reversed := make([]gifShownFrame, len(frames))
+			for i, f := range frames {
+				reversed[len(frames)-1-i] = f
+			}
+			frames = reversed
+		case "boomerang":
+			// Back again without showing either end twice in a row:
+			for i := len(frames) - 2; i > 0; i-- {
+				frames = append(frames, frames[i])
+			}
+		case "trim":
+			if op.Start != nil || op.End != nil {
+				// Keep the parts of frames shown within the time range:
+				start, end := 0, math.MaxInt32
+				if op.Start != nil {
+					start = int(math.Floor(*op.Start*100 + 0.5))
+				}
+				if op.End != nil {
+					end = int(math.Floor(*op.End*100 + 0.5))
+				}
+
+				trimmed := make([]gifShownFrame, 0, len(frames))
+				t := 0
+				for _, f := range frames {
+					from, to := t, t+effectiveDelay(f.Delay)
+					t = to
+					if from < start {
+						from = start
+					}
+					if to > end {
+						to = end
+					}
+					if to > from {
+						trimmed = append(trimmed, gifShownFrame{Index: f.Index, Delay: to - from})
+					}
+				}
+				if len(trimmed) == 0 {
+					return nil, 0, timelineError("Operation %d: nothing is shown from %.2fs; the GIF is %.2fs long", n+1, float64(start)/100, float64(t)/100)
+				}
+				frames = trimmed
+				break
+			}
+
+			to := len(frames) - 1
+			if op.To != nil {
+				to = *op.To
+			}
+			if op.From >= len(frames) || to >= len(frames) {
+				return nil, 0, timelineError("Operation %d: cannot keep frames %d to %d of %d", n+1, op.From, to, len(frames))
+			}
+			frames = frames[op.From : to+1]
+		case "loop":
+			switch *op.Count {
+			case 0:
+				loopCount = 0
+			case 1:
+				loopCount = -1
+			default:
+				loopCount = *op.Count - 1
+			}
+		}
+
+		if len(frames) > decodeMaxFrames {
+			return nil, 0, tooLarge("Operation %d: %d frames is more than %d", n+1, len(frames), decodeMaxFrames)
+		}
+	}
+	return frames, loopCount, nil
+}
+
+// Returns the rendered canvases of a planned timeline one at a time, for encodeGIFCanvases.
+// Frames shown in their original order are rendered as the compositor reaches them; otherwise all
+// frames needed are rendered up front, which must fit within the decoding limits.
+func timelineCanvases(comp *gifCompositor, frames []gifShownFrame, size image.Point, render func(*image.RGBA) *image.RGBA) (func() (*image.RGBA, int), error) {
+	inOrder := true
+	for i := 1; i < len(frames); i++ {
+		if frames[i].Index <= frames[i-1].Index {
+			inOrder = false
+			break
+		}
+	}
+
+	next := 0
+	if inOrder {
+		shown := -1
+		return func() (*image.RGBA, int) {
+			if next >= len(frames) {
+				return nil, 0
+			}
+			f := frames[next]
+			next++
+
+			var canvas *image.RGBA
+			for shown < f.Index {
+				canvas, _ = comp.Next()
+				shown++
+			}
+			return render(canvas), f.Delay
+		}, nil
+	}
+
+	needed := map[int]*image.RGBA{}
+	last := 0
+	for _, f := range frames {
+		needed[f.Index] = nil
+		if f.Index > last {
+			last = f.Index
+		}
+	}
+	if bytes := int64(len(needed)) * int64(size.X) * int64(size.Y) * 4; bytes > decodeMaxBytes {
+		return nil, tooLarge("Reordering %d frames would take more than %d bytes", len(needed), decodeMaxBytes)
+	}
+	for i := 0; i <= last; i++ {
+		canvas, _ := comp.Next()
+		if _, ok := needed[i]; ok {
+			needed[i] = render(canvas)
+		}
+	}
+
+	return func() (*image.RGBA, int) {
+		if next >= len(frames) {
+			return nil, 0
+		}
+		f := frames[next]
+		next++
+		return needed[f.Index], f.Delay
+	}, nil
+}
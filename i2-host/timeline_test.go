@@ -0,0 +1,113 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/gif"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func Test_planTimeline(t *testing.T) {
+	intp := func(n int) *int { return &n }
+	secs := func(s float64) *float64 { return &s }
+	delays := []int{10, 20, 30, 0}
+
+	tests := []struct {
+		name     string
+		ops      []transformOp
+		expected []gifShownFrame
+		loop     int
+	}{
+		{"unchanged", []transformOp{{Op: "grayscale"}}, []gifShownFrame{{0, 10}, {1, 20}, {2, 30}, {3, 0}}, 3},
+		// Missing delays count as the browser default; nothing gets faster than the minimum delay:
+		{"speed", []transformOp{{Op: "speed", Factor: 8}}, []gifShownFrame{{0, 2}, {1, 3}, {2, 4}, {3, 2}}, 3},
+		{"fps", []transformOp{{Op: "fps", FPS: 5}}, []gifShownFrame{{0, 20}, {1, 20}, {2, 20}, {3, 20}}, 3},
+		// Frames shown for less than a tick may be skipped:
+		{"fps dropping frames", []transformOp{{Op: "fps", FPS: 4}}, []gifShownFrame{{0, 25}, {1, 25}, {2, 25}}, 3},
+		{"reverse", []transformOp{{Op: "reverse"}}, []gifShownFrame{{3, 0}, {2, 30}, {1, 20}, {0, 10}}, 3},
+		{"boomerang", []transformOp{{Op: "boomerang"}}, []gifShownFrame{{0, 10}, {1, 20}, {2, 30}, {3, 0}, {2, 30}, {1, 20}}, 3},
+		{"trim frames", []transformOp{{Op: "trim", From: 1, To: intp(2)}}, []gifShownFrame{{1, 20}, {2, 30}}, 3},
+		{"trim to end", []transformOp{{Op: "reverse"}, {Op: "trim", From: 2}}, []gifShownFrame{{1, 20}, {0, 10}}, 3},
+		{"trim time", []transformOp{{Op: "trim", Start: secs(0.15), End: secs(0.4)}}, []gifShownFrame{{1, 15}, {2, 10}}, 3},
+		{"loop forever", []transformOp{{Op: "loop", Count: intp(0)}}, []gifShownFrame{{0, 10}, {1, 20}, {2, 30}, {3, 0}}, 0},
+		{"play once", []transformOp{{Op: "loop", Count: intp(1)}}, []gifShownFrame{{0, 10}, {1, 20}, {2, 30}, {3, 0}}, -1},
+		{"play twice", []transformOp{{Op: "loop", Count: intp(2)}}, []gifShownFrame{{0, 10}, {1, 20}, {2, 30}, {3, 0}}, 1},
+	}
+	for _, test := range tests {
+		frames, loop, err := planTimeline(test.ops, delays, len(delays), 3)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(frames, test.expected) || loop != test.loop {
+			t.Errorf("%s: expected %v loop %d, got %v loop %d", test.name, test.expected, test.loop, frames, loop)
+		}
+	}
+
+	bad := [][]transformOp{
+		{{Op: "trim", From: 4}},
+		{{Op: "trim", From: 0, To: intp(4)}},
+		{{Op: "trim", Start: secs(1)}},
+	}
+	for _, ops := range bad {
+		if _, _, err := planTimeline(ops, delays, len(delays), 3); err == nil {
+			t.Errorf("expected %+v to be refused", ops)
+		}
+	}
+
+	// Parameters are checked when planning the whole transform:
+	for _, ops := range [][]transformOp{
+		{{Op: "speed"}},
+		{{Op: "fps", FPS: 60}},
+		{{Op: "trim", From: 3, To: intp(1)}},
+		{{Op: "trim", Start: secs(2), End: secs(1)}},
+		{{Op: "loop"}},
+	} {
+		if _, _, err := planTransform(ops, 16, 16); err == nil {
+			t.Errorf("expected %+v to be refused", ops)
+		}
+	}
+}
+
+func Test_transformTimeline(t *testing.T) {
+	dir, done := withTempStore(t)
+	defer done()
+	os.MkdirAll(tmp_folder(), 0755)
+
+	// Black, blue then red frames:
+	full := image.Rect(0, 0, 8, 8)
+	gif_path := path.Join(dir, "flat.gif")
+	f, _ := os.Create(gif_path)
+	gif.EncodeAll(f, testFlatFrames([]image.Rectangle{full, full, full}, []uint8{1, 3, 2}))
+	f.Close()
+
+	one := 1
+	tmp_output, err := transformImage(gif_path, "gif", []transformOp{{Op: "boomerang"}, {Op: "speed", Factor: 2}, {Op: "loop", Count: &one}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, _ = os.Open(tmp_output)
+	g, err := gif.DecodeAll(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []color.RGBA{{0, 0, 0, 255}, {0, 0, 255, 255}, {255, 0, 0, 255}, {0, 0, 255, 255}}
+	frames, delays := displayedFrames(g, full)
+	if len(frames) != len(expected) || g.LoopCount != -1 {
+		t.Fatalf("expected %d frames played once, got %d frames, loop count %d", len(expected), len(frames), g.LoopCount)
+	}
+	for i, frame := range frames {
+		if c := frame.RGBAAt(0, 0); c != expected[i] || delays[i] != 5 {
+			t.Errorf("frame %d: expected %v for 5, got %v for %d", i, expected[i], c, delays[i])
+		}
+	}
+
+	if _, err = transformImage(gif_path, "png", []transformOp{{Op: "reverse"}}); err == nil {
+		t.Errorf("expected a timeline operation on a PNG to be refused")
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"os"
+)
+
+import (
+	"github.com/JamesDunne/go-util/imaging"
+	"github.com/JamesDunne/go-util/web"
+)
+
+// A single step of a transform, e.g. `{"op": "rotate", "degrees": 90}`:
+type transformOp struct {
+	Op string `json:"op"`
+
+	// crop:
+	Left   int `json:"left"`
+	Top    int `json:"top"`
+	Right  int `json:"right"`
+	Bottom int `json:"bottom"`
+
+	// rotate (clockwise) by 90, 180 or 270:
+	Degrees int `json:"degrees"`
+
+	// flip "horizontal" (mirror left to right) or "vertical":
+	Axis string `json:"axis"`
+
+	// resize; either may be 0 to keep the aspect ratio:
+	Width  int `json:"width"`
+	Height int `json:"height"`
+
+	// speed; 2 plays twice as fast:
+	Factor float64 `json:"factor"`
+
+	// fps; frames shown per second:
+	FPS float64 `json:"fps"`
+
+	// trim by frame numbers, both kept, or by time in seconds; a missing end keeps the rest:
+	From  int      `json:"from"`
+	To    *int     `json:"to"`
+	Start *float64 `json:"start"`
+	End   *float64 `json:"end"`
+
+	// loop; times to play, 0 for forever:
+	Count *int `json:"count"`
+}
+
+// Checks a list of operations against an image of the given size and returns the resulting size:
+func planTransform(ops []transformOp, w, h int) (int, int, error) {
+	if len(ops) == 0 {
+		return 0, 0, fmt.Errorf("No operations given")
+	}
+
+	for i, op := range ops {
+		switch op.Op {
+		case "crop":
+			r := image.Rect(op.Left, op.Top, op.Right, op.Bottom)
+			if r.Empty() || !r.In(image.Rect(0, 0, w, h)) {
+				return 0, 0, fmt.Errorf("Operation %d: crop boundaries are not contained within image boundaries", i+1)
+			}
+			w, h = r.Dx(), r.Dy()
+		case "rotate":
+			switch op.Degrees {
+			case 90, 270:
+				w, h = h, w
+			case 180:
+			default:
+				return 0, 0, fmt.Errorf("Operation %d: can only rotate by 90, 180 or 270 degrees", i+1)
+			}
+		case "flip":
+			if op.Axis != "horizontal" && op.Axis != "vertical" {
+				return 0, 0, fmt.Errorf("Operation %d: flip axis must be 'horizontal' or 'vertical'", i+1)
+			}
+		case "resize":
+			if op.Width < 0 || op.Height < 0 || (op.Width == 0 && op.Height == 0) {
+				return 0, 0, fmt.Errorf("Operation %d: resize needs a width or height", i+1)
+			}
+			w, h = resizeDimensions(op, w, h)
+			if int64(w)*int64(h) > decodeMaxPixels {
+				return 0, 0, tooLarge("Operation %d: %dx%d is more than %d pixels", i+1, w, h, decodeMaxPixels)
+			}
+		case "grayscale":
+		case "speed", "fps", "reverse", "boomerang", "trim", "loop":
+			if err := checkTimelineOp(op); err != nil {
+				return 0, 0, fmt.Errorf("Operation %d: %s", i+1, err)
+			}
+		default:
+			return 0, 0, fmt.Errorf("Operation %d: unknown operation '%s'", i+1, op.Op)
+		}
+	}
+	return w, h, nil
+}
+
+func resizeDimensions(op transformOp, w, h int) (int, int) {
+	nw, nh := op.Width, op.Height
+	if nw == 0 {
+		nw = (w*nh + h/2) / h
+	} else if nh == 0 {
+		nh = (h*nw + w/2) / w
+	}
+	if nw < 1 {
+		nw = 1
+	}
+	if nh < 1 {
+		nh = 1
+	}
+	return nw, nh
+}
+
+func toRGBA(img image.Image) *image.RGBA {
+	b := img.Bounds()
+	out := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(out, out.Rect, img, b.Min, draw.Src)
+	return out
+}
+
+// Applies planned operations to a single picture:
+func applyTransform(img *image.RGBA, ops []transformOp) *image.RGBA {
+	for _, op := range ops {
+		switch op.Op {
+		case "crop":
+			r := image.Rect(op.Left, op.Top, op.Right, op.Bottom).Add(img.Rect.Min)
+			img = toRGBA(img.SubImage(r))
+		case "rotate":
+			// As the EXIF orientations that turn an image clockwise:
+			orientation := map[int]int{90: 6, 180: 3, 270: 8}[op.Degrees]
+			img = applyOrientation(img, orientation).(*image.RGBA)
+		case "flip":
+			orientation := 2
+			if op.Axis == "vertical" {
+				orientation = 4
+			}
+			img = applyOrientation(img, orientation).(*image.RGBA)
+		case "resize":
+			w, h := resizeDimensions(op, img.Rect.Dx(), img.Rect.Dy())
+			img = toRGBA(imaging.Resize(img, w, h, imaging.Lanczos))
+		case "grayscale":
+			for i := 0; i+3 < len(img.Pix); i += 4 {
+				r, g, b := int(img.Pix[i]), int(img.Pix[i+1]), int(img.Pix[i+2])
+				y := uint8((299*r + 587*g + 114*b + 500) / 1000)
+				img.Pix[i], img.Pix[i+1], img.Pix[i+2] = y, y, y
+			}
+		}
+	}
+	return img
+}
+
+// Applies operations to a stored image and writes the result to a temporary file of the same kind.
+// Animated GIFs are transformed frame by frame and keep their timing unless timeline operations
+// change it.
+func transformImage(local_path, kind string, ops []transformOp) (tmp_output string, err error) {
+	_, ext, _ := imageKindTo(kind)
+	tmpf, err := TempFile(tmp_folder(), "transform-", ext)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		tmpf.Close()
+		if err != nil {
+			os.Remove(tmpf.Name())
+		}
+	}()
+
+	if kind == "gif" && !hasTimelineOps(ops) {
+		// Keeping the timing, frames are transformed as they are read:
+		comp, done, err := openGIFStream(local_path)
+		if err != nil {
+			return "", err
+		}
+		defer done()
+
+		w, h, err := planTransform(ops, comp.screen.Dx(), comp.screen.Dy())
+		if err != nil {
+			return "", err
+		}
+		err = encodeGIFCanvases(tmpf, comp.LoopCount(), image.Pt(w, h), func() (*image.RGBA, int) {
+			canvas, delay := comp.Next()
+			if canvas == nil {
+				return nil, 0
+			}
+			frame := applyTransform(toRGBA(canvas), ops)
+			limitColors(frame, nil)
+			return frame, delay
+		})
+		if err == nil {
+			err = comp.Err()
+		}
+		if err != nil {
+			return "", err
+		}
+		return tmpf.Name(), nil
+	}
+	if kind == "gif" {
+		// Timeline operations need every frame's delay up front:
+		imf, err := os.Open(local_path)
+		if err != nil {
+			return "", err
+		}
+		defer imf.Close()
+		release, err := acquireDecode(imf, true)
+		if err != nil {
+			return "", err
+		}
+		defer release()
+		g, err := gif.DecodeAll(imf)
+		if err != nil {
+			return "", err
+		}
+
+		comp := newGIFCompositor(g)
+		w, h, err := planTransform(ops, comp.screen.Dx(), comp.screen.Dy())
+		if err != nil {
+			return "", err
+		}
+		frames, loopCount, err := planTimeline(ops, g.Delay, len(g.Image), g.LoopCount)
+		if err != nil {
+			return "", err
+		}
+		next, err := timelineCanvases(comp, frames, image.Pt(w, h), func(canvas *image.RGBA) *image.RGBA {
+			frame := applyTransform(toRGBA(canvas), ops)
+			limitColors(frame, nil)
+			return frame
+		})
+		if err != nil {
+			return "", err
+		}
+		if err = encodeGIFCanvases(tmpf, loopCount, image.Pt(w, h), next); err != nil {
+			return "", err
+		}
+		return tmpf.Name(), nil
+	}
+
+	if hasTimelineOps(ops) {
+		return "", fmt.Errorf("Only GIFs have frames to change the timing of")
+	}
+	img, _, release, err := decodeFirstImage(local_path)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+	b := img.Bounds()
+	if _, _, err = planTransform(ops, b.Dx(), b.Dy()); err != nil {
+		return "", err
+	}
+	out := applyTransform(toRGBA(img), ops)
+
+	switch kind {
+	case "jpeg":
+		err = jpeg.Encode(tmpf, out, &jpeg.Options{Quality: 100})
+	case "png":
+		err = png.Encode(tmpf, out)
+	}
+	if err != nil {
+		return "", err
+	}
+	return tmpf.Name(), nil
+}
+
+// Stores a transformed file as a copy of img derived by the given operations, or over img itself when
+// replace is set, and regenerates its thumbnails. img is updated to the stored record.
+func storeTransformed(img *Image, tmp_output string, replace bool, derivation string) *web.Error {
+	if !replace {
+		// Clone the image record to a new record linked back to the original:
+		parentID := img.ID
+		img.ParentID = &parentID
+		img.DerivationOp = derivation
+		if werr := useAPI(func(api *API) *web.Error {
+			var err error
+			img.ID = 0
+			img.ID, err = api.NewImage(img)
+			return web.AsError(err, http.StatusInternalServerError)
+		}); werr != nil {
+			os.Remove(tmp_output)
+			return werr
+		}
+	}
+
+	if werr := moveFiles(tmp_output, img.ID, img); werr != nil {
+		os.Remove(tmp_output)
+		return werr
+	}
+
+	// The file's content changed:
+	if err := hashContent(img, imageLocalPath(img)); err != nil {
+		return web.AsError(err, http.StatusInternalServerError)
+	}
+	return useAPI(func(api *API) *web.Error {
+		return web.AsError(api.Update(img), http.StatusInternalServerError)
+	})
+}
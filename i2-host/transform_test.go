@@ -0,0 +1,117 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"os"
+	"path"
+	"testing"
+)
+
+func Test_planTransform(t *testing.T) {
+	w, h, err := planTransform([]transformOp{
+		{Op: "crop", Left: 10, Top: 0, Right: 110, Bottom: 50},
+		{Op: "rotate", Degrees: 90},
+		{Op: "resize", Width: 25},
+		{Op: "grayscale"},
+	}, 200, 100)
+	if err != nil || w != 25 || h != 50 {
+		t.Errorf("expected 25x50, got %dx%d (%v)", w, h, err)
+	}
+
+	bad := [][]transformOp{
+		nil,
+		{{Op: "crop", Left: 0, Top: 0, Right: 300, Bottom: 50}},
+		{{Op: "rotate", Degrees: 45}},
+		{{Op: "flip", Axis: "diagonal"}},
+		{{Op: "resize"}},
+		{{Op: "sharpen"}},
+	}
+	for _, ops := range bad {
+		if _, _, err := planTransform(ops, 200, 100); err == nil {
+			t.Errorf("expected %+v to be refused", ops)
+		}
+	}
+	if _, _, err := planTransform([]transformOp{{Op: "resize", Width: 100000, Height: 100000}}, 200, 100); err == nil {
+		t.Errorf("expected huge resize to be refused")
+	} else if _, ok := err.(*imageLimitError); !ok {
+		t.Errorf("expected huge resize to be reported as too large")
+	}
+}
+
+func Test_transformImage(t *testing.T) {
+	dir, done := withTempStore(t)
+	defer done()
+	os.MkdirAll(tmp_folder(), 0755)
+
+	api, err := NewAPI()
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.Close()
+
+	// A 4x2 image with a red top-left pixel:
+	src := image.NewRGBA(image.Rect(0, 0, 4, 2))
+	src.Set(0, 0, color.RGBA{255, 0, 0, 255})
+	local_path := path.Join(dir, "src.png")
+	f, _ := os.Create(local_path)
+	png.Encode(f, src)
+	f.Close()
+
+	tmp_output, err := transformImage(local_path, "png", []transformOp{{Op: "rotate", Degrees: 90}, {Op: "flip", Axis: "vertical"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, _ = os.Open(tmp_output)
+	out, err := png.Decode(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Rotating clockwise moves the pixel to the top right; flipping moves it to the bottom right:
+	if out.Bounds().Dx() != 2 || out.Bounds().Dy() != 4 {
+		t.Fatalf("unexpected size %v", out.Bounds())
+	}
+	if r, _, _, _ := out.At(1, 3).RGBA(); r != 0xffff {
+		t.Errorf("pixel did not end up at the bottom right")
+	}
+
+	// The result is stored as a new image with a thumbnail:
+	img := &Image{Kind: "png", Title: "test"}
+	if werr := storeTransformed(img, tmp_output, false, "rotate(90) flip(vertical)"); werr != nil {
+		t.Fatal(werr.Error)
+	}
+	if img.ID == 0 || img.ContentHash == "" || !fileExists(storePath(img.ID, ".png")) || !fileExists(path.Join(thumb_folder(), "1.png")) {
+		t.Errorf("transformed image was not stored: %+v", img)
+	}
+
+	// Animated GIFs keep their frames:
+	gif_path := path.Join(dir, "anim.gif")
+	f, _ = os.Create(gif_path)
+	gif.EncodeAll(f, testAnimation())
+	f.Close()
+	tmp_output, err = transformImage(gif_path, "gif", []transformOp{{Op: "rotate", Degrees: 270}, {Op: "grayscale"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, _ = os.Open(tmp_output)
+	g, err := gif.DecodeAll(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(g.Image) < 2 || g.LoopCount != 3 {
+		t.Errorf("animation was not kept: %d frames, loop count %d", len(g.Image), g.LoopCount)
+	}
+	for _, frame := range g.Image {
+		for _, c := range frame.Palette {
+			r, gr, b, _ := c.RGBA()
+			if r != gr || gr != b {
+				t.Fatalf("frame is not grayscale: %v", c)
+			}
+		}
+	}
+}
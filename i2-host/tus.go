@@ -0,0 +1,367 @@
+package main
+
+import (
+	crand "crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+import "github.com/JamesDunne/go-util/web"
+
+// Resumable uploads implementing the tus 1.0 protocol (https://tus.io/protocols/resumable-upload.html)
+// with the creation, expiration and termination extensions. Partial uploads live in the tmp folder.
+
+const tusVersion = "1.0.0"
+
+var (
+	tusMaxSize = int64(256 << 20)
+	tusExpiry  = 24 * time.Hour
+)
+
+// Persisted state of a partial upload; the offset is the size of its data file:
+type tusUpload struct {
+	ID       string            `json:"id"`
+	Length   int64             `json:"length"`
+	Metadata map[string]string `json:"metadata"`
+	Expires  time.Time         `json:"expires"`
+	ImageID  int64             `json:"imageID,omitempty"`
+}
+
+func tusInfoPath(id string) string { return path.Join(tmp_folder(), "tus-"+id+".json") }
+func tusDataPath(id string) string { return path.Join(tmp_folder(), "tus-"+id+".bin") }
+
+// Serializes requests against the same upload:
+var tusLock sync.Mutex
+var tusLocks = make(map[string]*sync.Mutex)
+
+func lockTusUpload(id string) func() {
+	tusLock.Lock()
+	l, ok := tusLocks[id]
+	if !ok {
+		l = &sync.Mutex{}
+		tusLocks[id] = l
+	}
+	tusLock.Unlock()
+
+	l.Lock()
+	return l.Unlock
+}
+
+func loadTusUpload(id string) (*tusUpload, error) {
+	b, err := ioutil.ReadFile(tusInfoPath(id))
+	if err != nil {
+		return nil, err
+	}
+	up := &tusUpload{}
+	if err = json.Unmarshal(b, up); err != nil {
+		return nil, err
+	}
+	return up, nil
+}
+
+func (up *tusUpload) save() error {
+	b, err := json.Marshal(up)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(tusInfoPath(up.ID), b, 0600)
+}
+
+func (up *tusUpload) offset() (int64, error) {
+	if up.ImageID != 0 {
+		// Completed uploads no longer keep their data:
+		return up.Length, nil
+	}
+	fi, err := os.Stat(tusDataPath(up.ID))
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+func (up *tusUpload) remove() {
+	os.Remove(tusDataPath(up.ID))
+	os.Remove(tusInfoPath(up.ID))
+}
+
+// Parses `Upload-Metadata: key base64value,key2 base64value2`:
+func parseTusMetadata(header string) (map[string]string, error) {
+	md := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, " ", 2)
+		value := ""
+		if len(kv) == 2 {
+			b, err := base64.StdEncoding.DecodeString(kv[1])
+			if err != nil {
+				return nil, fmt.Errorf("Bad Upload-Metadata value for '%s'", kv[0])
+			}
+			value = string(b)
+		}
+		md[kv[0]] = value
+	}
+	return md, nil
+}
+
+func formatTusMetadata(md map[string]string) string {
+	pairs := make([]string, 0, len(md))
+	for k, v := range md {
+		pairs = append(pairs, k+" "+base64.StdEncoding.EncodeToString([]byte(v)))
+	}
+	return strings.Join(pairs, ",")
+}
+
+func newTusID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := crand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Handles `/api/v1/tus` (creation) and `/api/v1/tus/<upload id>` requests:
+func tusHandler(rsp http.ResponseWriter, req *http.Request, id string) *web.Error {
+	h := rsp.Header()
+	h.Set("Tus-Resumable", tusVersion)
+
+	method := req.Method
+	if override := req.Header.Get("X-HTTP-Method-Override"); override != "" {
+		method = override
+	}
+
+	if method == "OPTIONS" {
+		h.Set("Tus-Version", tusVersion)
+		h.Set("Tus-Extension", "creation,expiration,termination")
+		h.Set("Tus-Max-Size", strconv.FormatInt(tusMaxSize, 10))
+		rsp.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+
+	if req.Header.Get("Tus-Resumable") != tusVersion {
+		h.Set("Tus-Version", tusVersion)
+		return web.AsError(fmt.Errorf("Unsupported Tus-Resumable version"), http.StatusPreconditionFailed)
+	}
+
+	if id == "" {
+		if method != "POST" {
+			return web.AsError(fmt.Errorf("Method not allowed"), http.StatusMethodNotAllowed)
+		}
+		return tusCreate(rsp, req)
+	}
+
+	// Upload IDs are hex; anything else cannot name a file of ours:
+	if _, err := hex.DecodeString(id); err != nil {
+		return web.AsError(fmt.Errorf("Upload not found"), http.StatusNotFound)
+	}
+
+	unlock := lockTusUpload(id)
+	defer unlock()
+
+	up, err := loadTusUpload(id)
+	if err != nil || time.Now().After(up.Expires) {
+		return web.AsError(fmt.Errorf("Upload not found"), http.StatusNotFound)
+	}
+
+	switch method {
+	case "HEAD":
+		offset, err := up.offset()
+		if werr := web.AsError(err, http.StatusInternalServerError); werr != nil {
+			return werr
+		}
+		h.Set("Cache-Control", "no-store")
+		h.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		h.Set("Upload-Length", strconv.FormatInt(up.Length, 10))
+		h.Set("Upload-Expires", up.Expires.UTC().Format(http.TimeFormat))
+		if len(up.Metadata) > 0 {
+			h.Set("Upload-Metadata", formatTusMetadata(up.Metadata))
+		}
+		setTusImageHeaders(h, up)
+		rsp.WriteHeader(http.StatusOK)
+		return nil
+	case "PATCH":
+		return tusPatch(rsp, req, up)
+	case "DELETE":
+		up.remove()
+		rsp.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+
+	return web.AsError(fmt.Errorf("Method not allowed"), http.StatusMethodNotAllowed)
+}
+
+func tusCreate(rsp http.ResponseWriter, req *http.Request) *web.Error {
+	length, err := strconv.ParseInt(req.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		return web.AsError(fmt.Errorf("Missing or invalid Upload-Length"), http.StatusBadRequest)
+	}
+	if length > tusMaxSize {
+		return web.AsError(fmt.Errorf("Upload-Length exceeds Tus-Max-Size of %d", tusMaxSize), http.StatusRequestEntityTooLarge)
+	}
+
+	md, err := parseTusMetadata(req.Header.Get("Upload-Metadata"))
+	if werr := web.AsError(err, http.StatusBadRequest); werr != nil {
+		return werr
+	}
+
+	id, err := newTusID()
+	if werr := web.AsError(err, http.StatusInternalServerError); werr != nil {
+		return werr
+	}
+
+	up := &tusUpload{
+		ID:       id,
+		Length:   length,
+		Metadata: md,
+		Expires:  time.Now().Add(tusExpiry),
+	}
+
+	// Create the empty data file and the upload's info:
+	os.MkdirAll(tmp_folder(), 0755)
+	f, err := os.OpenFile(tusDataPath(id), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if werr := web.AsError(err, http.StatusInternalServerError); werr != nil {
+		return werr
+	}
+	f.Close()
+	if werr := web.AsError(up.save(), http.StatusInternalServerError); werr != nil {
+		up.remove()
+		return werr
+	}
+
+	h := rsp.Header()
+	h.Set("Location", "/api/v1/tus/"+id)
+	h.Set("Upload-Expires", up.Expires.UTC().Format(http.TimeFormat))
+	rsp.WriteHeader(http.StatusCreated)
+	return nil
+}
+
+func tusPatch(rsp http.ResponseWriter, req *http.Request, up *tusUpload) *web.Error {
+	if req.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		return web.AsError(fmt.Errorf("Content-Type must be application/offset+octet-stream"), http.StatusUnsupportedMediaType)
+	}
+
+	offset, err := up.offset()
+	if werr := web.AsError(err, http.StatusInternalServerError); werr != nil {
+		return werr
+	}
+	if up.ImageID != 0 {
+		return web.AsError(fmt.Errorf("Upload is already complete"), http.StatusForbidden)
+	}
+	if req.Header.Get("Upload-Offset") != strconv.FormatInt(offset, 10) {
+		return web.AsError(fmt.Errorf("Upload-Offset does not match current offset %d", offset), http.StatusConflict)
+	}
+
+	// Append the chunk; a dropped connection keeps whatever arrived:
+	f, err := os.OpenFile(tusDataPath(up.ID), os.O_WRONLY|os.O_APPEND, 0600)
+	if werr := web.AsError(err, http.StatusInternalServerError); werr != nil {
+		return werr
+	}
+	n, err := io.Copy(f, io.LimitReader(req.Body, up.Length-offset))
+	f.Close()
+	offset += n
+	if err != nil {
+		log.Printf("tus %s: stopped at offset %d: %s\n", up.ID, offset, err)
+	}
+
+	// Every successful PATCH extends the expiry:
+	up.Expires = time.Now().Add(tusExpiry)
+	if offset == up.Length {
+		// Finalize into a stored image; uploads that fail to store cannot be resumed:
+		id, werr := storeTusUpload(up, req.RemoteAddr)
+		if werr != nil {
+			up.remove()
+			return werr
+		}
+		up.ImageID = id
+	}
+	if werr := web.AsError(up.save(), http.StatusInternalServerError); werr != nil {
+		return werr
+	}
+
+	h := rsp.Header()
+	h.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	h.Set("Upload-Expires", up.Expires.UTC().Format(http.TimeFormat))
+	setTusImageHeaders(h, up)
+	rsp.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// Reports the image a completed upload was stored as:
+func setTusImageHeaders(h http.Header, up *tusUpload) {
+	if up.ImageID == 0 {
+		return
+	}
+	h.Set("X-Image-ID", strconv.FormatInt(up.ImageID, 10))
+	h.Set("X-Image-Base62ID", b62.Encode(up.ImageID+10000))
+}
+
+// Stores a completed upload using its metadata for title, keywords, collection and nsfw:
+func storeTusUpload(up *tusUpload, submitter string) (int64, *web.Error) {
+	md := up.Metadata
+
+	// Give the data file its real extension so it is moved like any other upload:
+	local_path := path.Join(tmp_folder(), "tus-"+up.ID+filepath.Ext(md["filename"]))
+	if werr := web.AsError(os.Rename(tusDataPath(up.ID), local_path), http.StatusInternalServerError); werr != nil {
+		return 0, werr
+	}
+	defer os.Remove(local_path)
+
+	store := &imageStoreRequest{
+		CollectionName: md["collection"],
+		Submitter:      submitter,
+		SourceURL:      "file://" + md["filename"],
+		Title:          md["title"],
+		Keywords:       strings.ToLower(md["keywords"]),
+		IsClean:        md["nsfw"] != "1",
+		PostCreation: func(id int64, newImage *Image) *web.Error {
+			return moveFiles(local_path, id, newImage)
+		},
+	}
+	if store.Title == "" {
+		store.Title = filenameToTitle(md["filename"])
+	}
+
+	return storeImage(store)
+}
+
+// Periodically removes abandoned uploads past their expiry:
+func expireTusUploads() {
+	for {
+		infos, _ := filepath.Glob(path.Join(tmp_folder(), "tus-*.json"))
+		for _, info_path := range infos {
+			id := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(info_path), "tus-"), ".json")
+
+			unlock := lockTusUpload(id)
+			up, err := loadTusUpload(id)
+			expired := err != nil || time.Now().After(up.Expires)
+			if expired {
+				log.Printf("tus %s: expired\n", id)
+				(&tusUpload{ID: id}).remove()
+			}
+			unlock()
+
+			if expired {
+				tusLock.Lock()
+				delete(tusLocks, id)
+				tusLock.Unlock()
+			}
+		}
+
+		time.Sleep(time.Hour)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func tusRequest(t *testing.T, method, id string, headers map[string]string, body []byte) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, "/api/v1/tus/"+id, bytes.NewReader(body))
+	req.Header.Set("Tus-Resumable", tusVersion)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	rsp := httptest.NewRecorder()
+	if werr := tusHandler(rsp, req, id); werr != nil {
+		rsp.Code = werr.StatusCode
+	}
+	return rsp
+}
+
+func Test_tusUpload(t *testing.T) {
+	_, done := withTempStore(t)
+	defer done()
+
+	api, err := NewAPI()
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.Close()
+
+	buf := &bytes.Buffer{}
+	png.Encode(buf, image.NewRGBA(image.Rect(0, 0, 8, 8)))
+	data := buf.Bytes()
+
+	// Create the upload:
+	rsp := tusRequest(t, "POST", "", map[string]string{
+		"Upload-Length":   strconv.Itoa(len(data)),
+		"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte("tiny_square.png")),
+	}, nil)
+	if rsp.Code != http.StatusCreated {
+		t.Fatalf("POST: %d", rsp.Code)
+	}
+	id := strings.TrimPrefix(rsp.Header().Get("Location"), "/api/v1/tus/")
+
+	// Send the first half, then resume from the offset reported by HEAD:
+	half := len(data) / 2
+	rsp = tusRequest(t, "PATCH", id, map[string]string{"Content-Type": "application/offset+octet-stream", "Upload-Offset": "0"}, data[:half])
+	if rsp.Code != http.StatusNoContent {
+		t.Fatalf("PATCH: %d", rsp.Code)
+	}
+
+	rsp = tusRequest(t, "HEAD", id, nil, nil)
+	offset := rsp.Header().Get("Upload-Offset")
+	if offset != strconv.Itoa(half) {
+		t.Fatalf("HEAD offset = %s", offset)
+	}
+
+	rsp = tusRequest(t, "PATCH", id, map[string]string{"Content-Type": "application/offset+octet-stream", "Upload-Offset": "0"}, data[half:])
+	if rsp.Code != http.StatusConflict {
+		t.Fatalf("PATCH with stale offset: %d", rsp.Code)
+	}
+
+	rsp = tusRequest(t, "PATCH", id, map[string]string{"Content-Type": "application/offset+octet-stream", "Upload-Offset": offset}, data[half:])
+	if rsp.Code != http.StatusNoContent {
+		t.Fatalf("final PATCH: %d", rsp.Code)
+	}
+	if rsp.Header().Get("X-Image-ID") != "1" {
+		t.Fatalf("X-Image-ID = %q", rsp.Header().Get("X-Image-ID"))
+	}
+
+	img, werr := getImage(1)
+	if werr != nil {
+		t.Fatal(werr.Error)
+	}
+	if img.Title != "tiny square" || img.Kind != "png" {
+		t.Errorf("image = %+v", *img)
+	}
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+import "github.com/JamesDunne/go-util/web"
+
+// A file part received from a multipart upload and saved to the tmp folder:
+type uploadedFile struct {
+	FieldName string
+	FileName  string
+	LocalPath string
+
+	// Title and keywords derived from where the file came from, e.g. an archive entry:
+	Title    string
+	Keywords string
+}
+
+// Outcome of storing a single uploaded file:
+type uploadResult struct {
+	FileName string `json:"fileName"`
+	ID       int64  `json:"id,omitempty"`
+	Base62ID string `json:"base62id,omitempty"`
+	Title    string `json:"title,omitempty"`
+	Error    string `json:"error,omitempty"`
+	Skipped  string `json:"skipped,omitempty"`
+}
+
+// Reads all multipart form values and saves all file parts to temporary files.
+// On error, any temporary files already written are removed.
+func receiveUploads(req *http.Request) (values map[string]string, files []*uploadedFile, werr *web.Error) {
+	if !web.IsMultipart(req) {
+		return nil, nil, web.AsError(fmt.Errorf("Upload request must be multipart form data"), http.StatusBadRequest)
+	}
+
+	reader, err := req.MultipartReader()
+	if werr = web.AsError(err, http.StatusBadRequest); werr != nil {
+		return nil, nil, werr
+	}
+
+	values = make(map[string]string)
+	files = make([]*uploadedFile, 0, 1)
+	defer func() {
+		if werr != nil {
+			removeUploads(files)
+			files = nil
+		}
+	}()
+
+	// Keep reading the multipart form data and handle file uploads:
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if werr = web.AsError(err, http.StatusBadRequest); werr != nil {
+			return
+		}
+
+		// Parse normal form values:
+		if part.FileName() == "" {
+			t, err := ioutil.ReadAll(part)
+			if werr = web.AsError(err, http.StatusInternalServerError); werr != nil {
+				return
+			}
+			values[part.FormName()] = string(t)
+			continue
+		}
+
+		// Copy upload data to a local file:
+		os.MkdirAll(tmp_folder(), 0755)
+		f, err := TempFile(tmp_folder(), "up-", path.Ext(part.FileName()))
+		if werr = web.AsError(err, http.StatusInternalServerError); werr != nil {
+			return
+		}
+		files = append(files, &uploadedFile{
+			FieldName: part.FormName(),
+			FileName:  part.FileName(),
+			LocalPath: f.Name(),
+		})
+
+		_, err = io.Copy(f, part)
+		f.Close()
+		if werr = web.AsError(err, http.StatusInternalServerError); werr != nil {
+			return
+		}
+	}
+
+	return values, files, nil
+}
+
+// Removes any temporary files that were not moved into the store:
+func removeUploads(files []*uploadedFile) {
+	for _, f := range files {
+		os.Remove(f.LocalPath)
+	}
+}
+
+// Looks up a per-file form value, e.g. `title.file2` or `title.cat.gif`, falling back to the shared value:
+func uploadValue(values map[string]string, name string, f *uploadedFile, shared bool) string {
+	if v, ok := values[name+"."+f.FieldName]; ok {
+		return v
+	}
+	if v, ok := values[name+"."+f.FileName]; ok {
+		return v
+	}
+	if shared {
+		return values[name]
+	}
+	return ""
+}
+
+// Poster images for videos are sent as `poster.<field or file name>`, or as `poster` alone for every video:
+func isPosterUpload(f *uploadedFile) bool {
+	return f.FieldName == "poster" || strings.HasPrefix(f.FieldName, "poster.")
+}
+
+func posterFor(files []*uploadedFile, f *uploadedFile) *uploadedFile {
+	var shared *uploadedFile
+	for _, p := range files {
+		switch p.FieldName {
+		case "poster." + f.FieldName, "poster." + f.FileName:
+			return p
+		case "poster":
+			shared = p
+		}
+	}
+	return shared
+}
+
+// Stores each uploaded file as its own image:
+func storeUploads(collectionName, submitter string, values map[string]string, files []*uploadedFile) (results []uploadResult) {
+	defer removeUploads(files)
+
+	// Images are clean unless nsfw=1 is supplied in form:
+	isClean := values["nsfw"] != "1"
+
+	media := 0
+	for _, f := range files {
+		if !isPosterUpload(f) {
+			media++
+		}
+	}
+
+	results = make([]uploadResult, 0, len(files))
+	for _, f := range files {
+		if isPosterUpload(f) {
+			continue
+		}
+
+		store := &imageStoreRequest{
+			CollectionName: collectionName,
+			Submitter:      submitter,
+			SourceURL:      "file://" + f.FileName,
+			Title:          uploadValue(values, "title", f, false),
+			Keywords:       strings.ToLower(uploadValue(values, "keywords", f, true)),
+			IsClean:        isClean,
+		}
+		if nsfw, ok := values["nsfw."+f.FieldName]; ok {
+			store.IsClean = nsfw != "1"
+		}
+		if store.Title == "" {
+			store.Title = f.Title
+		}
+		if store.Title == "" && media == 1 {
+			// A shared title only makes sense for a single file:
+			store.Title = values["title"]
+		}
+		if store.Title == "" {
+			store.Title = filenameToTitle(f.FileName)
+		}
+		if f.Keywords != "" {
+			store.Keywords = strings.TrimSpace(store.Keywords + " " + f.Keywords)
+		}
+
+		local_path := f.LocalPath
+		poster := posterFor(files, f)
+		store.PostCreation = func(id int64, newImage *Image) *web.Error {
+			if werr := moveFiles(local_path, id, newImage); werr != nil {
+				return werr
+			}
+			if poster != nil && (newImage.Kind == "mp4" || newImage.Kind == "webm") {
+				return storePoster(id, newImage.Kind, poster.LocalPath)
+			}
+			return nil
+		}
+
+		// Store it in the database and generate thumbnail:
+		result := uploadResult{FileName: f.FileName, Title: store.Title}
+		id, werr := storeImage(store)
+		if werr != nil {
+			result.Error = werr.Error.Error()
+		} else {
+			result.ID = id
+			result.Base62ID = b62.Encode(id + 10000)
+		}
+		results = append(results, result)
+	}
+
+	return results
+}
+
+func wantsJSON(req *http.Request) bool {
+	return strings.Contains(req.Header.Get("Accept"), "application/json")
+}
+
+// Responds with the outcome of an upload as JSON, a redirect to the single new image, or a result page:
+func respondUploads(rsp http.ResponseWriter, req *http.Request, results []uploadResult) *web.Error {
+	if wantsJSON(req) {
+		web.JsonSuccess(rsp, &struct {
+			Results []uploadResult `json:"results"`
+		}{
+			Results: results,
+		})
+		return nil
+	}
+
+	if len(results) == 1 && results[0].Skipped == "" {
+		if results[0].Error != "" {
+			return web.AsError(fmt.Errorf("%s", results[0].Error), http.StatusBadRequest).AsHTML()
+		}
+
+		// Redirect to a black-background view of the image:
+		redir_url := path.Join("/b/", results[0].Base62ID)
+		http.Redirect(rsp, req, redir_url, http.StatusFound)
+		return nil
+	}
+
+	return renderResults(rsp, "Uploaded Images", results)
+}
+
+// Renders a page of per-image results under the given heading:
+func renderResults(rsp http.ResponseWriter, heading string, results []uploadResult) *web.Error {
+	model := struct {
+		Heading string
+		Results []uploadResult
+	}{
+		Heading: heading,
+		Results: results,
+	}
+
+	rsp.Header().Set("Content-Type", "text/html; charset=utf-8")
+	rsp.WriteHeader(200)
+	if werr := web.AsError(uiTmpl.ExecuteTemplate(rsp, "uploaded", model), http.StatusInternalServerError); werr != nil {
+		return werr.AsHTML()
+	}
+	return nil
+}
+
+// JSON form of a script upload carrying its image as a data URI:
+type dataURIUpload struct {
+	Title    string `json:"title"`
+	Keywords string `json:"keywords"`
+	NSFW     bool   `json:"nsfw"`
+	FileName string `json:"filename"`
+	Data     string `json:"data"`
+}
+
+// Decodes a base64 data URI, e.g. `data:image/png;base64,iVBORw0KGgo...`:
+func decodeDataURI(uri string) (mimeType string, data []byte, err error) {
+	if !strings.HasPrefix(uri, "data:") {
+		return "", nil, fmt.Errorf("Expected a data URI")
+	}
+	comma := strings.IndexByte(uri, ',')
+	if comma < 0 {
+		return "", nil, fmt.Errorf("Malformed data URI")
+	}
+
+	params := strings.Split(uri[len("data:"):comma], ";")
+	if params[len(params)-1] != "base64" {
+		return "", nil, fmt.Errorf("Only base64 data URIs are supported")
+	}
+	mimeType = strings.ToLower(params[0])
+
+	data, err = base64.StdEncoding.DecodeString(uri[comma+1:])
+	if err != nil {
+		return "", nil, err
+	}
+	return mimeType, data, nil
+}
+
+// Largest request body accepted by storeRawUpload; JSON bodies are held in memory while decoding:
+var rawUploadMaxSize = int64(64 << 20)
+
+// Reports a read past the limit of http.MaxBytesReader:
+func isRequestTooLarge(err error) bool {
+	return err != nil && err.Error() == "http: request body too large"
+}
+
+// Reads a header value falling back to a query value, e.g. `X-Title` or `?title=`:
+func headerOrQuery(req *http.Request, header, name string) string {
+	if v := req.Header.Get(header); v != "" {
+		return v
+	}
+	return req.URL.Query().Get(name)
+}
+
+// Stores an image sent by a script either as the raw request body with an image Content-Type
+// (title, keywords, nsfw and filename in the query or `X-Title`, `X-Keywords`, `X-NSFW` and `X-Filename` headers)
+// or as JSON carrying a data URI.
+func storeRawUpload(req *http.Request, collectionName string) (id int64, werr *web.Error) {
+	store := &imageStoreRequest{
+		CollectionName: collectionName,
+		Submitter:      req.RemoteAddr,
+	}
+
+	req.Body = http.MaxBytesReader(nil, req.Body, rawUploadMaxSize)
+	tooLarge := web.AsError(fmt.Errorf("Upload is larger than %d bytes", rawUploadMaxSize), http.StatusRequestEntityTooLarge)
+
+	var body io.Reader
+	var fileName string
+	contentType := strings.ToLower(strings.TrimSpace(strings.Split(req.Header.Get("Content-Type"), ";")[0]))
+	if contentType == "application/json" {
+		upload := &dataURIUpload{}
+		err := json.NewDecoder(req.Body).Decode(upload)
+		if isRequestTooLarge(err) {
+			return 0, tooLarge
+		}
+		if werr = web.AsError(err, http.StatusBadRequest); werr != nil {
+			return 0, werr
+		}
+
+		mimeType, data, err := decodeDataURI(upload.Data)
+		if werr = web.AsError(err, http.StatusBadRequest); werr != nil {
+			return 0, werr
+		}
+		contentType = mimeType
+		body = bytes.NewReader(data)
+
+		store.Title = upload.Title
+		store.Keywords = strings.ToLower(upload.Keywords)
+		store.IsClean = !upload.NSFW
+		fileName = upload.FileName
+	} else {
+		body = req.Body
+
+		store.Title = headerOrQuery(req, "X-Title", "title")
+		store.Keywords = strings.ToLower(headerOrQuery(req, "X-Keywords", "keywords"))
+		store.IsClean = headerOrQuery(req, "X-NSFW", "nsfw") != "1"
+		fileName = headerOrQuery(req, "X-Filename", "filename")
+	}
+
+	if !isStorableType(contentType) {
+		return 0, web.AsError(fmt.Errorf("Content-Type '%s' is not an image or video type", contentType), http.StatusUnsupportedMediaType)
+	}
+	if store.Title == "" {
+		store.Title = filenameToTitle(fileName)
+	}
+	store.SourceURL = "file://" + fileName
+
+	// Copy upload data to a local file:
+	os.MkdirAll(tmp_folder(), 0755)
+	f, err := TempFile(tmp_folder(), "up-", path.Ext(fileName))
+	if werr = web.AsError(err, http.StatusInternalServerError); werr != nil {
+		return 0, werr
+	}
+	local_path := f.Name()
+	defer os.Remove(local_path)
+
+	_, err = io.Copy(f, body)
+	f.Close()
+	if isRequestTooLarge(err) {
+		return 0, tooLarge
+	}
+	if werr = web.AsError(err, http.StatusInternalServerError); werr != nil {
+		return 0, werr
+	}
+
+	store.PostCreation = func(id int64, newImage *Image) *web.Error {
+		return moveFiles(local_path, id, newImage)
+	}
+	return storeImage(store)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+func Test_receiveUploads(t *testing.T) {
+	_, done := withTempStore(t)
+	defer done()
+
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	w, _ := mw.CreateFormFile("file", "first.gif")
+	w.Write([]byte("GIF89a"))
+	w, _ = mw.CreateFormFile("file", "second.png")
+	w.Write([]byte("\x89PNG"))
+	mw.WriteField("title.second.png", "The second one")
+	mw.WriteField("keywords", "shared words")
+	mw.Close()
+
+	req, _ := http.NewRequest("POST", "/col/upload", body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+
+	values, files, werr := receiveUploads(req)
+	if werr != nil {
+		t.Fatal(werr.Error)
+	}
+	defer removeUploads(files)
+
+	if len(files) != 2 {
+		t.Fatalf("expected 2 files, got %d", len(files))
+	}
+	for _, f := range files {
+		if _, err := os.Stat(f.LocalPath); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if title := uploadValue(values, "title", files[0], false); title != "" {
+		t.Errorf("first title = %q", title)
+	}
+	if title := uploadValue(values, "title", files[1], false); title != "The second one" {
+		t.Errorf("second title = %q", title)
+	}
+	if keywords := uploadValue(values, "keywords", files[0], true); keywords != "shared words" {
+		t.Errorf("keywords = %q", keywords)
+	}
+}
+
+func Test_decodeDataURI(t *testing.T) {
+	mimeType, data, err := decodeDataURI("data:image/gif;base64,R0lGODlh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mimeType != "image/gif" || string(data) != "GIF89a" {
+		t.Errorf("got %q %q", mimeType, data)
+	}
+
+	if _, _, err = decodeDataURI("data:image/gif,GIF89a"); err == nil {
+		t.Error("expected error for non-base64 data URI")
+	}
+}
+
+func Test_storeRawUpload_tooLarge(t *testing.T) {
+	_, done := withTempStore(t)
+	defer done()
+	defer func(old int64) { rawUploadMaxSize = old }(rawUploadMaxSize)
+	rawUploadMaxSize = 16
+
+	// Both the JSON body and a raw body are cut off at the limit:
+	body := `{"title": "cat", "data": "data:image/gif;base64,R0lGODlhR0lGODlhR0lGODlh"}`
+	req, _ := http.NewRequest("POST", "/api/v1/upload", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if _, werr := storeRawUpload(req, ""); werr == nil || werr.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected a large JSON upload to be refused with 413, got %v", werr)
+	}
+
+	req, _ = http.NewRequest("POST", "/api/v1/upload?title=cat", bytes.NewReader(make([]byte, 64)))
+	req.Header.Set("Content-Type", "image/png")
+	if _, werr := storeRawUpload(req, ""); werr == nil || werr.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected a large raw upload to be refused with 413, got %v", werr)
+	}
+}
+
+// Points base_folder at a new temporary directory; done removes it and restores base_folder:
+func withTempStore(t *testing.T) (dir string, done func()) {
+	dir, err := ioutil.TempDir("", "i2-host-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := base_folder
+	base_folder = dir
+	return dir, func() {
+		base_folder = old
+		os.RemoveAll(dir)
+	}
+}
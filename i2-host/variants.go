@@ -0,0 +1,250 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+import (
+	"github.com/JamesDunne/go-util/imaging"
+	"github.com/JamesDunne/go-util/web"
+)
+
+// Resized variants are served at /s/<size>/<base62>.<ext> and cached under sized/<size>/.
+// Sizes are given as "<w>x<h>" to fit within a box, "<w>x<h>-fill" to fill a box by cropping the
+// middle, or "<w>x" for a width alone. Variants are never larger than the original.
+
+// Sizes that may be requested; anything else is refused so the cache cannot grow without bound:
+var variantSizes = "200x,400x,800x,1200x,400x300,800x600,200x200-fill,400x400-fill"
+
+type variantSpec struct {
+	Width  int
+	Height int
+	Fill   bool
+}
+
+// Parses a size from the allowlist:
+func parseVariantSpec(size string) (spec variantSpec, ok bool) {
+	allowed := false
+	for _, s := range strings.Split(variantSizes, ",") {
+		if strings.TrimSpace(s) == size {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return spec, false
+	}
+
+	dims := size
+	if strings.HasSuffix(dims, "-fill") {
+		spec.Fill = true
+		dims = strings.TrimSuffix(dims, "-fill")
+	}
+	x := strings.Index(dims, "x")
+	if x < 0 {
+		return spec, false
+	}
+	var err error
+	if spec.Width, err = strconv.Atoi(dims[:x]); err != nil || spec.Width <= 0 {
+		return spec, false
+	}
+	if dims[x+1:] != "" {
+		if spec.Height, err = strconv.Atoi(dims[x+1:]); err != nil || spec.Height <= 0 {
+			return spec, false
+		}
+	}
+	if spec.Fill && spec.Height == 0 {
+		return spec, false
+	}
+	return spec, true
+}
+
+// Works out which part of a w by h image to use and the size to scale it to:
+func (spec variantSpec) geometry(w, h int) (src image.Rectangle, out image.Point) {
+	src = image.Rect(0, 0, w, h)
+	scale := func(f float64) image.Point {
+		if f > 1 {
+			f = 1
+		}
+		out := image.Pt(int(float64(src.Dx())*f+0.5), int(float64(src.Dy())*f+0.5))
+		if out.X < 1 {
+			out.X = 1
+		}
+		if out.Y < 1 {
+			out.Y = 1
+		}
+		return out
+	}
+
+	switch {
+	case spec.Fill:
+		// Crop the middle to the box's aspect ratio:
+		if w*spec.Height > h*spec.Width {
+			cw := h * spec.Width / spec.Height
+			src = image.Rect((w-cw)/2, 0, (w-cw)/2+cw, h)
+		} else {
+			ch := w * spec.Height / spec.Width
+			src = image.Rect(0, (h-ch)/2, w, (h-ch)/2+ch)
+		}
+		return src, scale(float64(spec.Width) / float64(src.Dx()))
+	case spec.Height == 0:
+		return src, scale(float64(spec.Width) / float64(w))
+	default:
+		fw, fh := float64(spec.Width)/float64(w), float64(spec.Height)/float64(h)
+		if fh < fw {
+			fw = fh
+		}
+		return src, scale(fw)
+	}
+}
+
+func resizeVariant(img image.Image, src image.Rectangle, out image.Point) image.Image {
+	src = src.Add(img.Bounds().Min)
+	if src == img.Bounds() && out == src.Size() {
+		return img
+	}
+	return imaging.Resize(imaging.SubImageKind(img, src), out.X, out.Y, imaging.Lanczos)
+}
+
+// Renders a resized variant of a stored image to a temporary file:
+func renderVariant(local_path, ext string, spec variantSpec) (tmp_output string, err error) {
+	tmpf, err := TempFile(tmp_folder(), "sized-", ext)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		tmpf.Close()
+		if err != nil {
+			os.Remove(tmpf.Name())
+		}
+	}()
+
+	if ext == ".gif" {
+		// Resize every displayed frame as it is read to keep the animation:
+		comp, done, err := openGIFStream(local_path)
+		if err != nil {
+			return "", err
+		}
+		defer done()
+
+		src, out := spec.geometry(comp.screen.Dx(), comp.screen.Dy())
+		err = encodeGIFCanvases(tmpf, comp.LoopCount(), out, func() (*image.RGBA, int) {
+			canvas, delay := comp.Next()
+			if canvas == nil {
+				return nil, 0
+			}
+			resized := resizeVariant(canvas, src, out)
+			frame := image.NewRGBA(image.Rectangle{Max: out})
+			draw.Draw(frame, frame.Rect, resized, resized.Bounds().Min, draw.Src)
+			limitColors(frame, nil)
+			return frame, delay
+		})
+		if err == nil {
+			err = comp.Err()
+		}
+		if err != nil {
+			return "", err
+		}
+		return tmpf.Name(), nil
+	}
+
+	img, _, release, err := decodeFirstImage(local_path)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+	b := img.Bounds()
+	src, out := spec.geometry(b.Dx(), b.Dy())
+	img = resizeVariant(img, src, out)
+
+	switch ext {
+	case ".jpg":
+		err = jpeg.Encode(tmpf, img, &jpeg.Options{Quality: 100})
+	case ".png":
+		err = png.Encode(tmpf, img)
+	default:
+		err = fmt.Errorf("Cannot resize '%s' images", ext)
+	}
+	if err != nil {
+		return "", err
+	}
+	return tmpf.Name(), nil
+}
+
+// Renders a variant into the cache unless it is already there:
+func ensureVariant(local_path, variant_path, ext string, spec variantSpec) error {
+	if _, err := os.Stat(variant_path); err == nil {
+		return nil
+	}
+
+	tmp_output, err := renderVariant(local_path, ext, spec)
+	if err != nil {
+		return err
+	}
+	os.MkdirAll(path.Dir(variant_path), 0755)
+	if err = os.Rename(tmp_output, variant_path); err != nil {
+		os.Remove(tmp_output)
+		return err
+	}
+	return nil
+}
+
+// Removes all cached variants of an image:
+func removeVariants(id int64) {
+	files, _ := filepath.Glob(path.Join(sized_folder(), "*", strconv.FormatInt(id, 10)+".*"))
+	for _, f := range files {
+		os.Remove(f)
+	}
+}
+
+// Serves a resized variant of an image, e.g. `/s/400x/2Bc.jpg`:
+func serveVariant(rsp http.ResponseWriter, req *http.Request, img *Image, size, req_ext string) *web.Error {
+	spec, ok := parseVariantSpec(size)
+	if !ok {
+		return web.AsError(fmt.Errorf("Size '%s' is not available", size), http.StatusNotFound)
+	}
+
+	_, ext, _ := imageKindTo(img.Kind)
+	if img.Kind == "imgur-gifv" {
+		// Resized from the GIF version:
+		ext = ".gif"
+	}
+	if req_ext != ext || (ext != ".jpg" && ext != ".png" && ext != ".gif") {
+		return web.AsError(fmt.Errorf("No resized variant for '%s'", req_ext), http.StatusNotFound)
+	}
+
+	img_name := strconv.FormatInt(img.ID, 10)
+	local_path := storePath(img.ID, ext)
+	variant_path := path.Join(sized_folder(), size, img_name+ext)
+	if !fileExists(local_path) {
+		return web.AsError(fmt.Errorf("Image file is missing"), http.StatusNotFound)
+	}
+	if werr := asDecodeError(ensureVariant(local_path, variant_path, ext, spec)); werr != nil {
+		return werr
+	}
+
+	mime := extToMimeType(ext)
+	if xrSized != "" {
+		// Pass request to nginx to serve static content file:
+		redirPath := path.Join(xrSized, size, img_name+ext)
+
+		rsp.Header().Set("X-Accel-Redirect", redirPath)
+		rsp.Header().Set("Content-Type", mime)
+		rsp.WriteHeader(200)
+		return nil
+	}
+
+	rsp.Header().Set("Content-Type", mime)
+	http.ServeFile(rsp, req, variant_path)
+	return nil
+}
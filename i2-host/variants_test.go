@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/gif"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func Test_variantGeometry(t *testing.T) {
+	tests := []struct {
+		size string
+		w, h int
+		src  image.Rectangle
+		out  image.Point
+	}{
+		{"400x", 1000, 500, image.Rect(0, 0, 1000, 500), image.Pt(400, 200)},
+		{"400x", 200, 100, image.Rect(0, 0, 200, 100), image.Pt(200, 100)},
+		{"400x300", 1000, 500, image.Rect(0, 0, 1000, 500), image.Pt(400, 200)},
+		{"400x300", 500, 1000, image.Rect(0, 0, 500, 1000), image.Pt(150, 300)},
+		{"200x200-fill", 1000, 500, image.Rect(250, 0, 750, 500), image.Pt(200, 200)},
+		{"200x200-fill", 100, 50, image.Rect(25, 0, 75, 50), image.Pt(50, 50)},
+	}
+	for _, test := range tests {
+		spec, ok := parseVariantSpec(test.size)
+		if !ok {
+			t.Fatalf("%s: expected size to be allowed", test.size)
+		}
+		src, out := spec.geometry(test.w, test.h)
+		if src != test.src || out != test.out {
+			t.Errorf("%s of %dx%d: expected %v to %v, got %v to %v", test.size, test.w, test.h, test.src, test.out, src, out)
+		}
+	}
+
+	for _, size := range []string{"401x", "x300", "../400x", "200x-fill"} {
+		if _, ok := parseVariantSpec(size); ok {
+			t.Errorf("%s: expected size to be refused", size)
+		}
+	}
+}
+
+func Test_serveVariant(t *testing.T) {
+	dir, done := withTempStore(t)
+	defer done()
+	defer func(old string) { xrSized = old }(xrSized)
+	xrSized = ""
+	os.MkdirAll(store_folder(), 0755)
+	os.MkdirAll(tmp_folder(), 0755)
+
+	f, _ := os.Create(storePath(1, ".png"))
+	png.Encode(f, image.NewRGBA(image.Rect(0, 0, 1000, 500)))
+	f.Close()
+
+	// An animated GIF keeps its frames and timing:
+	g := testAnimation()
+	f, _ = os.Create(storePath(2, ".gif"))
+	gif.EncodeAll(f, g)
+	f.Close()
+
+	get := func(img *Image, size, ext string) *httptest.ResponseRecorder {
+		rsp := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/s/"+size+"/x"+ext, nil)
+		if werr := serveVariant(rsp, req, img, size, ext); werr != nil {
+			rsp.Code = werr.StatusCode
+		}
+		return rsp
+	}
+
+	rsp := get(&Image{ID: 1, Kind: "png"}, "400x", ".png")
+	if rsp.Code != 200 {
+		t.Fatalf("expected 200, got %d", rsp.Code)
+	}
+	cfg, err := png.DecodeConfig(bytes.NewReader(rsp.Body.Bytes()))
+	if err != nil || cfg.Width != 400 || cfg.Height != 200 {
+		t.Errorf("unexpected variant %+v (%v)", cfg, err)
+	}
+	if !fileExists(dir + "/sized/400x/1.png") {
+		t.Errorf("variant was not cached")
+	}
+
+	rsp = get(&Image{ID: 2, Kind: "gif"}, "200x200-fill", ".gif")
+	if rsp.Code != 200 {
+		t.Fatalf("expected 200, got %d", rsp.Code)
+	}
+	out, err := gif.DecodeAll(bytes.NewReader(rsp.Body.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	total := 0
+	for _, d := range out.Delay {
+		total += d
+	}
+	if out.Config.Width != 16 || out.Config.Height != 16 || len(out.Image) < 2 || total != 105 || out.LoopCount != g.LoopCount {
+		t.Errorf("animation was not kept: %+v, %d frames lasting %dcs", out.Config, len(out.Image), total)
+	}
+
+	// Sizes outside the allowlist and mismatched extensions are refused:
+	if rsp = get(&Image{ID: 1, Kind: "png"}, "401x", ".png"); rsp.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unlisted size, got %d", rsp.Code)
+	}
+	if rsp = get(&Image{ID: 1, Kind: "png"}, "400x", ".jpg"); rsp.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for another extension, got %d", rsp.Code)
+	}
+
+	removeImageFiles(1)
+	if fileExists(dir + "/sized/400x/1.png") {
+		t.Errorf("variant was not removed with the image")
+	}
+}
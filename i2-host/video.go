@@ -0,0 +1,551 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+import "github.com/JamesDunne/go-util/web"
+
+// MP4 and WebM videos are stored as "mp4" and "webm" kinds. Their containers are parsed for
+// dimensions, duration and codec but frames are never decoded; thumbnails come from a poster
+// image stored beside the video as <id>.poster, or a placeholder when there is none.
+
+// Properties read from a video's container:
+type videoInfo struct {
+	Kind     string
+	Width    int
+	Height   int
+	Duration float64 // seconds
+	Codec    string
+}
+
+// How much of a WebM is read looking for its Info and Tracks elements, which precede the clusters:
+const webmHeadBytes = 4 << 20
+
+// Largest MP4 `moov` box read into memory:
+const mp4MaxMoovBytes = 64 << 20
+
+// Friendly names of codecs by MP4 sample entry type or Matroska CodecID:
+var videoCodecNames = map[string]string{
+	"avc1":            "h264",
+	"avc3":            "h264",
+	"hev1":            "hevc",
+	"hvc1":            "hevc",
+	"vp08":            "vp8",
+	"vp09":            "vp9",
+	"av01":            "av1",
+	"mp4v":            "mpeg4",
+	"V_VP8":           "vp8",
+	"V_VP9":           "vp9",
+	"V_AV1":           "av1",
+	"V_MPEG4/ISO/AVC": "h264",
+}
+
+// Detects a video container from a file's first bytes, returning its kind:
+func sniffVideo(head []byte) string {
+	if len(head) >= 8 && string(head[4:8]) == "ftyp" {
+		return "mp4"
+	}
+	if bytes.HasPrefix(head, []byte{0x1A, 0x45, 0xDF, 0xA3}) {
+		return "webm"
+	}
+	return ""
+}
+
+func sniffVideoFile(local_path string) string {
+	f, err := os.Open(local_path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	head := make([]byte, 12)
+	n, _ := io.ReadFull(f, head)
+	return sniffVideo(head[:n])
+}
+
+// Reads a video's properties from its container:
+func getVideoInfo(local_path string) (info *videoInfo, err error) {
+	f, err := os.Open(local_path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	head := make([]byte, 12)
+	n, _ := io.ReadFull(f, head)
+	if _, err = f.Seek(0, 0); err != nil {
+		return nil, err
+	}
+
+	switch sniffVideo(head[:n]) {
+	case "mp4":
+		info, err = parseMP4(f)
+	case "webm":
+		info, err = parseWebM(io.LimitReader(f, webmHeadBytes))
+	default:
+		return nil, fmt.Errorf("Not a video")
+	}
+	if err != nil {
+		return nil, &imageLimitError{msg: "Unrecognized or corrupt video: " + err.Error(), statusCode: http.StatusUnprocessableEntity}
+	}
+	return info, nil
+}
+
+// Walks ISO-BMFF boxes, calling fn with each box's type and contents:
+func walkMP4Boxes(data []byte, fn func(typ string, body []byte) error) error {
+	for len(data) >= 8 {
+		size := uint64(binary.BigEndian.Uint32(data[0:4]))
+		typ := string(data[4:8])
+		hdr := uint64(8)
+		switch size {
+		case 0:
+			// Extends to the end of the parent:
+			size = uint64(len(data))
+		case 1:
+			if len(data) < 16 {
+				return fmt.Errorf("truncated box '%s'", typ)
+			}
+			size = binary.BigEndian.Uint64(data[8:16])
+			hdr = 16
+		}
+		if size < hdr || size > uint64(len(data)) {
+			return fmt.Errorf("box '%s' has an invalid size", typ)
+		}
+		if err := fn(typ, data[hdr:size]); err != nil {
+			return err
+		}
+		data = data[size:]
+	}
+	return nil
+}
+
+// Reads the movie header and first video track of an MP4:
+func parseMP4(r io.ReadSeeker) (*videoInfo, error) {
+	// Skip top-level boxes (chiefly `mdat`) until `moov`:
+	var moov []byte
+	for moov == nil {
+		var hdr [16]byte
+		if _, err := io.ReadFull(r, hdr[:8]); err != nil {
+			if err == io.EOF {
+				return nil, fmt.Errorf("no 'moov' box")
+			}
+			return nil, err
+		}
+		size := int64(binary.BigEndian.Uint32(hdr[0:4]))
+		typ := string(hdr[4:8])
+		hdrSize := int64(8)
+		if size == 1 {
+			if _, err := io.ReadFull(r, hdr[8:16]); err != nil {
+				return nil, err
+			}
+			size = int64(binary.BigEndian.Uint64(hdr[8:16]))
+			hdrSize = 16
+		}
+		if size == 0 && typ != "moov" {
+			return nil, fmt.Errorf("no 'moov' box")
+		}
+		if size != 0 && size < hdrSize {
+			return nil, fmt.Errorf("box '%s' has an invalid size", typ)
+		}
+
+		if typ != "moov" {
+			if _, err := r.Seek(size-hdrSize, io.SeekCurrent); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if size == 0 || size-hdrSize > mp4MaxMoovBytes {
+			return nil, fmt.Errorf("'moov' box is too large")
+		}
+		moov = make([]byte, size-hdrSize)
+		if _, err := io.ReadFull(r, moov); err != nil {
+			return nil, err
+		}
+	}
+
+	info := &videoInfo{Kind: "mp4"}
+	found := false
+	err := walkMP4Boxes(moov, func(typ string, body []byte) error {
+		switch typ {
+		case "mvhd":
+			if len(body) >= 20 && body[0] == 0 {
+				if timescale := binary.BigEndian.Uint32(body[12:16]); timescale > 0 {
+					info.Duration = float64(binary.BigEndian.Uint32(body[16:20])) / float64(timescale)
+				}
+			} else if len(body) >= 32 && body[0] == 1 {
+				if timescale := binary.BigEndian.Uint32(body[20:24]); timescale > 0 {
+					info.Duration = float64(binary.BigEndian.Uint64(body[24:32])) / float64(timescale)
+				}
+			}
+		case "trak":
+			if found {
+				return nil
+			}
+			track, err := parseMP4Track(body)
+			if err != nil {
+				return err
+			}
+			if track != nil {
+				info.Width, info.Height, info.Codec = track.Width, track.Height, track.Codec
+				found = true
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("no video track")
+	}
+	return info, nil
+}
+
+// Reads a track's dimensions and codec, or returns nil if it is not a video track:
+func parseMP4Track(trak []byte) (*videoInfo, error) {
+	track := &videoInfo{}
+	handler := ""
+
+	var walk func(typ string, body []byte) error
+	walk = func(typ string, body []byte) error {
+		switch typ {
+		case "mdia", "minf", "stbl":
+			return walkMP4Boxes(body, walk)
+		case "tkhd":
+			// Display size in 16.16 fixed point follows the matrix:
+			off := 76
+			if len(body) > 0 && body[0] == 1 {
+				off = 88
+			}
+			if len(body) >= off+8 {
+				track.Width = int(binary.BigEndian.Uint32(body[off:]) >> 16)
+				track.Height = int(binary.BigEndian.Uint32(body[off+4:]) >> 16)
+			}
+		case "hdlr":
+			if len(body) >= 12 {
+				handler = string(body[8:12])
+			}
+		case "stsd":
+			// The first sample entry names the codec and has the coded size of a visual sample:
+			if len(body) >= 16 {
+				entry := body[8:]
+				fourcc := string(entry[4:8])
+				track.Codec = fourcc
+				if name, ok := videoCodecNames[fourcc]; ok {
+					track.Codec = name
+				}
+				if len(entry) >= 36 && (track.Width == 0 || track.Height == 0) {
+					track.Width = int(binary.BigEndian.Uint16(entry[32:34]))
+					track.Height = int(binary.BigEndian.Uint16(entry[34:36]))
+				}
+			}
+		}
+		return nil
+	}
+	if err := walkMP4Boxes(trak, walk); err != nil {
+		return nil, err
+	}
+
+	if handler != "vide" {
+		return nil, nil
+	}
+	return track, nil
+}
+
+// Reads an EBML variable-length integer; IDs keep their length marker bits, sizes do not.
+// An all-ones size means the size is unknown.
+func ebmlVint(b []byte, keepMarker bool) (v uint64, n int, unknown bool, err error) {
+	if len(b) == 0 || b[0] == 0 {
+		return 0, 0, false, fmt.Errorf("invalid EBML integer")
+	}
+	n = 1
+	for mask := byte(0x80); b[0]&mask == 0; mask >>= 1 {
+		n++
+	}
+	if len(b) < n {
+		return 0, 0, false, io.ErrUnexpectedEOF
+	}
+
+	v = uint64(b[0])
+	if !keepMarker {
+		v &= uint64(0xFF >> uint(n))
+	}
+	for _, c := range b[1:n] {
+		v = v<<8 | uint64(c)
+	}
+	unknown = !keepMarker && v == (uint64(1)<<uint(7*n))-1
+	return v, n, unknown, nil
+}
+
+// Walks EBML elements, calling fn with each element's ID and contents. Elements running past
+// the data, e.g. a Segment of which only the head was read, are cut short.
+func walkEBML(data []byte, fn func(id uint64, body []byte) (stop bool, err error)) error {
+	for len(data) > 0 {
+		id, n, _, err := ebmlVint(data, true)
+		if err != nil {
+			return err
+		}
+		size, m, unknown, err := ebmlVint(data[n:], false)
+		if err != nil {
+			return err
+		}
+		data = data[n+m:]
+
+		body := data
+		if !unknown && size < uint64(len(data)) {
+			body = data[:size]
+		}
+		stop, err := fn(id, body)
+		if err != nil || stop {
+			return err
+		}
+		data = data[len(body):]
+	}
+	return nil
+}
+
+func ebmlUint(b []byte) uint64 {
+	v := uint64(0)
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
+
+func ebmlFloat(b []byte) float64 {
+	switch len(b) {
+	case 4:
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b)))
+	case 8:
+		return math.Float64frombits(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+// EBML element IDs read from WebM files:
+const (
+	ebmlHeaderID     = 0x1A45DFA3
+	ebmlDocTypeID    = 0x4282
+	ebmlSegmentID    = 0x18538067
+	ebmlInfoID       = 0x1549A966
+	ebmlTimecodeID   = 0x2AD7B1
+	ebmlDurationID   = 0x4489
+	ebmlTracksID     = 0x1654AE6B
+	ebmlTrackEntryID = 0xAE
+	ebmlTrackTypeID  = 0x83
+	ebmlCodecID      = 0x86
+	ebmlVideoID      = 0xE0
+	ebmlWidthID      = 0xB0
+	ebmlHeightID     = 0xBA
+	ebmlClusterID    = 0x1F43B675
+)
+
+// Reads the segment info and first video track of a WebM:
+func parseWebM(r io.Reader) (*videoInfo, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &videoInfo{Kind: "webm"}
+	docType := ""
+	timecodeScale := uint64(1000000)
+	duration := 0.0
+	found := false
+
+	err = walkEBML(data, func(id uint64, body []byte) (bool, error) {
+		switch id {
+		case ebmlHeaderID:
+			return false, walkEBML(body, func(id uint64, body []byte) (bool, error) {
+				if id == ebmlDocTypeID {
+					docType = string(bytes.TrimRight(body, "\x00"))
+				}
+				return false, nil
+			})
+		case ebmlSegmentID:
+			return true, walkEBML(body, func(id uint64, body []byte) (bool, error) {
+				switch id {
+				case ebmlInfoID:
+					return false, walkEBML(body, func(id uint64, body []byte) (bool, error) {
+						switch id {
+						case ebmlTimecodeID:
+							timecodeScale = ebmlUint(body)
+						case ebmlDurationID:
+							duration = ebmlFloat(body)
+						}
+						return false, nil
+					})
+				case ebmlTracksID:
+					return false, walkEBML(body, func(id uint64, body []byte) (bool, error) {
+						if id != ebmlTrackEntryID || found {
+							return false, nil
+						}
+						track := parseWebMTrack(body)
+						if track != nil {
+							info.Width, info.Height, info.Codec = track.Width, track.Height, track.Codec
+							found = true
+						}
+						return false, nil
+					})
+				case ebmlClusterID:
+					// Media data; everything we need comes before it:
+					return true, nil
+				}
+				return false, nil
+			})
+		}
+		return false, nil
+	})
+	if err != nil && !found {
+		return nil, err
+	}
+
+	if docType != "webm" && docType != "matroska" {
+		return nil, fmt.Errorf("unsupported document type '%s'", docType)
+	}
+	if !found {
+		return nil, fmt.Errorf("no video track")
+	}
+	info.Duration = duration * float64(timecodeScale) / 1e9
+	return info, nil
+}
+
+// Reads a track entry's dimensions and codec, or returns nil if it is not a video track:
+func parseWebMTrack(entry []byte) *videoInfo {
+	track := &videoInfo{}
+	trackType := uint64(0)
+	walkEBML(entry, func(id uint64, body []byte) (bool, error) {
+		switch id {
+		case ebmlTrackTypeID:
+			trackType = ebmlUint(body)
+		case ebmlCodecID:
+			track.Codec = string(bytes.TrimRight(body, "\x00"))
+			if name, ok := videoCodecNames[track.Codec]; ok {
+				track.Codec = name
+			}
+		case ebmlVideoID:
+			walkEBML(body, func(id uint64, body []byte) (bool, error) {
+				switch id {
+				case ebmlWidthID:
+					track.Width = int(ebmlUint(body))
+				case ebmlHeightID:
+					track.Height = int(ebmlUint(body))
+				}
+				return false, nil
+			})
+		}
+		return false, nil
+	})
+
+	// Track type 1 is video:
+	if trackType != 1 {
+		return nil
+	}
+	return track
+}
+
+// Draws a play symbol on a dark background with a video's aspect ratio, for videos without a poster:
+func videoPlaceholder(w, h int) image.Image {
+	size := 2 * thumbnail_dimensions
+	if w <= 0 || h <= 0 {
+		w, h = size, size
+	}
+	if w >= h {
+		w, h = size, (h*size+w/2)/w
+	} else {
+		w, h = (w*size+h/2)/h, size
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	bg, fg := color.RGBA{0x20, 0x20, 0x20, 0xff}, color.RGBA{0xe0, 0xe0, 0xe0, 0xff}
+
+	// A triangle pointing right, a quarter of the shorter side across:
+	r := float64(w)
+	if h < w {
+		r = float64(h)
+	}
+	r /= 4
+	cx, cy := float64(w)/2, float64(h)/2
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			dx, dy := float64(x)+0.5-cx+r/3, math.Abs(float64(y)+0.5-cy)
+			if dx >= 0 && dx <= r && dy <= (r-dx)*0.6 {
+				img.SetRGBA(x, y, fg)
+			} else {
+				img.SetRGBA(x, y, bg)
+			}
+		}
+	}
+	return img
+}
+
+// Path of the poster image kept beside a stored video:
+func posterPath(video_path string) string {
+	return strings.TrimSuffix(video_path, path.Ext(video_path)) + ".poster"
+}
+
+// Decodes the image standing in for a video's first frame; release as for decodeFirstImage:
+func decodeVideoPoster(video_path string) (poster image.Image, release func(), err error) {
+	poster_path := posterPath(video_path)
+	if fileExists(poster_path) {
+		poster, _, release, err = decodeFirstImage(poster_path)
+		return poster, release, err
+	}
+
+	info, err := getVideoInfo(video_path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return videoPlaceholder(info.Width, info.Height), func() {}, nil
+}
+
+// Stores a poster image for a stored video and regenerates its thumbnail from it:
+func storePoster(id int64, imageKind, poster_path string) *web.Error {
+	if imageKind != "mp4" && imageKind != "webm" {
+		return web.AsError(fmt.Errorf("Only videos have posters"), http.StatusBadRequest)
+	}
+
+	// The poster must be an image we can thumbnail:
+	_, kind, release, err := decodeFirstImage(poster_path)
+	if werr := asDecodeError(err); werr != nil {
+		return werr
+	}
+	release()
+	if kind == "mp4" || kind == "webm" {
+		return web.AsError(fmt.Errorf("Poster must be an image"), http.StatusBadRequest)
+	}
+
+	_, ext, thumbExt := imageKindTo(imageKind)
+	video_path := storePath(id, ext)
+	// Copied rather than moved since one poster may be shared by several uploaded videos:
+	data, err := ioutil.ReadFile(poster_path)
+	if werr := web.AsError(err, http.StatusInternalServerError); werr != nil {
+		return werr
+	}
+	if werr := web.AsError(ioutil.WriteFile(posterPath(video_path), data, 0644), http.StatusInternalServerError); werr != nil {
+		return werr
+	}
+
+	thumb_path := path.Join(thumb_folder(), strconv.FormatInt(id, 10)+thumbExt)
+	os.Remove(thumb_path)
+	return asDecodeError(ensureThumbnail(video_path, thumb_path))
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"testing"
+)
+
+func mp4Box(typ string, parts ...[]byte) []byte {
+	body := bytes.Join(parts, nil)
+	b := make([]byte, 8, 8+len(body))
+	binary.BigEndian.PutUint32(b, uint32(8+len(body)))
+	copy(b[4:], typ)
+	return append(b, body...)
+}
+
+// Builds an MP4 with an audio track followed by a video track, with `mdat` before `moov`:
+func testMP4(w, h int, timescale, duration uint32, codec string) []byte {
+	mvhd := make([]byte, 100)
+	binary.BigEndian.PutUint32(mvhd[12:], timescale)
+	binary.BigEndian.PutUint32(mvhd[16:], duration)
+
+	track := func(handler string, w, h int, entry string) []byte {
+		tkhd := make([]byte, 84)
+		binary.BigEndian.PutUint32(tkhd[76:], uint32(w)<<16)
+		binary.BigEndian.PutUint32(tkhd[80:], uint32(h)<<16)
+		hdlr := make([]byte, 24)
+		copy(hdlr[8:], handler)
+		stsd := make([]byte, 8)
+		binary.BigEndian.PutUint32(stsd[4:], 1)
+		return mp4Box("trak",
+			mp4Box("tkhd", tkhd),
+			mp4Box("mdia",
+				mp4Box("hdlr", hdlr),
+				mp4Box("minf", mp4Box("stbl", mp4Box("stsd", stsd, mp4Box(entry, make([]byte, 78)))))))
+	}
+
+	return bytes.Join([][]byte{
+		mp4Box("ftyp", []byte("isom\x00\x00\x02\x00isomiso2avc1mp41")),
+		mp4Box("mdat", make([]byte, 1000)),
+		mp4Box("moov",
+			mp4Box("mvhd", mvhd),
+			track("soun", 0, 0, "mp4a"),
+			track("vide", w, h, codec)),
+	}, nil)
+}
+
+// Encodes an EBML element with an 8-byte size, or an unknown size if body is nil:
+func ebmlElement(id uint32, parts ...[]byte) []byte {
+	var b []byte
+	for shift := uint(24); shift > 0; shift -= 8 {
+		if id>>shift != 0 {
+			b = append(b, byte(id>>shift))
+		}
+	}
+	b = append(b, byte(id))
+
+	body := bytes.Join(parts, nil)
+	if parts == nil {
+		return append(b, 0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF)
+	}
+	size := make([]byte, 8)
+	binary.BigEndian.PutUint64(size, uint64(len(body)))
+	size[0] = 0x01
+	return append(append(b, size...), body...)
+}
+
+func testWebM(w, h int, durationMS float64, codec string) []byte {
+	duration := make([]byte, 8)
+	binary.BigEndian.PutUint64(duration, math.Float64bits(durationMS))
+
+	segment := bytes.Join([][]byte{
+		ebmlElement(ebmlInfoID,
+			ebmlElement(ebmlTimecodeID, []byte{0x0F, 0x42, 0x40}),
+			ebmlElement(ebmlDurationID, duration)),
+		ebmlElement(ebmlTracksID,
+			ebmlElement(ebmlTrackEntryID,
+				ebmlElement(ebmlTrackTypeID, []byte{2}),
+				ebmlElement(ebmlCodecID, []byte("A_OPUS"))),
+			ebmlElement(ebmlTrackEntryID,
+				ebmlElement(ebmlTrackTypeID, []byte{1}),
+				ebmlElement(ebmlCodecID, []byte(codec)),
+				ebmlElement(ebmlVideoID,
+					ebmlElement(ebmlWidthID, []byte{byte(w >> 8), byte(w)}),
+					ebmlElement(ebmlHeightID, []byte{byte(h >> 8), byte(h)})))),
+		ebmlElement(ebmlClusterID, make([]byte, 500)),
+	}, nil)
+
+	return append(
+		ebmlElement(ebmlHeaderID, ebmlElement(ebmlDocTypeID, []byte("webm"))),
+		append(ebmlElement(ebmlSegmentID), segment...)...)
+}
+
+func Test_getVideoInfo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "video")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name     string
+		data     []byte
+		expected videoInfo
+	}{
+		{"a.mp4", testMP4(640, 360, 600, 1500, "avc1"), videoInfo{Kind: "mp4", Width: 640, Height: 360, Duration: 2.5, Codec: "h264"}},
+		{"b.mp4", testMP4(1920, 1080, 1000, 500, "xyz1"), videoInfo{Kind: "mp4", Width: 1920, Height: 1080, Duration: 0.5, Codec: "xyz1"}},
+		{"c.webm", testWebM(320, 240, 4250, "V_VP9"), videoInfo{Kind: "webm", Width: 320, Height: 240, Duration: 4.25, Codec: "vp9"}},
+	}
+	for _, test := range tests {
+		local_path := path.Join(dir, test.name)
+		if err = ioutil.WriteFile(local_path, test.data, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		info, err := getVideoInfo(local_path)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if *info != test.expected {
+			t.Errorf("%s: expected %+v, got %+v", test.name, test.expected, *info)
+		}
+
+		w, h, kind, err := getImageInfo(local_path)
+		if err != nil || kind != test.expected.Kind || w != test.expected.Width || h != test.expected.Height {
+			t.Errorf("%s: getImageInfo gave %dx%d %s, %v", test.name, w, h, kind, err)
+		}
+		mimeType, ext, _ := imageKindTo(kind)
+		if !isStorableType(mimeType) || ext != path.Ext(test.name) {
+			t.Errorf("%s: unexpected mapping %s %s", test.name, mimeType, ext)
+		}
+	}
+
+	// Truncated containers are refused:
+	truncated := path.Join(dir, "t.mp4")
+	ioutil.WriteFile(truncated, testMP4(640, 360, 600, 1500, "avc1")[:1100], 0644)
+	if _, err = getVideoInfo(truncated); err == nil {
+		t.Errorf("expected truncated MP4 to be refused")
+	}
+}
+
+func Test_videoThumbnail(t *testing.T) {
+	dir, done := withTempStore(t)
+	defer done()
+	os.MkdirAll(store_folder(), 0755)
+	os.MkdirAll(thumb_folder(), 0755)
+
+	// Without a poster the thumbnail is a placeholder with the video's aspect ratio:
+	video_path := storePath(1, ".mp4")
+	ioutil.WriteFile(video_path, testMP4(640, 320, 600, 1500, "avc1"), 0644)
+	img, kind, release, err := decodeFirstImage(video_path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+	if kind != "mp4" || img.Bounds().Dx() != 2*img.Bounds().Dy() {
+		t.Errorf("expected a 2:1 placeholder for an mp4, got %v %s", img.Bounds(), kind)
+	}
+
+	// A poster replaces it:
+	poster := image.NewNRGBA(image.Rect(0, 0, 30, 20))
+	poster_path := path.Join(dir, "poster.png")
+	f, _ := os.Create(poster_path)
+	png.Encode(f, poster)
+	f.Close()
+
+	if werr := storePoster(1, "mp4", poster_path); werr != nil {
+		t.Fatal(werr.Error)
+	}
+	img, _, release, err = decodeFirstImage(video_path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+	if img.Bounds() != poster.Bounds() {
+		t.Errorf("expected the poster, got %v", img.Bounds())
+	}
+	if !fileExists(path.Join(thumb_folder(), "1.png")) {
+		t.Errorf("expected a thumbnail")
+	}
+
+	if werr := storePoster(1, "mp4", video_path); werr == nil {
+		t.Errorf("expected a video to be refused as a poster")
+	}
+}
@@ -1,24 +1,24 @@
 package main
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"encoding/gob"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"image"
+	"image/png"
 	"io"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
 	"path"
 	"path/filepath"
-	"runtime"
 	"strconv"
 	"strings"
-	"sync"
+	"time"
 )
 
 import "github.com/JamesDunne/go-util/web"
@@ -31,14 +31,69 @@ func imageKindTo(imageKind string) (mimeType, ext, thumbExt string) {
 		return "image/png", ".png", ".png"
 	case "gif":
 		return "image/gif", ".gif", ".png"
+	case "webp":
+		return "image/webp", ".webp", ".png"
+	case "bmp":
+		return "image/bmp", ".bmp", ".png"
+	case "tiff":
+		return "image/tiff", ".tif", ".png"
+	case "svg":
+		return "image/svg+xml", ".svg", ".png"
+	case "imgur-gifv":
+		return "video/mp4", ".mp4", ".png"
+	case "mp4":
+		return "video/mp4", ".mp4", ".png"
+	case "webm":
+		return "video/webm", ".webm", ".png"
 	}
 	return "", "", ""
 }
 
+func extToMimeType(ext string) string {
+	switch strings.ToLower(ext) {
+	case ".jpg", ".jpeg":
+		return "image/jpeg"
+	case ".png":
+		return "image/png"
+	case ".gif":
+		return "image/gif"
+	case ".webp":
+		return "image/webp"
+	case ".bmp":
+		return "image/bmp"
+	case ".tif", ".tiff":
+		return "image/tiff"
+	case ".svg":
+		return "image/svg+xml"
+	case ".mp4":
+		return "video/mp4"
+	case ".webm":
+		return "video/webm"
+	}
+	return ""
+}
+
+// Determines whether content of a MIME type may be stored:
+func isStorableType(mimeType string) bool {
+	return strings.HasPrefix(mimeType, "image/") || mimeType == "video/mp4" || mimeType == "video/webm"
+}
+
 func filename(path string) string {
 	return path[:len(path)-len(filepath.Ext(path))]
 }
 
+// Derives a title from a file name, e.g. "/tmp/happy_cat-dance.gif" -> "happy cat dance":
+func filenameToTitle(name string) string {
+	title := filename(filepath.Base(name))
+	title = strings.Map(func(c rune) rune {
+		if c == '_' || c == '-' || c == '.' {
+			return ' '
+		}
+		return c
+	}, title)
+	return strings.Join(strings.Fields(title), " ")
+}
+
 type ImageViewModel struct {
 	ID             int64   `json:"id"`
 	Base62ID       string  `json:"base62id"`
@@ -47,6 +102,7 @@ type ImageViewModel struct {
 	ImageURL       string  `json:"imageURL"`
 	ThumbURL       string  `json:"thumbURL"`
 	OGImageURL     string  `json:"ogImageURL"`
+	FallbackURL    string  `json:"fallbackURL,omitempty"`
 	OGImageWidth   *string `json:"ogImageWidth,omitempty"`
 	OGImageHeight  *string `json:"ogImageHeight,omitempty"`
 	Submitter      string  `json:"submitter,omitempty"`
@@ -55,6 +111,20 @@ type ImageViewModel struct {
 	RedirectToID   *int64  `json:"redirectToID,omitempty"`
 	IsClean        bool    `json:"isClean"`
 	Keywords       string  `json:"keywords,omitempty"`
+	LinkStatus     string  `json:"linkStatus,omitempty"`
+	LinkCheckedAt  *int64  `json:"linkCheckedAt,omitempty"`
+	CapturedAt     *int64  `json:"capturedAt,omitempty"`
+	Camera         string  `json:"camera,omitempty"`
+	CapturedDate   string  `json:"-"`
+	HasSnapshot    bool    `json:"hasSnapshot,omitempty"` // only looked up for single image views
+	AnimThumbURL   string  `json:"animThumbURL,omitempty"`
+	ParentID       *int64  `json:"parentID,omitempty"`
+	DerivationOp   string  `json:"derivationOp,omitempty"`
+	ThumbFrame     *int64  `json:"thumbFrame,omitempty"`
+	Author         string  `json:"author,omitempty"`
+	AuthorURL      string  `json:"authorURL,omitempty"`
+	License        string  `json:"license,omitempty"`
+	LicenseURL     string  `json:"licenseURL,omitempty"`
 }
 
 func xlatImageViewModel(i *Image, o *ImageViewModel) *ImageViewModel {
@@ -72,6 +142,20 @@ func xlatImageViewModel(i *Image, o *ImageViewModel) *ImageViewModel {
 	o.CollectionName = i.CollectionName
 	o.Submitter = i.Submitter
 	o.Keywords = i.Keywords
+	o.LinkStatus = i.LinkStatus
+	o.LinkCheckedAt = i.LinkCheckedAt
+	o.CapturedAt = i.CapturedAt
+	o.Camera = i.Camera
+	o.Author = i.Author
+	o.AuthorURL = i.AuthorURL
+	o.License = i.License
+	o.LicenseURL = licenseURL(i.License)
+	o.ParentID = i.ParentID
+	o.DerivationOp = i.DerivationOp
+	o.ThumbFrame = i.ThumbFrame
+	if i.CapturedAt != nil {
+		o.CapturedDate = time.Unix(*i.CapturedAt, 0).Format("2006-01-02 15:04:05")
+	}
 
 	if o.Kind == "" {
 		o.Kind = "gif"
@@ -83,18 +167,41 @@ func xlatImageViewModel(i *Image, o *ImageViewModel) *ImageViewModel {
 		o.ThumbURL = "http://i1.ytimg.com/vi/" + *i.SourceURL + "/hqdefault.jpg"
 		break
 	case "imgur-gifv":
-		hash := filename(*i.SourceURL)
-		if strings.HasPrefix(hash, "/") {
-			hash = hash[1:]
+		hash := imgurHash(*i.SourceURL)
+		o.FallbackURL = "http://i.imgur.com/" + hash
+		if hasLocalGifv(i.ID) {
+			// Serve our own copies; the viewer appends the format's extension:
+			o.ImageURL = "/" + o.Base62ID
+			o.OGImageURL = "http://i.imgur.com/" + hash + ".gif"
+			o.ThumbURL = "http://i.imgur.com/" + hash + "b.jpg"
+			if fileExists(storePath(i.ID, ".gif")) {
+				// Thumbnails are made from the GIF version:
+				o.OGImageURL = "http://i.bittwiddlers.org/" + o.Base62ID + ".gif"
+				o.ThumbURL = "/t/" + o.Base62ID + thumbExt
+				if animThumbEnabled(o.Kind) {
+					o.AnimThumbURL = "/t/" + o.Base62ID + ".gif"
+				}
+			}
+			break
 		}
-		o.ImageURL = "http://i.imgur.com/" + hash
+
+		// Fall back to imgur when local files are missing:
+		o.ImageURL = o.FallbackURL
 		o.OGImageURL = "http://i.imgur.com/" + hash + ".gif"
 		o.ThumbURL = "http://i.imgur.com/" + hash + "b.jpg"
 		break
+	case "mp4", "webm":
+		o.ImageURL = "http://i.bittwiddlers.org/" + o.Base62ID + ext
+		o.OGImageURL = "http://i.bittwiddlers.org/t/" + o.Base62ID + thumbExt
+		o.ThumbURL = "/t/" + o.Base62ID + thumbExt
+		break
 	default:
 		o.ImageURL = "http://i.bittwiddlers.org/" + o.Base62ID + ext
 		o.OGImageURL = o.ImageURL
 		o.ThumbURL = "/t/" + o.Base62ID + thumbExt
+		if animThumbEnabled(o.Kind) {
+			o.AnimThumbURL = "/t/" + o.Base62ID + ".gif"
+		}
 
 		break
 	}
@@ -133,66 +240,135 @@ func useAPI(use func(api *API) *web.Error) *web.Error {
 }
 
 type imageStoreRequest struct {
+	// Fixed ID to insert with or 0 to allocate a new one:
+	ID int64 `json:"-"`
+
 	Kind      string `json:"kind"`
 	Title     string `json:"title"`
 	SourceURL string `json:"sourceURL"`
 	Submitter string `json:"submitter"`
 	IsClean   bool   `json:"isClean"`
 	Keywords  string `json:"keywords"`
+	// Archive the submitted page when the URL is a web page:
+	Snapshot bool `json:"snapshot"`
 
 	CollectionName string
 	PostCreation   func(id int64, newImage *Image) *web.Error
+	// Downloaded file that PostCreation moves into the store; removed if the image is not stored:
+	LocalPath string `json:"-"`
+}
+
+// The fields of an image that `/api/v1/update` may change; fields left out of the request keep their values:
+type imageUpdateRequest struct {
+	Title      string  `json:"title"`
+	Keywords   string  `json:"keywords"`
+	SourceURL  *string `json:"sourceURL"`
+	Author     string  `json:"author"`
+	AuthorURL  string  `json:"authorURL"`
+	License    string  `json:"license"`
+	ThumbFrame *int64  `json:"thumbFrame"`
+}
+
+func newImageUpdateRequest(img *Image) *imageUpdateRequest {
+	u := &imageUpdateRequest{
+		Title:     img.Title,
+		Keywords:  img.Keywords,
+		Author:    img.Author,
+		AuthorURL: img.AuthorURL,
+		License:   img.License,
+	}
+	// Copy pointed-to values so decoding does not write through to the image:
+	if img.SourceURL != nil {
+		sourceURL := *img.SourceURL
+		u.SourceURL = &sourceURL
+	}
+	if img.ThumbFrame != nil {
+		thumbFrame := *img.ThumbFrame
+		u.ThumbFrame = &thumbFrame
+	}
+	return u
+}
+
+// Reports whether a URL links straight to media, leaving no web page to take a missing title from:
+func needsTitle(source string) bool {
+	u, err := url.Parse(source)
+	if err != nil {
+		return true
+	}
+	if u.Host == "www.youtube.com" || ((u.Host == "imgur.com" || u.Host == "i.imgur.com") && path.Ext(u.Path) == ".gifv") {
+		return true
+	}
+	if _, _, ok := imgurAlbumID(source); ok {
+		// Albums are titled by imgur:
+		return false
+	}
+	return isStorableType(extToMimeType(path.Ext(u.Path)))
 }
 
 func storeImage(req *imageStoreRequest) (id int64, werr *web.Error) {
+	defer func() {
+		if werr != nil && req.LocalPath != "" {
+			os.Remove(req.LocalPath)
+		}
+	}()
+
 	if req.Title == "" {
 		return 0, web.AsError(fmt.Errorf("Missing title!"), http.StatusBadRequest)
 	}
 
-	// Open the database:
-	werr = useAPI(func(api *API) (werr *web.Error) {
-		var err error
-
-		newImage := &Image{
-			Kind:           req.Kind,
-			Title:          req.Title,
-			SourceURL:      &req.SourceURL,
-			CollectionName: req.CollectionName,
-			Submitter:      req.Submitter,
-			IsClean:        req.IsClean,
-			Keywords:       strings.ToLower(req.Keywords),
-		}
+	newImage := &Image{
+		ID:             req.ID,
+		Kind:           req.Kind,
+		Title:          req.Title,
+		SourceURL:      &req.SourceURL,
+		CollectionName: req.CollectionName,
+		Submitter:      req.Submitter,
+		IsClean:        req.IsClean,
+		Keywords:       strings.ToLower(req.Keywords),
+	}
 
-		// Generate keywords from title:
-		if newImage.Keywords == "" {
-			newImage.Keywords = titleToKeywords(newImage.Title)
-		}
+	// Generate keywords from title:
+	if newImage.Keywords == "" {
+		newImage.Keywords = titleToKeywords(newImage.Title)
+	}
 
-		if newImage.Kind == "" {
-			newImage.Kind = "gif"
-		}
+	if newImage.Kind == "" {
+		newImage.Kind = "gif"
+	}
 
-		// Create the DB record:
+	// Create the DB record:
+	werr = useAPI(func(api *API) *web.Error {
+		var err error
 		id, err = api.NewImage(newImage)
-		if werr = web.AsError(err, http.StatusInternalServerError); werr != nil {
-			return
-		}
-
-		// Run post-creation function:
-		if req.PostCreation != nil {
-			if werr = req.PostCreation(id, newImage); werr != nil {
-				return
-			}
-		}
+		return web.AsError(err, http.StatusInternalServerError)
+	})
+	if werr != nil {
+		return 0, werr
+	}
+	newImage.ID = id
 
-		// Update image record with new Kind or other information discovered after download:
-		err = api.Update(newImage)
-		if werr = web.AsError(err, http.StatusInternalServerError); werr != nil {
-			//log.Println(err)
-			return
-		}
+	// Move the files into place and run the post-ingest processors, which may amend the record or
+	// reject the image; neither holds the database open while waiting on downloads or hooks:
+	if req.PostCreation != nil {
+		werr = req.PostCreation(id, newImage)
+	}
+	var runs []ProcessorRun
+	if werr == nil {
+		runs, werr = processNewImage(newImage)
+	}
+	if werr != nil {
+		// Do not leave a record behind for an image that was rejected:
+		useAPI(func(api *API) *web.Error {
+			return web.AsError(api.Delete(id), http.StatusInternalServerError)
+		})
+		removeImageFiles(id)
+		return 0, werr
+	}
 
-		return nil
+	// Update image record with new Kind or other information discovered after download:
+	werr = useAPI(func(api *API) *web.Error {
+		recordProcessorRuns(api, runs)
+		return web.AsError(api.Update(newImage), http.StatusInternalServerError)
 	})
 	if werr != nil {
 		return 0, werr
@@ -201,29 +377,60 @@ func storeImage(req *imageStoreRequest) (id int64, werr *web.Error) {
 	return id, nil
 }
 
-func downloadFile(url string) (string, *web.Error) {
+func downloadFile(url string) (string, string, *web.Error) {
 	// Do a HTTP GET to fetch the image:
 	img_rsp, err := http.Get(url)
 	if err != nil {
-		return "", web.AsError(err, http.StatusInternalServerError)
+		return "", "", web.AsError(err, http.StatusInternalServerError)
 	}
 	defer img_rsp.Body.Close()
 
+	if img_rsp.StatusCode < 200 || img_rsp.StatusCode >= 300 {
+		return "", "", web.AsError(fmt.Errorf("GET %s returned %s", url, img_rsp.Status), http.StatusBadGateway)
+	}
+
 	// Create a local temporary file to download to:
 	os.MkdirAll(tmp_folder(), 0755)
 	local_file, err := TempFile(tmp_folder(), "dl-", "")
 	if err != nil {
-		return "", web.AsError(err, http.StatusInternalServerError)
+		return "", "", web.AsError(err, http.StatusInternalServerError)
 	}
 	defer local_file.Close()
 
 	// Download file:
 	_, err = io.Copy(local_file, img_rsp.Body)
 	if err != nil {
-		return "", web.AsError(err, http.StatusInternalServerError)
+		return "", "", web.AsError(err, http.StatusInternalServerError)
+	}
+
+	// Report the media type without parameters, e.g. "text/html":
+	mimeType := strings.ToLower(strings.TrimSpace(strings.Split(img_rsp.Header.Get("Content-Type"), ";")[0]))
+
+	return local_file.Name(), mimeType, nil
+}
+
+// Sniffs the content type of a local file from its first bytes:
+func sniffFile(local_path string) (string, error) {
+	f, err := os.Open(local_path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	buf := make([]byte, 512)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return "", err
 	}
 
-	return local_file.Name(), nil
+	// Formats DetectContentType does not know:
+	switch {
+	case isSVG(buf[:n]):
+		return "image/svg+xml", nil
+	case bytes.HasPrefix(buf[:n], []byte("II*\x00")) || bytes.HasPrefix(buf[:n], []byte("MM\x00*")):
+		return "image/tiff", nil
+	}
+	return http.DetectContentType(buf[:n]), nil
 }
 
 func moveToStoreFolder(local_path string, id int64, ext string) (werr *web.Error) {
@@ -242,18 +449,30 @@ func moveFiles(local_path string, id int64, newImage *Image) (werr *web.Error) {
 	var firstImage image.Image
 	var err error
 
-	firstImage, newImage.Kind, err = decodeFirstImage(local_path)
-	defer func() { firstImage = nil }()
-	if werr = web.AsError(err, http.StatusInternalServerError); werr != nil {
+	// Strip anything active from SVGs before they are stored or served:
+	if isSVGFile(local_path) {
+		if werr = asDecodeError(sanitizeSVGFile(local_path)); werr != nil {
+			return
+		}
+	}
+
+	var release func()
+	firstImage, newImage.Kind, release, err = decodeFirstImage(local_path)
+	if werr = asDecodeError(err); werr != nil {
 		return
 	}
+	defer release()
 
 	_, ext, thumbExt := imageKindTo(newImage.Kind)
 
+	// A chosen thumbnail frame does not carry over to new content:
+	newImage.ThumbFrame = nil
+
 	// Move the file into the store folder:
 	if werr = moveToStoreFolder(local_path, id, ext); werr != nil {
 		return
 	}
+	removeVariants(id)
 
 	// Generate a thumbnail:
 	img_name := strconv.FormatInt(id, 10)
@@ -262,11 +481,26 @@ func moveFiles(local_path string, id int64, newImage *Image) (werr *web.Error) {
 	if werr = web.AsError(generateThumbnail(firstImage, newImage.Kind, thumb_path), http.StatusInternalServerError); werr != nil {
 		return
 	}
+	// Make room for decoding the animated preview:
+	release()
+
+	// Generate an animated preview; the static thumbnail is enough if this fails:
+	if animThumbEnabled(newImage.Kind) {
+		anim_path := path.Join(thumb_folder(), img_name+".gif")
+		if err = generateAnimatedThumbnail(storePath(id, ext), anim_path); err != nil && err != errNotAnimated {
+			log.Println(err)
+		}
+	}
 
 	return nil
 }
 
 func downloadImageFor(store *imageStoreRequest) *web.Error {
+	return downloadImage(store, true)
+}
+
+// Downloads media for a store request; HTML pages are scraped for their media only if `allowPages` is set:
+func downloadImage(store *imageStoreRequest, allowPages bool) *web.Error {
 	// Validate the URL:
 	imgurl, err := url.Parse(store.SourceURL)
 	if err != nil {
@@ -279,6 +513,12 @@ func downloadImageFor(store *imageStoreRequest) *web.Error {
 	// Check if it's a youtube link:
 	if (imgurl.Scheme == "http" || imgurl.Scheme == "https") && (imgurl.Host == "www.youtube.com") {
 		// Process youtube links specially:
+		if strings.HasPrefix(imgurl.Path, "/embed/") {
+			// Embed links are commonly found in og:video tags:
+			store.Kind = "youtube"
+			store.SourceURL = imgurl.Path[len("/embed/"):]
+			return nil
+		}
 		if imgurl.Path != "/watch" {
 			return web.AsError(fmt.Errorf("Unrecognized YouTube URL form."), http.StatusBadRequest)
 		}
@@ -296,66 +536,106 @@ func downloadImageFor(store *imageStoreRequest) *web.Error {
 		store.SourceURL = filename(fname)
 	}
 
-	if imgurl.Host == "imgur.com" && imgurl.Path[0:9] == "/gallery/" {
+	// Gallery links that are not expanded into albums, e.g. imported rows, keep their single gifv:
+	if endpoint, id, ok := imgurAlbumID(store.SourceURL); ok && endpoint == "gallery" {
 		store.Kind = "imgur-gifv"
-		_, fname := filepath.Split(imgurl.Path)
-		store.SourceURL = filename(fname)
+		store.SourceURL = id
 	}
 
 	if store.Kind == "imgur-gifv" {
-		// Background-fetch the WEBM and MP4 files:
-		wg := &sync.WaitGroup{}
-		fetch_func := func(ext string, path *string) {
-			defer wg.Done()
-
-			// Fetch the GIF version:
-			var werr *web.Error
-			*path, werr = downloadFile("http://i.imgur.com/" + store.SourceURL + ext)
-			if werr != nil {
-				log.Println(werr)
-				return
-			}
-		}
-
-		var (
-			webm_file string
-			mp4_file  string
-		)
-
-		wg.Add(2)
-		go fetch_func(".webm", &webm_file)
-		go fetch_func(".mp4", &mp4_file)
+		// Background-fetch the WEBM, MP4 and GIF files:
+		moveGifvFiles := downloadImgurGifv(store.SourceURL, imgurGifvExts)
 
 		// Function to run after DB record creation:
-		store.PostCreation = func(id int64, newImage *Image) (werr *web.Error) {
-			// Wait for all files to download:
-			wg.Wait()
-
-			// Move temp files to final storage:
-			if werr = moveToStoreFolder(webm_file, id, ".webm"); werr != nil {
-				return
-			}
-			if werr = moveToStoreFolder(mp4_file, id, ".mp4"); werr != nil {
-				return
-			}
-			return nil
+		store.PostCreation = func(id int64, newImage *Image) *web.Error {
+			return moveGifvFiles(id)
 		}
 		return nil
 	}
 
 	// Do a HTTP GET to fetch the image:
-	local_path, werr := downloadFile(fetchurl)
+	local_path, mimeType, werr := downloadFile(fetchurl)
 	if werr != nil {
 		return werr
 	}
 
+	if allowPages && (mimeType == "text/html" || mimeType == "application/xhtml+xml") {
+		// Scrape the web page for its media instead:
+		return downloadPageMediaFor(store, local_path, mimeType)
+	}
+	if !allowPages {
+		// Only accept actual images when picking candidates from a page:
+		sniffed, err := sniffFile(local_path)
+		if err != nil || !isStorableType(sniffed) {
+			os.Remove(local_path)
+			return web.AsError(fmt.Errorf("URL '%s' is not an image or video", fetchurl), http.StatusBadRequest)
+		}
+	}
+
 	// Function to run after DB record creation:
+	store.LocalPath = local_path
 	store.PostCreation = func(id int64, newImage *Image) (werr *web.Error) {
 		return moveFiles(local_path, id, newImage)
 	}
 	return nil
 }
 
+// Downloads an existing image again from its SourceURL and updates its record:
+func redownloadImage(img *Image) *web.Error {
+	if img.SourceURL == nil || img.Kind == "youtube" {
+		return web.AsError(fmt.Errorf("Image has nothing to download"), http.StatusBadRequest)
+	}
+
+	// Download the image:
+	storeRequest := &imageStoreRequest{
+		Kind:           img.Kind,
+		Title:          img.Title,
+		SourceURL:      *img.SourceURL,
+		Submitter:      img.Submitter,
+		IsClean:        img.IsClean,
+		Keywords:       img.Keywords,
+		CollectionName: img.CollectionName,
+	}
+	if werr := downloadImageFor(storeRequest); werr != nil {
+		return werr
+	}
+
+	// Keep the current files until the processors accept the new ones:
+	finish, err := setAsideImageFiles(img.ID)
+	if werr := web.AsError(err, http.StatusInternalServerError); werr != nil {
+		if storeRequest.LocalPath != "" {
+			os.Remove(storeRequest.LocalPath)
+		}
+		return werr
+	}
+
+	// Update the image record; storing the files sets the kind of the new content:
+	prev := *img
+	img.Kind = storeRequest.Kind
+	img.SourceURL = &storeRequest.SourceURL
+	if storeRequest.PostCreation != nil {
+		if werr := storeRequest.PostCreation(img.ID, img); werr != nil {
+			finish(true)
+			*img = prev
+			return werr
+		}
+	}
+
+	// Run the post-ingest processors and process the update request:
+	runs, werr := processNewImage(img)
+	finish(werr != nil)
+	if werr != nil {
+		*img = prev
+	}
+	return useAPI(func(api *API) *web.Error {
+		recordProcessorRuns(api, runs)
+		if werr != nil {
+			return werr
+		}
+		return web.AsError(api.Update(img), http.StatusInternalServerError)
+	})
+}
+
 func getForm(rsp http.ResponseWriter, req *http.Request) {
 	rsp.Header().Set("Content-Type", "text/html; charset=utf-8")
 }
@@ -420,11 +700,11 @@ func getList(collectionName string, includeBase bool, orderBy ImagesOrderBy) (li
 	return
 }
 
-func apiSearch(keywords []string, collectionName string, includeBase bool, orderBy ImagesOrderBy) (list []Image, werr *web.Error) {
+func apiSearch(keywords []string, collectionName string, includeBase bool, licenses []string, orderBy ImagesOrderBy) (list []Image, werr *web.Error) {
 	werr = useAPI(func(api *API) *web.Error {
 		var err error
 
-		list, err = api.Search(keywords, collectionName, includeBase, orderBy)
+		list, err = api.Search(keywords, collectionName, includeBase, licenses, orderBy)
 
 		return web.AsError(err, http.StatusInternalServerError)
 	})
@@ -482,6 +762,11 @@ type viewTemplateModel struct {
 	Query      map[string]string
 	Image      ImageViewModel
 	IsAdmin    bool
+
+	// Admin only:
+	ProcessorRuns []ProcessorRun
+	Ancestors     []*lineageNode
+	Variants      []*lineageNode
 }
 
 func flattenQuery(query map[string][]string) (flat map[string]string) {
@@ -506,6 +791,14 @@ func requestHandler(rsp http.ResponseWriter, req *http.Request) *web.Error {
 	}
 	//log.Printf("%s %s %s %s\nHeaders: %v\n\n", req.RemoteAddr, req.Method, req.Host, req.URL, req.Header)
 
+	// Resumable uploads use their own set of methods:
+	if upload_id, ok := web.MatchSimpleRoute(req.URL.Path, "/api/v1/tus"); ok {
+		if werr := tusHandler(rsp, req, upload_id); werr != nil {
+			return werr.AsJSON()
+		}
+		return nil
+	}
+
 	if req.Method == "POST" {
 		// POST:
 
@@ -526,14 +819,23 @@ func requestHandler(rsp http.ResponseWriter, req *http.Request) *web.Error {
 				SourceURL:      imgurl_s,
 				Keywords:       strings.ToLower(req.FormValue("keywords")),
 				IsClean:        !nsfw,
+				Snapshot:       req.FormValue("snapshot") == "1",
 			}
 
-			// Require the 'title' form value:
-			if store.Title == "" {
+			if store.Title == "" && needsTitle(imgurl_s) {
 				return web.AsError(fmt.Errorf("Missing title!"), http.StatusBadRequest).AsHTML()
 			}
 
-			// Download the image from the URL:
+			// Store each image of an imgur album:
+			if endpoint, album_id, ok := imgurAlbumID(imgurl_s); ok {
+				results, werr := storeImgurAlbum(store, endpoint, album_id)
+				if werr != nil {
+					return werr.AsHTML()
+				}
+				return respondUploads(rsp, req, results)
+			}
+
+			// Download the image from the URL; a missing title may be filled in from a web page:
 			if werr := downloadImageFor(store); werr != nil {
 				return werr.AsHTML()
 			}
@@ -549,99 +851,24 @@ func requestHandler(rsp http.ResponseWriter, req *http.Request) *web.Error {
 			http.Redirect(rsp, req, redir_url, http.StatusFound)
 			return nil
 		} else if collectionName, ok := web.MatchSimpleRoute(req.URL.Path, "/col/upload"); ok {
-			// Upload a new image:
-			_ = "breakpoint"
-			store := &imageStoreRequest{
-				CollectionName: collectionName,
-				Submitter:      req.RemoteAddr,
-				IsClean:        true,	// default unless nsfw=1 is supplied in form
+			// Upload one or more new images:
+			values, files, werr := receiveUploads(req)
+			if werr != nil {
+				return werr.AsHTML()
 			}
-
-			if !web.IsMultipart(req) {
-				return web.AsError(fmt.Errorf("Upload request must be multipart form data"), http.StatusBadRequest).AsHTML()
+			if len(files) == 0 {
+				return web.AsError(fmt.Errorf("No files uploaded"), http.StatusBadRequest).AsHTML()
 			}
 
-			// Accept file upload:
-			reader, err := req.MultipartReader()
+			// Extract images from any uploaded archives:
+			files, skipped, err := expandArchives(files)
 			if werr := web.AsError(err, http.StatusBadRequest); werr != nil {
 				return werr.AsHTML()
 			}
 
-			// Keep reading the multipart form data and handle file uploads:
-			for {
-				part, err := reader.NextPart()
-				if err == io.EOF {
-					break
-				}
-
-				// Parse normal form values:
-				if part.FormName() == "title" {
-					// TODO: parse content-length if it exists?
-					//part.Header.Get("Content-Length")
-
-					t, err := ioutil.ReadAll(part)
-					if werr := web.AsError(err, http.StatusInternalServerError); werr != nil {
-						return werr.AsHTML()
-					}
-					store.Title = string(t)
-					continue
-				} else if part.FormName() == "keywords" {
-					t, err := ioutil.ReadAll(part)
-					if werr := web.AsError(err, http.StatusInternalServerError); werr != nil {
-						return werr.AsHTML()
-					}
-					store.Keywords = strings.ToLower(string(t))
-					continue
-				} else if part.FormName() == "nsfw" {
-					t, err := ioutil.ReadAll(part)
-					if werr := web.AsError(err, http.StatusInternalServerError); werr != nil {
-						return werr.AsHTML()
-					}
-					nsfw := (string(t) == "1")
-					store.IsClean = !nsfw
-					continue
-				}
-
-				if part.FileName() == "" {
-					continue
-				}
-
-				// Copy upload data to a local file:
-				store.SourceURL = "file://" + part.FileName()
-
-				werr := func() *web.Error {
-					os.MkdirAll(tmp_folder(), 0755)
-					f, err := TempFile(tmp_folder(), "up-", path.Ext(part.FileName()))
-					if err != nil {
-						return web.AsError(err, http.StatusInternalServerError)
-					}
-					defer f.Close()
-
-					local_path := f.Name()
-					store.PostCreation = func(id int64, newImage *Image) (werr *web.Error) {
-						return moveFiles(local_path, id, newImage)
-					}
-
-					if _, err := io.Copy(f, part); err != nil {
-						return web.AsError(err, http.StatusInternalServerError)
-					}
-					return nil
-				}()
-				if werr.AsHTML().Respond(rsp) {
-					return werr
-				}
-			}
-
-			// Store it in the database and generate thumbnail:
-			id, werr := storeImage(store)
-			if werr.AsHTML().Respond(rsp) {
-				return werr
-			}
-
-			// Redirect to a black-background view of the image:
-			redir_url := path.Join("/b/", b62.Encode(id+10000))
-			http.Redirect(rsp, req, redir_url, http.StatusFound)
-			return nil
+			// Store each file in the database and generate thumbnails:
+			results := storeUploads(collectionName, req.RemoteAddr, values, files)
+			return respondUploads(rsp, req, append(results, skipped...))
 		} else if id_s, ok := web.MatchSimpleRoute(req.URL.Path, "/admin/download"); ok {
 			id := b62.Decode(id_s) - 10000
 
@@ -657,37 +884,28 @@ func requestHandler(rsp http.ResponseWriter, req *http.Request) *web.Error {
 				return web.AsError(fmt.Errorf("Could not find image by ID"), http.StatusNotFound).AsHTML()
 			}
 
-			// Download the image:
-			storeRequest := &imageStoreRequest{
-				Kind:           img.Kind,
-				Title:          img.Title,
-				SourceURL:      *img.SourceURL,
-				Submitter:      img.Submitter,
-				IsClean:        img.IsClean,
-				Keywords:       img.Keywords,
-				CollectionName: img.CollectionName,
-			}
-			if werr := downloadImageFor(storeRequest); werr != nil {
-				return werr.AsHTML()
-			}
-			if werr := storeRequest.PostCreation(img.ID, img); werr != nil {
-				return werr.AsHTML()
-			}
-
-			// Update the image record:
-			img.Kind = storeRequest.Kind
-			img.SourceURL = &storeRequest.SourceURL
-
-			// Process the update request:
-			if werr := useAPI(func(api *API) *web.Error {
-				return web.AsError(api.Update(img), http.StatusInternalServerError)
-			}); werr != nil {
+			// Download the image and update its record:
+			if werr := redownloadImage(img); werr != nil {
 				return werr.AsHTML()
 			}
 
 			// Redirect back to edit page:
 			http.Redirect(rsp, req, "/admin/edit/"+id_s, http.StatusFound)
 			return nil
+		} else if web.MatchExactRouteIgnoreSlash(req.URL.Path, "/admin/redownload") {
+			// Re-download the selected images whose sources are still alive:
+			if err := req.ParseForm(); err != nil {
+				return web.AsError(err, http.StatusBadRequest).AsHTML()
+			}
+			ids := make([]int64, 0, len(req.PostForm["id"]))
+			for _, id_s := range req.PostForm["id"] {
+				ids = append(ids, b62.Decode(id_s)-10000)
+			}
+			if len(ids) == 0 {
+				return web.AsError(fmt.Errorf("No images selected"), http.StatusBadRequest).AsHTML()
+			}
+
+			return renderResults(rsp, "Re-downloaded Images", redownloadImages(ids))
 		} else if id_s, ok := web.MatchSimpleRoute(req.URL.Path, "/admin/update"); ok {
 			id := b62.Decode(id_s) - 10000
 
@@ -723,6 +941,19 @@ func requestHandler(rsp http.ResponseWriter, req *http.Request) *web.Error {
 			img.Submitter = req.FormValue("submitter")
 			img.IsClean = (req.FormValue("nsfw") == "")
 			img.Kind = req.FormValue("kind")
+			img.Author = req.FormValue("author")
+			img.AuthorURL = req.FormValue("authorURL")
+			img.License = req.FormValue("license")
+			if werr := web.AsError(normalizeAttribution(img), http.StatusBadRequest); werr != nil {
+				return werr.AsHTML()
+			}
+			thumbFrame, err := parseThumbFrame(strings.TrimSpace(req.FormValue("thumbFrame")))
+			if werr := web.AsError(err, http.StatusBadRequest); werr != nil {
+				return werr.AsHTML()
+			}
+			if werr := setThumbFrame(img, thumbFrame); werr != nil {
+				return werr.AsHTML()
+			}
 
 			// Generate keywords from title:
 			if img.Keywords == "" {
@@ -751,6 +982,24 @@ func requestHandler(rsp http.ResponseWriter, req *http.Request) *web.Error {
 				return werr.AsJSON()
 			}
 
+			if store.Title == "" && needsTitle(store.SourceURL) {
+				return web.AsError(fmt.Errorf("Missing title!"), http.StatusBadRequest).AsJSON()
+			}
+
+			// Store each image of an imgur album:
+			if endpoint, album_id, ok := imgurAlbumID(store.SourceURL); ok {
+				results, werr := storeImgurAlbum(store, endpoint, album_id)
+				if werr != nil {
+					return werr.AsJSON()
+				}
+				web.JsonSuccess(rsp, &struct {
+					Results []uploadResult `json:"results"`
+				}{
+					Results: results,
+				})
+				return nil
+			}
+
 			// Download Image locally:
 			if werr := downloadImageFor(store); werr != nil {
 				return werr.AsJSON()
@@ -770,6 +1019,34 @@ func requestHandler(rsp http.ResponseWriter, req *http.Request) *web.Error {
 				Base62ID: b62.Encode(id + 10000),
 			})
 			return nil
+		} else if collectionName, ok := web.MatchSimpleRoute(req.URL.Path, "/api/v1/upload"); ok {
+			// Add a new image sent as the raw request body or as a JSON data URI:
+			id, werr := storeRawUpload(req, collectionName)
+			if werr != nil {
+				return werr.AsJSON()
+			}
+
+			web.JsonSuccess(rsp, &struct {
+				ID       int64  `json:"id"`
+				Base62ID string `json:"base62id"`
+			}{
+				ID:       id,
+				Base62ID: b62.Encode(id + 10000),
+			})
+			return nil
+		} else if collectionName, ok := web.MatchSimpleRoute(req.URL.Path, "/api/v1/archive"); ok {
+			// Add all images from a zip or tar(.gz) archive sent as the request body:
+			results, werr := storeArchiveBody(req, collectionName)
+			if werr != nil {
+				return werr.AsJSON()
+			}
+
+			web.JsonSuccess(rsp, &struct {
+				Results []uploadResult `json:"results"`
+			}{
+				Results: results,
+			})
+			return nil
 		} else if id_s, ok := web.MatchSimpleRoute(req.URL.Path, "/api/v1/update"); ok {
 			// TODO: Lock down based on basic_auth.username == collectionName.
 
@@ -781,12 +1058,28 @@ func requestHandler(rsp http.ResponseWriter, req *http.Request) *web.Error {
 				return werr.AsJSON()
 			}
 
-			// Decode JSON straight onto existing Image record:
+			// Decode JSON onto the editable fields of the existing Image record:
+			update := newImageUpdateRequest(img)
 			jd := json.NewDecoder(req.Body)
-			err := jd.Decode(img)
+			err := jd.Decode(update)
 			if werr := web.AsError(err, http.StatusBadRequest); werr != nil {
 				return werr.AsJSON()
 			}
+			img.Title = update.Title
+			img.Keywords = update.Keywords
+			img.SourceURL = update.SourceURL
+			img.Author = update.Author
+			img.AuthorURL = update.AuthorURL
+			img.License = update.License
+
+			if werr := web.AsError(normalizeAttribution(img), http.StatusBadRequest); werr != nil {
+				return werr.AsJSON()
+			}
+
+			// Regenerate the thumbnail if another frame was chosen:
+			if werr := setThumbFrame(img, update.ThumbFrame); werr != nil {
+				return werr.AsJSON()
+			}
 
 			// Generate keywords from title:
 			if img.Keywords == "" {
@@ -858,34 +1151,16 @@ func requestHandler(rsp http.ResponseWriter, req *http.Request) *web.Error {
 			_, ext, _ := imageKindTo(img.Kind)
 			local_path := path.Join(store_folder(), strconv.FormatInt(img.ID, 10)+ext)
 			tmp_output, err := cropImage(local_path, cr.Left, cr.Top, cr.Right, cr.Bottom)
-			if werr := web.AsError(err, http.StatusInternalServerError); werr != nil {
-				return werr.AsJSON()
-			}
-
-			// Clone the image record to a new record:
-			if werr := useAPI(func(api *API) *web.Error {
-				var err error
-				img.ID = 0
-				img.ID, err = api.NewImage(img)
-				return web.AsError(err, http.StatusInternalServerError)
-			}); werr != nil {
+			if werr := asDecodeError(err); werr != nil {
 				return werr.AsJSON()
 			}
 
-			// Move the temp file to the final storage path:
-			img_name := strconv.FormatInt(img.ID, 10)
-			os.MkdirAll(store_folder(), 0755)
-			store_path := path.Join(store_folder(), img_name+ext)
-			if werr := web.AsError(os.Rename(tmp_output, store_path), http.StatusInternalServerError); werr != nil {
+			// Store the cropped copy and generate its thumbnails:
+			derivation := describeOps([]transformOp{{Op: "crop", Left: cr.Left, Top: cr.Top, Right: cr.Right, Bottom: cr.Bottom}})
+			if werr := storeTransformed(img, tmp_output, false, derivation); werr != nil {
 				return werr.AsJSON()
 			}
 
-			//// Generate a thumbnail:
-			//os.MkdirAll(thumb_folder(), 0755)
-			//thumb_path := path.Join(thumb_folder(), img_name+thumbExt)
-			//if web.AsError(generateThumbnail(firstImage, newImage.Kind, thumb_path), http.StatusInternalServerError).AsJSON().Respond(rsp) {
-			//	return
-			//}
 			width, height := cr.Right-cr.Left, cr.Bottom-cr.Top
 
 			web.JsonSuccess(rsp, &struct {
@@ -908,6 +1183,82 @@ func requestHandler(rsp http.ResponseWriter, req *http.Request) *web.Error {
 				Height:         &height,
 			})
 			return nil
+		} else if id_s, ok := web.MatchSimpleRoute(req.URL.Path, "/api/v1/transform"); ok {
+			id := b62.Decode(id_s) - 10000
+
+			tr := &struct {
+				Ops     []transformOp `json:"ops"`
+				Replace bool          `json:"replace"`
+			}{}
+
+			jd := json.NewDecoder(req.Body)
+			err := jd.Decode(tr)
+			if werr := web.AsError(err, http.StatusBadRequest); werr != nil {
+				return werr.AsJSON()
+			}
+
+			img, werr := getImage(id)
+			if werr != nil {
+				return werr.AsJSON()
+			}
+			if img == nil {
+				return web.AsError(fmt.Errorf("Could not find image by ID"), http.StatusNotFound).AsJSON()
+			}
+			if img.Kind != "jpeg" && img.Kind != "png" && img.Kind != "gif" {
+				return web.AsError(fmt.Errorf("Cannot transform '%s' images", img.Kind), http.StatusBadRequest).AsJSON()
+			}
+			if img.Kind != "gif" && hasTimelineOps(tr.Ops) {
+				return web.AsError(fmt.Errorf("Only GIFs have frames to change the timing of"), http.StatusBadRequest).AsJSON()
+			}
+
+			// Check the operations before doing any work:
+			local_path := imageLocalPath(img)
+			if local_path == "" {
+				return web.AsError(fmt.Errorf("Image file is missing"), http.StatusNotFound).AsJSON()
+			}
+			w, h, _, err := getImageInfo(local_path)
+			if werr := asDecodeError(err); werr != nil {
+				return werr.AsJSON()
+			}
+			width, height, err := planTransform(tr.Ops, w, h)
+			if _, ok := err.(*imageLimitError); ok {
+				return asDecodeError(err).AsJSON()
+			} else if werr := web.AsError(err, http.StatusBadRequest); werr != nil {
+				return werr.AsJSON()
+			}
+
+			tmp_output, err := transformImage(local_path, img.Kind, tr.Ops)
+			if werr := asDecodeError(err); werr != nil {
+				return werr.AsJSON()
+			}
+
+			// Store as a new image or over the original, with new thumbnails either way:
+			if werr := storeTransformed(img, tmp_output, tr.Replace, describeOps(tr.Ops)); werr != nil {
+				return werr.AsJSON()
+			}
+
+			web.JsonSuccess(rsp, &struct {
+				ID             int64  `json:"id"`
+				Base62ID       string `json:"base62id"`
+				Title          string `json:"title"`
+				CollectionName string `json:"collectionName,omitempty"`
+				Submitter      string `json:"submitter,omitempty"`
+				Kind           string `json:"kind"`
+				Width          int    `json:"width"`
+				Height         int    `json:"height"`
+				Replaced       bool   `json:"replaced"`
+			}{
+				ID:             img.ID,
+				Base62ID:       b62.Encode(img.ID + 10000),
+				Kind:           img.Kind,
+				Title:          img.Title,
+				CollectionName: img.CollectionName,
+				Submitter:      img.Submitter,
+				Width:          width,
+				Height:         height,
+				Replaced:       tr.Replace,
+			})
+			return nil
 		}
 
 		rsp.WriteHeader(http.StatusBadRequest)
@@ -935,7 +1286,7 @@ func requestHandler(rsp http.ResponseWriter, req *http.Request) *web.Error {
 		return web.NewError(nil, http.StatusNoContent, web.Empty)
 	} else if req.URL.Path == "/" {
 		keywords := normalizeKeywords(req_query["q"])
-		list, werr := apiSearch(keywords, "all", true, orderBy)
+		list, werr := apiSearch(keywords, "all", true, req_query["license"], orderBy)
 		if werr != nil {
 			return werr.AsHTML()
 		}
@@ -944,7 +1295,7 @@ func requestHandler(rsp http.ResponseWriter, req *http.Request) *web.Error {
 		return nil
 	} else if collectionName, ok := web.MatchSimpleRoute(req.URL.Path, "/col/list"); ok {
 		keywords := normalizeKeywords(req_query["q"])
-		list, werr := apiSearch(keywords, collectionName, true, orderBy)
+		list, werr := apiSearch(keywords, collectionName, true, req_query["license"], orderBy)
 		if werr != nil {
 			return werr.AsHTML()
 		}
@@ -953,7 +1304,7 @@ func requestHandler(rsp http.ResponseWriter, req *http.Request) *web.Error {
 		return nil
 	} else if collectionName, ok := web.MatchSimpleRoute(req.URL.Path, "/col/only"); ok {
 		keywords := normalizeKeywords(req_query["q"])
-		list, werr := apiSearch(keywords, collectionName, false, orderBy)
+		list, werr := apiSearch(keywords, collectionName, false, req_query["license"], orderBy)
 		if werr != nil {
 			return werr.AsHTML()
 		}
@@ -981,18 +1332,26 @@ func requestHandler(rsp http.ResponseWriter, req *http.Request) *web.Error {
 		return nil
 	} else if web.MatchExactRouteIgnoreSlash(req.URL.Path, "/admin") {
 		keywords := normalizeKeywords(req_query["q"])
-		list, werr := apiSearch(keywords, "all", true, orderBy)
+		list, werr := apiSearch(keywords, "all", true, req_query["license"], orderBy)
 		if werr != nil {
 			return werr.AsHTML()
 		}
 
+		// Show only images with dead sources when `?dead` is given:
+		_, dead := req_query["dead"]
+		if dead {
+			list = filterDeadLinks(list)
+		}
+
 		// Project into a view model:
 		model := struct {
 			List     []ImageViewModel
 			Keywords string
+			Dead     bool
 		}{
 			List:     projectModelList(list),
 			Keywords: strings.Join(keywords, " "),
+			Dead:     dead,
 		}
 
 		// GET the /admin/list to link to edit pages:
@@ -1004,18 +1363,26 @@ func requestHandler(rsp http.ResponseWriter, req *http.Request) *web.Error {
 		return nil
 	} else if collectionName, ok := web.MatchSimpleRoute(req.URL.Path, "/admin/list"); ok {
 		keywords := normalizeKeywords(req_query["q"])
-		list, werr := apiSearch(keywords, collectionName, true, orderBy)
+		list, werr := apiSearch(keywords, collectionName, true, req_query["license"], orderBy)
 		if werr != nil {
 			return werr.AsHTML()
 		}
 
+		// Show only images with dead sources when `?dead` is given:
+		_, dead := req_query["dead"]
+		if dead {
+			list = filterDeadLinks(list)
+		}
+
 		// Project into a view model:
 		model := struct {
 			List     []ImageViewModel
 			Keywords string
+			Dead     bool
 		}{
 			List:     projectModelList(list),
 			Keywords: strings.Join(keywords, " "),
+			Dead:     dead,
 		}
 
 		// GET the /admin/list to link to edit pages:
@@ -1025,13 +1392,31 @@ func requestHandler(rsp http.ResponseWriter, req *http.Request) *web.Error {
 			return werr.AsHTML()
 		}
 		return nil
+	} else if id_s, ok := web.MatchSimpleRoute(req.URL.Path, "/admin/snapshot"); ok {
+		// GET /admin/snapshot/<id> to replay the archived source page of an image:
+		if werr := serveSnapshot(rsp, req, id_s); werr != nil {
+			return werr.AsHTML()
+		}
+		return nil
 	} else if id_s, ok := web.MatchSimpleRoute(req.URL.Path, "/admin/edit"); ok {
 		id := b62.Decode(id_s) - 10000
 
 		var img *Image
+		var runs []ProcessorRun
+		var ancestors, variants []*lineageNode
 		if werr := useAPI(func(api *API) *web.Error {
 			var err error
 			img, err = api.GetImage(id)
+			if err != nil || img == nil {
+				return web.AsError(err, http.StatusInternalServerError)
+			}
+			if runs, err = api.GetProcessorRuns(id); err != nil {
+				return web.AsError(err, http.StatusInternalServerError)
+			}
+			if ancestors, err = getAncestors(api, img); err != nil {
+				return web.AsError(err, http.StatusInternalServerError)
+			}
+			variants, err = getVariants(api, img)
 			return web.AsError(err, http.StatusInternalServerError)
 		}); werr != nil {
 			return werr.AsHTML()
@@ -1046,8 +1431,12 @@ func requestHandler(rsp http.ResponseWriter, req *http.Request) *web.Error {
 			Query:   flattenQuery(req_query),
 			Image:   *xlatImageViewModel(img, nil),
 			// Allow editing:
-			IsAdmin: true,
+			IsAdmin:       true,
+			ProcessorRuns: runs,
+			Ancestors:     ancestors,
+			Variants:      variants,
 		}
+		model.Image.HasSnapshot = hasSnapshot(img.ID)
 
 		// GET the /admin/list to link to edit pages:
 		rsp.Header().Set("Content-Type", "text/html; charset=utf-8")
@@ -1122,15 +1511,23 @@ func requestHandler(rsp http.ResponseWriter, req *http.Request) *web.Error {
 	} else if collectionName, ok := web.MatchSimpleRoute(req.URL.Path, "/api/v1/search"); ok {
 		// Join and resplit keywords by spaces because `req_query["q"]` splits at `q=1&q=2&q=3` level, not spaces.
 		keywords := normalizeKeywords(req_query["q"])
-		list, werr := apiSearch(keywords, collectionName, true, orderBy)
+		list, werr := apiSearch(keywords, collectionName, true, req_query["license"], orderBy)
 		return apiListResult(req, rsp, list, werr)
 	} else if id_s, ok := web.MatchSimpleRoute(req.URL.Path, "/api/v1/info"); ok {
 		id := b62.Decode(id_s) - 10000
 
 		var img *Image
+		var ancestors, variants []*lineageNode
 		if werr := useAPI(func(api *API) *web.Error {
 			var err error
 			img, err = api.GetImage(id)
+			if err != nil || img == nil {
+				return web.AsError(err, http.StatusInternalServerError)
+			}
+			if ancestors, err = getAncestors(api, img); err != nil {
+				return web.AsError(err, http.StatusInternalServerError)
+			}
+			variants, err = getVariants(api, img)
 			return web.AsError(err, http.StatusInternalServerError)
 		}); werr != nil {
 			return werr.AsJSON()
@@ -1155,6 +1552,18 @@ func requestHandler(rsp http.ResponseWriter, req *http.Request) *web.Error {
 			RedirectToID   *int64  `json:"redirectToID,omitempty"`
 			Width          *int    `json:"width,omitempty"`
 			Height         *int    `json:"height,omitempty"`
+
+			// Videos only:
+			Duration *float64 `json:"duration,omitempty"`
+			Codec    string   `json:"codec,omitempty"`
+
+			HasSnapshot bool `json:"hasSnapshot"`
+
+			// Images this one was derived from, the original first, and the tree of images derived from it:
+			ParentID     *string        `json:"parentID,omitempty"`
+			DerivationOp string         `json:"derivationOp,omitempty"`
+			Ancestors    []*lineageNode `json:"ancestors,omitempty"`
+			Variants     []*lineageNode `json:"variants,omitempty"`
 		}{
 			ID:             id,
 			Base62ID:       b62.Encode(id + 10000),
@@ -1165,6 +1574,14 @@ func requestHandler(rsp http.ResponseWriter, req *http.Request) *web.Error {
 			Submitter:      img.Submitter,
 			SourceURL:      img.SourceURL,
 			RedirectToID:   img.RedirectToID,
+			DerivationOp:   img.DerivationOp,
+			Ancestors:      ancestors,
+			Variants:       variants,
+			HasSnapshot:    hasSnapshot(id),
+		}
+		if img.ParentID != nil {
+			parent_s := b62.Encode(*img.ParentID + 10000)
+			model.ParentID = &parent_s
 		}
 		if model.Kind == "" {
 			model.Kind = "gif"
@@ -1181,10 +1598,70 @@ func requestHandler(rsp http.ResponseWriter, req *http.Request) *web.Error {
 				model.Width = &width
 				model.Height = &height
 			}
+
+			if model.Kind == "mp4" || model.Kind == "webm" {
+				if info, err := getVideoInfo(local_path); err == nil {
+					model.Duration = &info.Duration
+					model.Codec = info.Codec
+				}
+			}
 		}
 
 		web.JsonSuccess(rsp, model)
 		return nil
+	} else if route, ok := web.MatchSimpleRoute(req.URL.Path, "/api/v1/frames"); ok {
+		// `/api/v1/frames/<base62>` lists frames; `/api/v1/frames/<base62>/<n>.png` exports one:
+		id_s, frame_s := route, ""
+		if i := strings.Index(route, "/"); i >= 0 {
+			id_s, frame_s = route[:i], route[i+1:]
+		}
+		id := b62.Decode(id_s) - 10000
+
+		img, werr := getImage(id)
+		if werr != nil {
+			return werr.AsJSON()
+		}
+		if img == nil {
+			return web.AsError(fmt.Errorf("Could not find image by ID"), http.StatusNotFound).AsJSON()
+		}
+		if img.Kind != "gif" {
+			return web.AsError(fmt.Errorf("Only GIFs have frames"), http.StatusBadRequest).AsJSON()
+		}
+
+		local_path := storePath(img.ID, ".gif")
+		if frame_s == "" {
+			g, release, err := decodeGIFFile(local_path)
+			if werr := asDecodeError(err); werr != nil {
+				return werr.AsJSON()
+			}
+			defer release()
+
+			info := listGIFFrames(g)
+			info.ThumbFrame = img.ThumbFrame
+			web.JsonSuccess(rsp, info)
+			return nil
+		}
+
+		n, err := strconv.Atoi(strings.TrimSuffix(frame_s, ".png"))
+		if err != nil || !strings.HasSuffix(frame_s, ".png") {
+			return web.AsError(fmt.Errorf("Frames are exported as '<n>.png'"), http.StatusNotFound).AsJSON()
+		}
+
+		// Only the frames up to the one exported are decoded:
+		comp, done, err := openGIFStream(local_path)
+		if werr := asDecodeError(err); werr != nil {
+			return werr.AsJSON()
+		}
+		defer done()
+		frame, err := compositeGIFFrame(comp, n)
+		if _, ok := err.(*gifFrameRangeError); ok {
+			return web.AsError(err, http.StatusNotFound).AsJSON()
+		} else if werr := asDecodeError(err); werr != nil {
+			return werr.AsJSON()
+		}
+
+		rsp.Header().Set("Content-Type", "image/png")
+		return web.AsError(png.Encode(rsp, frame), http.StatusInternalServerError)
 	}
 
 	dir := path.Dir(req.URL.Path)
@@ -1225,7 +1702,11 @@ func requestHandler(rsp http.ResponseWriter, req *http.Request) *web.Error {
 	if img.Kind == "" {
 		img.Kind = "gif"
 	}
-	mime, _, thumbExt := imageKindTo(img.Kind)
+	mime, ext, thumbExt := imageKindTo(img.Kind)
+	if img.Kind == "imgur-gifv" {
+		// Served as any of its rehosted formats:
+		mime = extToMimeType(req_ext)
+	}
 
 	// Find the image file:
 	img_name := strconv.FormatInt(img.ID, 10)
@@ -1253,13 +1734,36 @@ func requestHandler(rsp http.ResponseWriter, req *http.Request) *web.Error {
 			return werr.AsHTML()
 		}
 
+		return nil
+	} else if strings.HasPrefix(dir, "/s/") {
+		// Serve a resized variant:
+		if werr := serveVariant(rsp, req, img, dir[len("/s/"):], req_ext); werr != nil {
+			return werr.AsHTML()
+		}
 		return nil
 	} else if dir == "/t" {
 		// Serve thumbnail file:
-		local_path := path.Join(store_folder(), img_name+req_ext)
+		if img.Kind == "imgur-gifv" {
+			// Thumbnails are made from the GIF version:
+			ext = ".gif"
+		}
+		local_path := path.Join(store_folder(), img_name+ext)
+		ensure := func(image_path, thumb_path string) error {
+			return ensureThumbnailFrame(image_path, thumb_path, img.ThumbFrame)
+		}
+		if req_ext == ".gif" && animThumbEnabled(img.Kind) {
+			// Animated preview:
+			thumbExt = ".gif"
+			ensure = ensureAnimatedThumbnail
+		}
 		thumb_path := path.Join(thumb_folder(), img_name+thumbExt)
-		if werr := web.AsError(ensureThumbnail(local_path, thumb_path), http.StatusInternalServerError); werr != nil {
-			runtime.GC()
+		mime = extToMimeType(thumbExt)
+		if err := ensure(local_path, thumb_path); err == errNotAnimated {
+			// Still images only have the static thumbnail:
+			_, _, staticExt := imageKindTo(img.Kind)
+			http.Redirect(rsp, req, "/t/"+filename+staticExt, http.StatusFound)
+			return nil
+		} else if werr := asDecodeError(err); werr != nil {
 			return werr.AsHTML()
 		}
 
@@ -1270,17 +1774,20 @@ func requestHandler(rsp http.ResponseWriter, req *http.Request) *web.Error {
 			rsp.Header().Set("X-Accel-Redirect", redirPath)
 			rsp.Header().Set("Content-Type", mime)
 			rsp.WriteHeader(200)
-			runtime.GC()
 			return nil
 		} else {
 			rsp.Header().Set("Content-Type", mime)
 			http.ServeFile(rsp, req, thumb_path)
-			runtime.GC()
 			return nil
 		}
 	}
 
 	// Serve actual image contents:
+	if img.Kind == "svg" {
+		// SVGs are documents; keep them from running scripts or loading anything if sanitizing missed something:
+		rsp.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; img-src data:; sandbox")
+		rsp.Header().Set("X-Content-Type-Options", "nosniff")
+	}
 	if xrGif != "" {
 		// Pass request to nginx to serve static content file:
 		redirPath := path.Join(xrGif, img_name+req_ext)
@@ -1288,7 +1795,6 @@ func requestHandler(rsp http.ResponseWriter, req *http.Request) *web.Error {
 		rsp.Header().Set("X-Accel-Redirect", redirPath)
 		rsp.Header().Set("Content-Type", mime)
 		rsp.WriteHeader(200)
-		runtime.GC()
 		return nil
 	} else {
 		// Serve content directly with the proper mime-type:
@@ -1296,7 +1802,6 @@ func requestHandler(rsp http.ResponseWriter, req *http.Request) *web.Error {
 
 		rsp.Header().Set("Content-Type", mime)
 		http.ServeFile(rsp, req, local_path)
-		runtime.GC()
 		return nil
 	}
 }